@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// averagedLabel holds the results of AveragedQueries for the test images of one label
+type averagedLabel struct {
+	images, singleCorrect    int
+	prototypes, protoCorrect int
+}
+
+// AveragedQueries groups the test images by label, averages the embeddings of every
+// cfg.AverageQueries consecutive images of a label into one query and classifies it by
+// its nearest neighbor. The images themselves are classified
+// the same way, so the accuracy per label shows how much averaging denoises the query,
+// most visibly with -noise. A label's last images that do not fill a group are left out
+// of both. The averaged queries that are misclassified are listed with their images.
+func AveragedQueries(rdb *redis.Client, cfg Config) error {
+	if cfg.AverageQueries < 2 {
+		return fmt.Errorf("-average-queries needs at least 2 images per query, got %d", cfg.AverageQueries)
+	}
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	mask, err := parseMask(cfg.Mask)
+	if err != nil {
+		return err
+	}
+	noise := newPixelNoise(cfg)
+	weights, err := queryPixelWeights(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	s := newSearcher(cfg, storage)
+
+	groups := map[int][]int{}
+	for i, record := range test {
+		label, err := strconv.Atoi(record[0])
+		if err != nil {
+			return err
+		}
+		groups[label] = append(groups[label], i)
+	}
+	labels := make([]int, 0, len(groups))
+	for label := range groups {
+		labels = append(labels, label)
+	}
+	sort.Ints(labels)
+
+	results := map[int]*averagedLabel{}
+	var misses []string
+	start := time.Now()
+	for _, label := range labels {
+		results[label] = &averagedLabel{}
+		images := groups[label]
+		for first := 0; first+cfg.AverageQueries <= len(images); first += cfg.AverageQueries {
+			if cfg.MaxTestDuration > 0 && time.Since(start) >= cfg.MaxTestDuration {
+				break
+			}
+			group := images[first : first+cfg.AverageQueries]
+			average := make([]float32, NumPixels)
+			for _, i := range group {
+				embedding, err := cfg.parsePixels(test[i][1:])
+				if err != nil {
+					return err
+				}
+				mask.apply(embedding)
+				noise.apply(embedding, i)
+				for p, v := range embedding {
+					average[p] += v / float32(len(group))
+				}
+				weights.apply(embedding)
+				nearest, _, err := s.searchVectorInRedis(rdb, embedding)
+				if err != nil {
+					return err
+				}
+				results[label].images++
+				if nearest.Label == label {
+					results[label].singleCorrect++
+				}
+			}
+
+			// The weights scale every pixel, so they apply to the average as to its images
+			weights.apply(average)
+			nearest, _, err := s.searchVectorInRedis(rdb, average)
+			if err != nil {
+				return err
+			}
+			results[label].prototypes++
+			if nearest.Label == label {
+				results[label].protoCorrect++
+			} else {
+				indices := make([]string, len(group))
+				for n, i := range group {
+					indices[n] = strconv.Itoa(i)
+				}
+				misses = append(misses, fmt.Sprintf("Averaged query of label %d over test images %s: predicted %d (nearest %s)", label, strings.Join(indices, ","), nearest.Label, nearest.Key))
+			}
+		}
+	}
+
+	var total averagedLabel
+	fmt.Printf("Averaged queries of %d test images each, nearest neighbor on mnist_index\n", cfg.AverageQueries)
+	fmt.Printf("%-6s %8s %10s %12s %16s\n", "Label", "Images", "Single", "Prototypes", "Averaged")
+	for _, label := range labels {
+		r := results[label]
+		if r.prototypes == 0 {
+			continue
+		}
+		fmt.Printf("%-6d %8d %9.2f%% %12d %15.2f%%\n", label, r.images, 100*float64(r.singleCorrect)/float64(r.images), r.prototypes, 100*float64(r.protoCorrect)/float64(r.prototypes))
+		total.images += r.images
+		total.singleCorrect += r.singleCorrect
+		total.prototypes += r.prototypes
+		total.protoCorrect += r.protoCorrect
+	}
+	if total.prototypes == 0 {
+		return fmt.Errorf("no label has %d test images to average", cfg.AverageQueries)
+	}
+	fmt.Printf("%-6s %8d %9.2f%% %12d %15.2f%%\n", "All", total.images, 100*float64(total.singleCorrect)/float64(total.images), total.prototypes, 100*float64(total.protoCorrect)/float64(total.prototypes))
+	for _, miss := range misses {
+		fmt.Println(miss)
+	}
+	return nil
+}
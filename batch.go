@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BatchError reports the queries of a SearchBatch call that failed, by position
+// in the batch. The results of the other queries are still valid.
+type BatchError struct {
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	positions := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		positions = append(positions, i)
+	}
+	sort.Ints(positions)
+
+	var messages []string
+	for _, i := range positions {
+		messages = append(messages, fmt.Sprintf("query %d: %v", i, e.Errors[i]))
+	}
+	return fmt.Sprintf("%d of the batch queries failed: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+// SearchBatch runs a KNN query for each embedding on the mnist_index in a single
+// pipeline round trip, with the storage, metric and timeouts of cfg. The returned slice
+// has one entry per embedding. When some of the queries fail their entries are nil and
+// the error is a *BatchError listing them; the entries of the successful queries are
+// filled in either way.
+func SearchBatch(rdb *redis.Client, cfg Config, embeddings [][]float32, k int) ([][]SearchResult, error) {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := newSearcher(cfg, storage)
+	return s.knnSearchBatch(s.ctx, rdb, "mnist_index", embeddings, k)
+}
+
+// knnSearchBatch runs SearchBatch on the given index with the storage, metric and
+// timeouts of the searcher. The pipeline is traced as one span and its queries are
+// sampled for FT.PROFILE like single ones, against their share of the pipeline time.
+func (s *searcher) knnSearchBatch(ctx context.Context, rdb *redis.Client, index string, embeddings [][]float32, k int) ([][]SearchResult, error) {
+	queryCtx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+	spanCtx, span := tracer.Start(queryCtx, "FT.SEARCH KNN pipeline", trace.WithAttributes(
+		attribute.String("index", index),
+		attribute.Int("k", k),
+		attribute.String("metric", s.metric),
+		attribute.Int("queries", len(embeddings)),
+	))
+	defer span.End()
+
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.Cmd, len(embeddings))
+	queries := make([][]interface{}, len(embeddings))
+	batchErr := &BatchError{Errors: map[int]error{}}
+	for i, embedding := range embeddings {
+		if err := checkQueryVector(embedding, s.metric); err != nil {
+			batchErr.Errors[i] = err
+			continue
+		}
+		query, err := buildKNNQuery(KNNQuery{Index: index, K: k, Storage: s.storage, Timeout: s.serverTimeout, Blob: s.storage.vectorBlob(embedding)})
+		if err != nil {
+			return nil, err
+		}
+		queries[i] = query
+		cmds[i] = pipe.Do(spanCtx, query...)
+	}
+	// Per command errors are collected below, Exec only reports the first one or why the
+	// pipeline was not sent at all
+	start := time.Now()
+	_, execErr := pipe.Exec(spanCtx)
+	elapsed := time.Since(start)
+	if execErr != nil {
+		span.RecordError(execErr)
+		span.SetStatus(codes.Error, execErr.Error())
+	}
+	share := elapsed / time.Duration(max(len(queries)-len(batchErr.Errors), 1))
+
+	results := make([][]SearchResult, len(embeddings))
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		reply, err := cmd.Result()
+		if err == nil && reply == nil && execErr != nil {
+			// The pipeline failed before the command was sent, e.g. opening the connection
+			err = execErr
+		}
+		s.debugQuery(queries[i], reply, err)
+		if err == nil {
+			var total int64
+			results[i], total, err = parseSearchReply(reply, s.storage)
+			if err == nil && len(results[i]) == 0 {
+				err = errNoNeighbors
+			}
+			if err == nil {
+				s.warnSearchLimits(reply, total, len(results[i]), k)
+			}
+			results[i] = s.reportedDistances(results[i])
+		}
+		err = s.timeoutError(err, reply)
+		if err != nil {
+			batchErr.Errors[i] = err
+			continue
+		}
+		s.sampleProfile(ctx, rdb, queries[i], share)
+	}
+	span.SetAttributes(attribute.Int("failed", len(batchErr.Errors)))
+	if len(batchErr.Errors) > 0 {
+		return results, batchErr
+	}
+	return results, nil
+}
+
+// classifyBatch classifies several test CSV rows with one SearchBatch call. The
+// duration of each result is the batch time divided by its size.
+func (c *Classifier) classifyBatch(rdb *redis.Client, batch []int, records [][]string) []testResult {
+	results := make([]testResult, len(batch))
+	var embeddings [][]float32
+	var positions []int
+	for n, i := range batch {
+		results[n].index = i
+		expected, err := strconv.Atoi(records[i][0])
+		if err != nil {
+			results[n].err = err
+			continue
+		}
+		results[n].expected = expected
+		embedding, err := c.cfg.parsePixels(records[i][1:])
+		if err != nil {
+			results[n].err = err
+			continue
+		}
+		c.mask.apply(embedding)
+		c.noise.apply(embedding, i)
+		results[n].embedding = append([]float32(nil), embedding...)
+		c.weights.apply(embedding)
+		embeddings = append(embeddings, embedding)
+		positions = append(positions, n)
+	}
+	if len(embeddings) == 0 {
+		return results
+	}
+
+	start := time.Now()
+	neighbors, err := c.searchBatch(rdb, embeddings)
+	amortized := time.Since(start) / time.Duration(len(embeddings))
+	duration := amortized.Milliseconds()
+
+	batchErr, _ := err.(*BatchError)
+	if err != nil && batchErr == nil {
+		for _, n := range positions {
+			results[n].err = err
+		}
+		return results
+	}
+	for q, n := range positions {
+		if batchErr != nil && errors.Is(batchErr.Errors[q], errZeroVector) {
+			results[n].found = rejectedLabel
+			results[n].zeroVector = true
+			continue
+		}
+		if batchErr != nil && batchErr.Errors[q] != nil {
+			results[n].err = batchErr.Errors[q]
+			continue
+		}
+		results[n].found = c.voter.vote(neighbors[q])
+		results[n].unweighted = c.voter.unweightedVote(neighbors[q])
+		results[n].agreeing = countLabel(neighbors[q], results[n].found)
+		results[n].fetched = len(neighbors[q])
+		results[n].distance = neighbors[q][0].Distance
+		results[n].nearest = neighbors[q][0]
+		results[n].neighbors = neighbors[q]
+		results[n].duration = duration
+		results[n].amortized = amortized
+	}
+	if every := c.cfg.IsolatedEvery; every > 0 && (batch[0]/max(c.cfg.Batch, 1))%every == 0 && results[positions[0]].err == nil && !results[positions[0]].zeroVector {
+		// The sampled query runs after its batch so it does not slow the batch down
+		start := time.Now()
+		_, _, err := c.search(rdb, embeddings[0])
+		if err == nil {
+			results[positions[0]].isolated = time.Since(start)
+		}
+	}
+	return results
+}
+
+// printPerSampleCost prints the amortized per-sample cost of the batched queries next
+// to the time of the sampled queries run on their own and the speedup of batching
+func (s evalSummary) printPerSampleCost() {
+	count := s.durations.Count()
+	if count == 0 {
+		return
+	}
+	fmt.Printf("Amortized Per-Sample Cost = %s over %d queries\n", (s.amortized / time.Duration(count)).Round(time.Microsecond), count)
+	if s.isolatedCount == 0 || s.isolatedAmortized == 0 {
+		return
+	}
+	isolated := s.isolated / time.Duration(s.isolatedCount)
+	amortized := s.isolatedAmortized / time.Duration(s.isolatedCount)
+	fmt.Printf("Isolated Single-Query Cost = %s over %d sampled queries (amortized %s), Batching Speedup = %.2fx\n",
+		isolated.Round(time.Microsecond), s.isolatedCount, amortized.Round(time.Microsecond), isolated.Seconds()/amortized.Seconds())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Vector index algorithms selectable with -algorithm
+const (
+	// algorithmFlat compares the query with every stored vector, the neighbors are exact.
+	algorithmFlat = "FLAT"
+	// algorithmHNSW searches a navigable small world graph, the neighbors are approximate.
+	algorithmHNSW = "HNSW"
+)
+
+// validAlgorithm reports an error for a vector algorithm RediSearch does not know
+func validAlgorithm(a string) error {
+	switch a {
+	case algorithmFlat, algorithmHNSW:
+		return nil
+	}
+	return fmt.Errorf("unknown algorithm %q, expected %s or %s", a, algorithmFlat, algorithmHNSW)
+}
+
+// indexInfoValue returns the value of a field of FT.INFO as a number
+func indexInfoValue(rdb *redis.Client, index, field string) (float64, error) {
+	reply, err := rdb.Do(ctx, "FT.INFO", index).Result()
+	if err != nil {
+		return 0, err
+	}
+	info, _ := replyMap(reply)
+	value, ok := info[field]
+	if !ok {
+		return 0, fmt.Errorf("FT.INFO %s has no %s", index, field)
+	}
+	return replyFloat(value)
+}
+
+// waitForIndexing polls FT.INFO until RediSearch has indexed every existing document
+// of the index and returns how long that took
+func waitForIndexing(rdb *redis.Client, index string) (time.Duration, error) {
+	start := time.Now()
+	for {
+		indexing, err := indexInfoValue(rdb, index, "indexing")
+		if err != nil {
+			return 0, err
+		}
+		if indexing == 0 {
+			return time.Since(start), nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// buildIndex finishes the index after StoreData transferred the documents. With
+// -index-after-load the index is only created now, so RediSearch indexes every stored
+// document in one background scan. Otherwise the documents were indexed as they
+// arrived and only the backlog of the last writes is waited for.
+func buildIndex(rdb *redis.Client, cfg Config) (time.Duration, error) {
+	start := time.Now()
+	if cfg.IndexAfterLoad {
+		err := createIndexIfMissing(rdb, cfg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := waitForIndexing(rdb, "mnist_index")
+	if err != nil {
+		return 0, err
+	}
+	build := time.Since(start)
+	slog.Info("Index built.", slog.String("algorithm", cfg.indexAlgorithm()), slog.Bool("after load", cfg.IndexAfterLoad), slog.Duration("duration", build))
+	return build, nil
+}
+
+// buildMode names how the index was built for the load report
+func buildMode(cfg Config) string {
+	if cfg.IndexAfterLoad {
+		return "after load"
+	}
+	return "incremental"
+}
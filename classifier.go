@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Classifier labels images by a KNN query on a Redis vector index. It holds the client,
+// the context of its queries and every option of the classification: the index, K, the
+// searcher with the metric, storage mode, timeouts and profiling, and the
+// normalization, so independent classifiers can be used side by side.
+type Classifier struct {
+	ctx      context.Context
+	rdb      *redis.Client
+	cfg      Config
+	index    string
+	k        int
+	searcher *searcher
+	voter    *voter
+	// mask is zeroed in the test images before they are queried, nil for none
+	mask *pixelMask
+	// noise is added to the test images before they are queried, nil for none
+	noise *pixelNoise
+	// weights are the pixel weights of the stored data, applied to every query last
+	weights pixelWeights
+	// logger receives the progress and warnings of the classifier, see Config.Logger
+	logger *slog.Logger
+}
+
+// Prediction is the label voted for one image and the neighbors it was voted from
+type Prediction struct {
+	Label    int     `json:"label"`
+	Distance float64 `json:"distance"`
+	// Confidence is the share of the neighbors that voted for Label.
+	Confidence float64 `json:"confidence"`
+	// Similarity is the cosine similarity of the nearest neighbor with the COSINE metric.
+	Similarity *float64       `json:"similarity,omitempty"`
+	Neighbors  []SearchResult `json:"neighbors"`
+	// Documents are the stored documents of the neighbors, only filled in on request.
+	Documents []NeighborDocument `json:"documents,omitempty"`
+}
+
+// NewClassifier creates a classifier querying rdb with the options of cfg. The label
+// priors are loaded when cfg.PriorWeighting is set. It logs through cfg.Logger.
+func NewClassifier(rdb *redis.Client, cfg Config) (*Classifier, error) {
+	if cfg.Storage == "" {
+		cfg.Storage = storageJSON
+	}
+	if cfg.TieBreak == "" {
+		cfg.TieBreak = tieBreakNearest
+	}
+	if err := validTieBreak(cfg.TieBreak); err != nil {
+		return nil, err
+	}
+	if cfg.Metric == "" {
+		cfg.Metric = metricL2
+	}
+	if err := validMetric(cfg.Metric); err != nil {
+		return nil, err
+	}
+	s, err := storageOf(cfg)
+	if err != nil {
+		return nil, err
+	}
+	mask, err := parseMask(cfg.Mask)
+	if err != nil {
+		return nil, err
+	}
+	weights, err := queryPixelWeights(rdb, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Classifier{
+		ctx:      cfg.context(),
+		rdb:      rdb,
+		cfg:      cfg,
+		index:    "mnist_index",
+		k:        cfg.K,
+		searcher: newSearcher(cfg, s),
+		voter:    newVoter(cfg.TieBreak, cfg.Seed),
+		mask:     mask,
+		noise:    newPixelNoise(cfg),
+		weights:  weights,
+		logger:   cfg.logger(),
+	}
+	if c.k < 1 {
+		c.k = 1
+	}
+	switch cfg.Classifier {
+	case "", classifierKNN:
+	case classifierCentroid:
+		// The nearest class mean decides alone
+		c.index = prototypeIndex
+		c.k = 1
+	default:
+		return nil, fmt.Errorf("unknown classifier %q, expected knn or centroid", cfg.Classifier)
+	}
+	if cfg.PriorWeighting {
+		priors, err := loadPriors(rdb)
+		if err != nil {
+			return nil, err
+		}
+		c.voter.priors = priors
+	}
+	return c, nil
+}
+
+// Index returns the name of the index the classifier queries
+func (c *Classifier) Index() string {
+	return c.index
+}
+
+// Predict classifies one image given as 784 grayscale pixels in 0-255, row by row
+func (c *Classifier) Predict(pixels []int) (Prediction, error) {
+	embedding, err := queryEmbedding(c.cfg, pixels)
+	if err != nil {
+		return Prediction{}, err
+	}
+	return c.predictEmbedding(embedding)
+}
+
+// predictEmbedding classifies one embedding built by queryEmbedding
+func (c *Classifier) predictEmbedding(embedding []float32) (Prediction, error) {
+	c.weights.apply(embedding)
+	neighbors, _, err := c.search(c.rdb, embedding)
+	if err != nil {
+		return Prediction{}, err
+	}
+	return c.prediction(neighbors), nil
+}
+
+// PredictBatch classifies several images with one pipelined round trip. When some of
+// the queries fail the error is a *BatchError and the other predictions are filled in.
+func (c *Classifier) PredictBatch(images [][]int) ([]Prediction, error) {
+	embeddings := make([][]float32, len(images))
+	for i, pixels := range images {
+		embedding, err := queryEmbedding(c.cfg, pixels)
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %w", i, err)
+		}
+		embeddings[i] = embedding
+	}
+	return c.predictEmbeddings(embeddings)
+}
+
+// predictEmbeddings classifies several embeddings built by queryEmbedding with one
+// pipelined round trip, like PredictBatch
+func (c *Classifier) predictEmbeddings(embeddings [][]float32) ([]Prediction, error) {
+	for _, embedding := range embeddings {
+		c.weights.apply(embedding)
+	}
+	neighbors, err := c.searchBatch(c.rdb, embeddings)
+	if _, ok := err.(*BatchError); err != nil && !ok {
+		return nil, err
+	}
+	predictions := make([]Prediction, len(embeddings))
+	for i := range neighbors {
+		if neighbors[i] != nil {
+			predictions[i] = c.prediction(neighbors[i])
+		}
+	}
+	return predictions, err
+}
+
+// prediction votes the label of a query from its neighbors
+func (c *Classifier) prediction(neighbors []SearchResult) Prediction {
+	label := c.voter.vote(neighbors)
+	return Prediction{
+		Label:      label,
+		Distance:   neighbors[0].Distance,
+		Confidence: float64(countLabel(neighbors, label)) / float64(len(neighbors)),
+		Similarity: neighbors[0].Similarity,
+		Neighbors:  neighbors,
+	}
+}
+
+// search runs the KNN query of one embedding with rdb, which is the classifier client
+// or the dedicated client of a worker
+func (c *Classifier) search(rdb *redis.Client, embedding []float32) ([]SearchResult, int64, error) {
+	neighbors, _, duration, err := c.searcher.knnSearch(c.ctx, rdb, c.index, embedding, c.k)
+	return neighbors, duration, err
+}
+
+// searchBatch runs the KNN queries of several embeddings in one pipeline with rdb
+func (c *Classifier) searchBatch(rdb *redis.Client, embeddings [][]float32) ([][]SearchResult, error) {
+	return c.searcher.knnSearchBatch(c.ctx, rdb, c.index, embeddings, c.k)
+}
+
+// EvalStatus is the outcome of one test record in an evaluation
+type EvalStatus string
+
+const (
+	// EvalAnswered records were voted a label
+	EvalAnswered EvalStatus = "answered"
+	// EvalAbstained records were searched but the vote declined to answer
+	EvalAbstained EvalStatus = "abstained"
+	// EvalZeroVector records were not searched, their vector is all zero under a metric
+	// that cannot rank it
+	EvalZeroVector EvalStatus = "zero-vector"
+	// EvalTimeout records were stopped by the server TIMEOUT or the client -query-timeout
+	EvalTimeout EvalStatus = "timeout"
+	// EvalRejected records could not be classified, Err says why
+	EvalRejected EvalStatus = "rejected"
+	// EvalSkipped records were never classified, the evaluation budget ran out or the
+	// evaluation stopped at an error first
+	EvalSkipped EvalStatus = "skipped"
+)
+
+// EvalResult is the outcome of one test record passed to the onResult hook of Evaluate
+type EvalResult struct {
+	Index  int
+	Status EvalStatus
+	// Expected is the label of the record, unset for skipped records
+	Expected int
+	// Label is the voted label, rejectedLabel unless the record was answered
+	Label int
+	// Nearest is the nearest neighbor as stored, its Label is the stored one and not the
+	// vote, Neighbors all of them. Both are only set for answered and abstained records.
+	Nearest   SearchResult
+	Neighbors []SearchResult
+	// Duration is the query time in milliseconds
+	Duration int64
+	// Embedding is the query vector before the pixel weights
+	Embedding []float32
+	Err       error
+}
+
+// Evaluate classifies the test records with cfg.Workers goroutines and prints the results.
+// Workers share the client and its connection pool unless cfg.ClientPerWorker is set.
+// When onResult is not nil it is called once for every record with its outcome, in the
+// order the results arrive and the skipped records last. It is called from a single
+// goroutine, after the CLI output of the record.
+func (c *Classifier) Evaluate(records [][]string, onResult func(EvalResult)) (evalSummary, error) {
+	rdb, cfg := c.rdb, c.cfg
+	profiled := &c.searcher.profile.breakdown
+	profiled.reset()
+
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	evalCtx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	batchSize := cfg.Batch
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	jobs := make(chan []int)
+	results := make(chan testResult)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			client := rdb
+			if cfg.ClientPerWorker {
+				opt := *rdb.Options()
+				client = redis.NewClient(&opt)
+				defer client.Close()
+			}
+			for batch := range jobs {
+				if batchSize == 1 {
+					r := c.classifyRecord(client, batch[0], records[batch[0]])
+					r.worker = w
+					results <- r
+					continue
+				}
+				for _, r := range c.classifyBatch(client, batch, records) {
+					r.worker = w
+					results <- r
+				}
+			}
+		}(w)
+	}
+
+	evalStart := time.Now()
+	// budgetReached is set when the rows left were skipped for cfg.MaxTestDuration
+	var budgetReached atomic.Bool
+	go func() {
+		defer close(jobs)
+		// Iterate over each row in the test CSV file, batchSize rows at a time
+		for start := 0; start < len(records); start += batchSize {
+			// Stop early once the evaluation budget is spent
+			if cfg.MaxTestDuration > 0 && time.Since(evalStart) >= cfg.MaxTestDuration {
+				budgetReached.Store(true)
+				return
+			}
+			var batch []int
+			for i := start; i < start+batchSize && i < len(records); i++ {
+				batch = append(batch, i)
+			}
+			select {
+			case jobs <- batch:
+			case <-evalCtx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	summary := evalSummary{headline: cfg.HeadlineAccuracy, classes: classCounts{}, confused: confusions{}, agreement: map[int]int{}, durations: &Stats{}}
+	var correctDistances, wrongDistances []float64
+	var wrongResults []testResult
+	var firstErr error
+	perWorker := make([]int, workers)
+	printOutcome := c.printOutcome(&summary, len(records))
+	delivered := make([]bool, len(records))
+	deliver := func(outcome EvalResult) {
+		delivered[outcome.Index] = true
+		printOutcome(outcome)
+		if onResult != nil {
+			onResult(outcome)
+		}
+	}
+	for r := range results {
+		if isTimeout(r.err) {
+			summary.timeouts++
+			deliver(EvalResult{Index: r.index, Status: EvalTimeout, Expected: r.expected, Label: rejectedLabel, Embedding: r.embedding, Err: r.err})
+			continue
+		}
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+				cancel()
+			}
+			deliver(EvalResult{Index: r.index, Status: EvalRejected, Expected: r.expected, Label: rejectedLabel, Embedding: r.embedding, Err: r.err})
+			continue
+		}
+		if r.zeroVector {
+			// Nothing was searched, the image is counted as rejected without a duration
+			summary.classes.add(r.expected, rejectedLabel)
+			summary.rejected++
+			summary.zeroVectors++
+			deliver(EvalResult{Index: r.index, Status: EvalZeroVector, Expected: r.expected, Label: rejectedLabel, Embedding: r.embedding})
+			continue
+		}
+		summary.durations.Record(r.duration)
+		summary.amortized += r.amortized
+		if r.isolated > 0 {
+			summary.isolated += r.isolated
+			summary.isolatedAmortized += r.amortized
+			summary.isolatedCount++
+		}
+		perWorker[r.worker]++
+		summary.classes.add(r.expected, r.found)
+		if c.k > 1 {
+			summary.agreement[r.agreeing]++
+		}
+		summary.fetched += r.fetched
+		summary.used += min(r.fetched, c.k)
+		if r.fetched < c.k {
+			summary.short++
+			summary.shortFetched += r.fetched
+		}
+		if r.unweighted == r.expected {
+			summary.unweightedCorrect++
+		}
+		status := EvalAnswered
+		if r.found == rejectedLabel {
+			summary.rejected++
+			status = EvalAbstained
+		} else if r.expected == r.found {
+			summary.correct++
+			correctDistances = append(correctDistances, r.distance)
+		} else {
+			wrongDistances = append(wrongDistances, r.distance)
+			summary.confused[labelPair{expected: r.expected, found: r.found}]++
+			summary.wrong++
+			if cfg.SortErrors != 0 {
+				wrongResults = append(wrongResults, r)
+			}
+		}
+		deliver(EvalResult{Index: r.index, Status: status, Expected: r.expected, Label: r.found, Nearest: r.nearest, Neighbors: r.neighbors,
+			Duration: r.duration, Embedding: r.embedding})
+	}
+	summary.elapsed = time.Since(evalStart)
+	var skipped int
+	for i, done := range delivered {
+		if !done {
+			skipped++
+			deliver(EvalResult{Index: i, Status: EvalSkipped, Label: rejectedLabel})
+		}
+	}
+	if firstErr != nil {
+		return summary, firstErr
+	}
+
+	processed := summary.processed()
+	if processed == 0 {
+		return summary, fmt.Errorf("no test images were evaluated")
+	}
+	if budgetReached.Load() {
+		fmt.Printf("Partial evaluation over %d of %d test images (budget of %s reached)\n", processed, len(records), cfg.MaxTestDuration)
+	}
+	if skipped > 0 {
+		fmt.Printf("Number of Skipped = %d (not evaluated)\n", skipped)
+	}
+	fmt.Printf("Number of Correct guess = %d\n", summary.correct)
+	fmt.Printf("Number of Wrong guess = %d\n", summary.wrong)
+	if summary.timeouts > 0 {
+		fmt.Printf("Number of Timeouts = %d (not counted in the accuracy)\n", summary.timeouts)
+	}
+	if summary.rejected > 0 && summary.headline == accuracyAll {
+		fmt.Printf("Number of Rejected = %d (counted as wrong in the accuracy)\n", summary.rejected)
+	} else if summary.rejected > 0 {
+		fmt.Printf("Number of Rejected = %d (not counted in the accuracy)\n", summary.rejected)
+	}
+	if summary.zeroVectors > 0 {
+		fmt.Printf("Number of All Zero Queries = %d (rejected, not sent to Redis)\n", summary.zeroVectors)
+	}
+	fmt.Printf("Accuracy over accepted samples = %.2f%% (%d of %d answered)\n", summary.acceptedAccuracy(), summary.correct+summary.wrong, processed)
+	fmt.Printf("Accuracy over all samples = %.2f%% (rejections count as wrong)\n", summary.allAccuracy())
+	fmt.Printf("Accuracy = %d%%\n", int(summary.accuracy()))
+	if cfg.PriorWeighting && summary.correct+summary.wrong > 0 {
+		fmt.Printf("Accuracy without prior weighting = %.2f%%, with prior weighting = %.2f%%\n",
+			100*float64(summary.unweightedCorrect)/float64(summary.correct+summary.wrong), summary.accuracy())
+	}
+	summary.classes.print()
+	summary.classes.printReport()
+	if cfg.TopConfused > 0 && len(summary.confused) > 0 {
+		summary.confused.printTop(cfg.TopConfused)
+	}
+	if c.k > 1 {
+		printAgreement(summary.agreement, c.k)
+	}
+	if cfg.SortErrors != 0 && len(wrongResults) > 0 {
+		c.printSortedErrors(wrongResults, cfg.SortErrors, cfg.SortErrorsASCII)
+	}
+	if cfg.HistogramBins > 0 {
+		hist := newDistanceHistogram(cfg.HistogramBins, correctDistances, wrongDistances)
+		hist.print(c.searcher.distanceName())
+		if cfg.HistogramOut != "" {
+			err := hist.writeCSV(cfg.HistogramOut)
+			if err != nil {
+				return summary, err
+			}
+		}
+	}
+	fmt.Printf("Redis Vector Search Min Duration = %dms\n", summary.durations.Min())
+	fmt.Printf("Redis Vector Search Max Duration = %dms\n", summary.durations.Max())
+	fmt.Printf("Redis Vector Search Average Duration = %dms\n", summary.durations.Average())
+	fmt.Printf("Redis Vector Search P50/P95/P99 Duration = %dms / %dms / %dms\n",
+		summary.durations.Percentile(50), summary.durations.Percentile(95), summary.durations.Percentile(99))
+	profiled.print()
+	if workers > 1 {
+		for w, count := range perWorker {
+			fmt.Printf("Worker %d Throughput = %.1f queries/sec\n", w, float64(count)/summary.elapsed.Seconds())
+		}
+	}
+	// A strict filter or a small index leaves fewer than K neighbors to vote
+	fmt.Printf("Neighbors Requested = %d, Fetched = %d, Used in Votes = %d\n", summary.durations.Count()*c.k, summary.fetched, summary.used)
+	if summary.short > 0 {
+		fmt.Printf("Queries with fewer than %d neighbors = %d (%.2f%%), their vote used %.2f neighbors on average\n",
+			c.k, summary.short, 100*float64(summary.short)/float64(summary.durations.Count()), float64(summary.shortFetched)/float64(summary.short))
+	}
+	fmt.Printf("Redis Vector Search Throughput = %.1f queries/sec (batch %d)\n", summary.queriesPerSecond(), batchSize)
+	if batchSize > 1 {
+		summary.printPerSampleCost()
+	}
+
+	return summary, nil
+}
+
+// printOutcome returns the hook Evaluate prints the outcome of every record with: one
+// line per searched or timed out image, the first cfg.ShowErrors misclassified images
+// and every cfg.ProgressEvery images a progress line with the running totals of summary
+func (c *Classifier) printOutcome(summary *evalSummary, total int) func(EvalResult) {
+	return func(r EvalResult) {
+		switch r.Status {
+		case EvalTimeout:
+			fmt.Printf("Test image %d: expected = %d, timed out: %v\n", r.Index, r.Expected, r.Err)
+			return
+		case EvalZeroVector:
+			fmt.Printf("Test image %d: expected = %d, rejected: all zero vector under %s\n", r.Index, r.Expected, c.searcher.metric)
+		case EvalAnswered, EvalAbstained:
+			// Print the expected result and the found label
+			fmt.Printf("Test image %d: expected = %d, found = %d in %dms\n", r.Index, r.Expected, r.Label, r.Duration)
+			// summary.wrong already counts this image
+			if r.Status == EvalAnswered && r.Label != r.Expected && summary.wrong <= c.cfg.ShowErrors {
+				fmt.Printf("Misclassified test image %d: expected = %d, found = %d\n%s", r.Index, r.Expected, r.Label, RenderASCII(ReshapeToGrid(r.Embedding)))
+				if c.searcher.storage.Pixels {
+					c.printNeighborImages(r.Neighbors)
+				}
+			}
+		default:
+			return
+		}
+		if every := c.cfg.ProgressEvery; every > 0 && summary.processed()%every == 0 {
+			c.logger.Info("Progress.", slog.Int("processed", summary.processed()), slog.Int("total", total),
+				slog.String("running accuracy", fmt.Sprintf("%.2f%%", summary.accuracy())), slog.Int64("running average ms", summary.durations.Average()))
+		}
+	}
+}
+
+// classifyRecord searches the nearest neighbors of a single test CSV row
+func (c *Classifier) classifyRecord(rdb *redis.Client, i int, record []string) testResult {
+	r := testResult{index: i}
+
+	// The first value is the expected result (the label)
+	expectedResult, err := strconv.Atoi(record[0])
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.expected = expectedResult
+
+	// The rest are pixel values
+	embedding, err := c.cfg.parsePixels(record[1:])
+	if err != nil {
+		r.err = err
+		return r
+	}
+
+	c.mask.apply(embedding)
+	c.noise.apply(embedding, i)
+	r.embedding = append([]float32(nil), embedding...)
+	c.weights.apply(embedding)
+
+	// Perform the FT.SEARCH query using the normalized embedding
+	neighbors, duration, err := c.search(rdb, embedding)
+	if errors.Is(err, errZeroVector) {
+		r.found = rejectedLabel
+		r.zeroVector = true
+		return r
+	}
+	if err != nil {
+		r.err = err
+		return r
+	}
+	r.found = c.voter.vote(neighbors)
+	r.unweighted = c.voter.unweightedVote(neighbors)
+	r.agreeing = countLabel(neighbors, r.found)
+	r.fetched = len(neighbors)
+	r.distance = neighbors[0].Distance
+	r.nearest = neighbors[0]
+	r.neighbors = neighbors
+	r.duration = duration
+	r.amortized = time.Duration(duration) * time.Millisecond
+	return r
+}
+
+// printNeighborImages renders the stored pixels of the neighbors, written with
+// -store-pixels, fetching their documents in one round trip
+func (c *Classifier) printNeighborImages(neighbors []SearchResult) {
+	docs, err := fetchNeighborDocuments(c.ctx, c.rdb, c.searcher.storage, neighborKeysOf(neighbors))
+	if err != nil {
+		fmt.Printf("Could not fetch the neighbor documents: %v\n", err)
+		return
+	}
+	for i, doc := range docs {
+		if doc.Pixels == nil {
+			fmt.Printf("Training image %s has no stored pixels\n", doc.Key)
+			continue
+		}
+		fmt.Printf("Neighbor %d, training image %s: label = %d, distance = %.4f\n%s", i+1, doc.Key, doc.Label, neighbors[i].Distance, RenderASCII(ReshapeToGrid(doc.Pixels)))
+	}
+}
+
+// explain fills in the stored documents of the neighbors of a prediction
+func (c *Classifier) explain(p *Prediction) error {
+	docs, err := fetchNeighborDocuments(c.ctx, c.rdb, c.searcher.storage, neighborKeysOf(p.Neighbors))
+	if err != nil {
+		return err
+	}
+	p.Documents = docs
+	return nil
+}
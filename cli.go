@@ -0,0 +1,602 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisFlags registers the options of the connection, the storage layout and the queries
+func redisFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Password, "password", "", "Redis password, visible in the process list, prefer -password-file or REDIS_PASSWORD")
+	fs.StringVar(&cfg.PasswordFile, "password-file", "", "read the Redis password from the first line of this file")
+	fs.IntVar(&cfg.DB, "db", 0, "logical Redis database to use")
+	fs.IntVar(&cfg.Protocol, "protocol", 2, "RESP protocol version of the connection, 2 or 3")
+	fs.StringVar(&cfg.Storage, "storage", storageJSON, "store the training images as json documents or hash keys, queries return the label field of that mode")
+	fs.StringVar(&cfg.KeyTemplate, "key-template", defaultKeyTemplate, "layout of the training keys with the placeholders {idx}, {label} and {split}, the text before the first one is the index PREFIX")
+	fs.StringVar(&cfg.DistanceAlias, "distance-alias", defaultDistanceAlias, "name the KNN distance is returned under")
+	fs.BoolVar(&cfg.StoreNorms, "store-norms", false, "store the L2 norm of every embedding in a norm field and return it with the neighbors")
+	fs.BoolVar(&cfg.StorePixels, "store-pixels", false, "store the pixels of every training image, about 1 KB each, and render the nearest one of every -show-errors image")
+	fs.StringVar(&cfg.Metric, "metric", metricL2, "distance metric of the index: L2, COSINE or IP")
+	fs.StringVar(&cfg.Algorithm, "algorithm", algorithmFlat, "vector algorithm of the index: FLAT (exact) or HNSW (approximate)")
+	fs.StringVar(&cfg.VectorType, "vector-type", vectorFloat32, "element type of the stored and query vectors: FLOAT32, or FLOAT16 for half the vector memory")
+	fs.DurationVar(&cfg.DialTimeout, "dial-timeout", 5*time.Second, "timeout for establishing a new connection to Redis")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", 3*time.Second, "socket timeout for reading the reply of a command, -1 disables it")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", 3*time.Second, "socket timeout for writing a command, -1 disables it")
+	fs.DurationVar(&cfg.QueryTimeout, "query-timeout", 0, "timeout of a whole KNN query, 0 for no limit")
+	fs.IntVar(&cfg.ReconnectAttempts, "reconnect-attempts", 10, "rebuild the client and resume the load this many times after losing the connection, 0 to exit instead")
+	fs.DurationVar(&cfg.ServerTimeout, "server-timeout", 0, "TIMEOUT sent with every KNN query so RediSearch stops it, 0 keeps the server default")
+	fs.StringVar(&cfg.OTelEndpoint, "otel-endpoint", "", "export OpenTelemetry spans of the Redis calls to this OTLP/HTTP endpoint (e.g. http://localhost:4318)")
+	fs.IntVar(&cfg.DebugQuery, "debug-query", 0, "print the command and raw reply of this many first KNN queries")
+	fs.StringVar(&cfg.SearchConfig, "search-config", "", "comma separated KEY=VALUE RediSearch configs set at startup: MAXSEARCHRESULTS, MAXAGGREGATERESULTS, MAXPREFIXEXPANSIONS, TIMEOUT or ON_TIMEOUT")
+	fs.BoolVar(&cfg.ListIndexes, "list-indexes", false, "print the documents, vector type, dimension, metric, algorithm and memory of every existing index and exit")
+}
+
+// dataFlags registers the CSV files and how their pixels become embeddings
+func dataFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.TrainFile, "train-file", "mnist_train.csv", "CSV file with the training images")
+	fs.StringVar(&cfg.TestFile, "test-file", "mnist_test.csv", "CSV file with the test images")
+	fs.StringVar(&cfg.Delimiter, "delimiter", ",", `field separator of the CSV files, a single character or \t for a tab`)
+	fs.Int64Var(&cfg.Seed, "seed", 1, "seed of the random generator")
+	fs.IntVar(&cfg.Batch, "batch", 1, "number of parsed rows buffered before a pipeline flush: documents written per round trip while loading unless -load-batch is set, test queries sent together while searching")
+	fs.StringVar(&cfg.LabelCol, "label-col", labelFirst, "column holding the label: first, last, or auto to pick the one with only digits 0-9")
+	fs.StringVar(&cfg.PixelType, "pixel-type", pixelInt, "how the CSV pixels are written: int for 0-255, float for values in [0,1], or auto to tell from the first rows")
+	fs.StringVar(&cfg.PixelWeights, "pixel-weights", "", "weigh every pixel of the stored and query embeddings: variance of the training set, or a file of 784 weights")
+	fs.BoolVar(&cfg.TSV, "tsv", false, "read tab separated files, the same as -delimiter '\\t'")
+	cfg.Normalize = true
+	fs.BoolFunc("no-normalize", "store and query raw 0-255 pixel values instead of dividing them by 255", func(value string) error {
+		raw, err := strconv.ParseBool(value)
+		cfg.Normalize = !raw
+		return err
+	})
+}
+
+// loadFlags registers the options of storing the training images
+func loadFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.Float64Var(&cfg.SampleRate, "sample-rate", 1, "store each training row with this probability, drawn from -seed, 1 stores them all")
+	fs.BoolVar(&cfg.Append, "append", false, "add the training rows after the already stored ones, keeping the existing index and data")
+	fs.BoolVar(&cfg.Reconcile, "reconcile", false, "load on top of existing keys and delete the training keys this load did not write afterwards")
+	fs.BoolVar(&cfg.Force, "force", false, "load the training data even if the database already holds training keys")
+	fs.IntVar(&cfg.LoadBatch, "load-batch", 0, "number of JSON documents written per round trip while loading, 0 uses -batch")
+	fs.IntVar(&cfg.MaxInFlight, "max-in-flight", 0, "send load batches in the background with at most this many documents pending, 0 sends them synchronously")
+	fs.IntVar(&cfg.MaxMemoryMB, "max-memory-mb", 0, "stop the load cleanly once Redis reports more used_memory than this, 0 to disable")
+	fs.IntVar(&cfg.MemoryCheckEvery, "memory-check-every", 1000, "number of stored rows between two INFO memory checks of -max-memory-mb")
+	fs.BoolVar(&cfg.IndexAfterLoad, "index-after-load", false, "create the index only after every training document is stored, so it is built in one pass")
+	fs.StringVar(&cfg.ValFile, "val-file", "", "small validation CSV evaluated against the index every -val-every rows while loading and at the end")
+	fs.IntVar(&cfg.ValEvery, "val-every", 5000, "number of stored rows between two evaluations of -val-file")
+	fs.BoolVar(&cfg.ProfileLoad, "profile-load", false, "print the time spent in each stage of loading the training data")
+	fs.BoolVar(&cfg.Verify, "verify", false, "compare the stored embeddings with the training CSV and exit")
+	fs.IntVar(&cfg.VerifySample, "verify-sample", 1000, "number of random rows checked by -verify")
+	fs.BoolVar(&cfg.VerifyAll, "verify-all", false, "check every row with -verify instead of a sample")
+	fs.IntVar(&cfg.VerifyDecimals, "verify-decimals", defaultVerifyDecimals, "number of decimal places compared by -verify, sets the absolute tolerance to one unit in the last place")
+	fs.Float64Var(&cfg.VerifyAbsTol, "verify-abs-tol", 0, "absolute tolerance of -verify, 0 derives it from -verify-decimals")
+	fs.Float64Var(&cfg.VerifyRelTol, "verify-rel-tol", 0, "tolerance of -verify relative to the expected value, added to the absolute one")
+	fs.StringVar(&cfg.Export, "export", "", "write the stored training documents with keys, labels and embeddings to this JSON lines file and exit")
+	fs.StringVar(&cfg.Import, "import", "", "store the documents of a file written by -export instead of reading the training CSV")
+	fs.IntVar(&cfg.CompressionReport, "compression-report", 0, "read back this many stored documents, print their raw, gzip and zstd compressed size and exit")
+}
+
+// searchFlags registers the options of classifying the test images
+func searchFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Classifier, "classifier", classifierKNN, "knn to vote among the nearest training images, centroid to pick the label of the nearest class mean")
+	fs.IntVar(&cfg.K, "k", 1, "number of nearest neighbors voting on the label of a test image")
+	fs.BoolVar(&cfg.PriorWeighting, "prior-weighting", false, "divide the vote of each neighbor by the training frequency of its label")
+	fs.StringVar(&cfg.TieBreak, "tiebreak", tieBreakNearest, "how ties of the neighbor vote are resolved: nearest, lowest-label or random")
+	fs.IntVar(&cfg.Workers, "workers", 1, "number of concurrent search workers")
+	fs.BoolVar(&cfg.ClientPerWorker, "client-per-worker", false, "create a dedicated redis client per search worker instead of sharing one pool")
+	fs.StringVar(&cfg.Mask, "mask", "", "zero the x,y,width,height rectangle of every test image before querying (e.g. 10,10,8,8), for occlusion experiments")
+	fs.StringVar(&cfg.Noise, "noise", "", "add gaussian or sp (salt-and-pepper) noise seeded by -seed to every test image before querying")
+	fs.Func("noise-level", "noise standard deviation or share of salt-and-pepper pixels relative to the pixel range, comma separated levels (e.g. 0,0.1,0.2) are evaluated one by one", func(value string) error {
+		for _, level := range strings.Split(value, ",") {
+			n, err := strconv.ParseFloat(strings.TrimSpace(level), 64)
+			if err != nil {
+				return fmt.Errorf("invalid level %q", level)
+			}
+			cfg.NoiseLevels = append(cfg.NoiseLevels, n)
+		}
+		return nil
+	})
+	fs.StringVar(&cfg.Distance, "distance", distanceNative, "unit of every reported and compared distance: native as RediSearch returns it (squared for L2) or euclidean")
+	fs.StringVar(&cfg.HeadlineAccuracy, "headline-accuracy", accuracyAccepted, "accuracy reported as the headline number: accepted leaves rejected images out, all counts them as wrong")
+	fs.Float64Var(&cfg.MinAccuracy, "min-accuracy", 0, "exit with code 3 when the accuracy, as a fraction such as 0.95, is below this, 0 to disable")
+	fs.StringVar(&cfg.HistoryFile, "history-file", "", "append the time, settings fingerprint, accuracy and latency percentiles of the evaluation to this JSON lines file")
+	fs.BoolVar(&cfg.History, "history", false, "print the accuracy and latency trend of the runs in -history-file and exit")
+	fs.IntVar(&cfg.IsolatedEvery, "isolated-every", 10, "with -batch, rerun the first query of every this many batches on its own to report the batching speedup, 0 to disable")
+	fs.IntVar(&cfg.Passes, "passes", 1, "evaluate the test set this many times and print per pass and mean and stddev accuracy and latency")
+	fs.IntVar(&cfg.ProgressEvery, "progress-every", 500, "log running accuracy and latency every this many test images, 0 to disable")
+	fs.IntVar(&cfg.HistogramBins, "histogram-bins", 0, "print histograms of the nearest neighbor distance for correct and wrong guesses with this many bins")
+	fs.StringVar(&cfg.HistogramOut, "histogram-out", "", "also write the distance histograms to this CSV file")
+	fs.IntVar(&cfg.TopConfused, "top-confused", 0, "print this many of the most frequent expected -> found label pairs of the wrong guesses")
+	fs.IntVar(&cfg.ShowErrors, "show-errors", 0, "render up to this many misclassified test images as ASCII art")
+	fs.IntVar(&cfg.SortErrors, "sort-errors", 0, "after the evaluation, list this many misclassified test images by ascending nearest neighbor distance, -1 for all")
+	fs.BoolVar(&cfg.SortErrorsASCII, "sort-errors-ascii", false, "render the images listed by -sort-errors as ASCII art")
+	fs.DurationVar(&cfg.MaxTestDuration, "max-test-duration", 0, "stop evaluating test images after this long (e.g. 1m), 0 for no limit")
+	fs.IntVar(&cfg.ProfileEvery, "profile-every", 0, "repeat every this many KNN queries under FT.PROFILE and report server time next to client time, 0 to disable")
+	fs.StringVar(&cfg.QueryKey, "query-key", "", "print the nearest neighbors of a stored key (e.g. number:1234:7) and exit")
+	fs.IntVar(&cfg.QueryK, "query-k", 10, "number of neighbors printed for -query-key")
+	fs.BoolVar(&cfg.ProfileQuery, "profile-query", false, "print the FT.PROFILE of the KNN query of a random test image and exit")
+}
+
+// benchFlags registers the experiments comparing search setups
+func benchFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.Func("learning-curve", "comma separated training set sizes (e.g. 1000,5000,60000) to measure accuracy at, replaces the index", func(value string) error {
+		for _, size := range strings.Split(value, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(size))
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid size %q", size)
+			}
+			cfg.LearningCurve = append(cfg.LearningCurve, n)
+		}
+		return nil
+	})
+	fs.IntVar(&cfg.PreviewDim, "preview-dim", 0, "store PCA previews of this many dimensions in a second index, compare single-stage with two-stage search and exit")
+	fs.IntVar(&cfg.PreviewCandidates, "preview-candidates", 100, "number of preview neighbors re-ranked by their exact distance with -preview-dim")
+	fs.BoolVar(&cfg.CompareStorage, "compare-storage", false, "load and evaluate the data as json and as hash under two throwaway indexes, compare them and exit")
+	fs.Func("mask-sweep", "comma separated sizes of centered square masks (e.g. 4,8,12) to evaluate the test set with, print the accuracy drop and exit", func(value string) error {
+		for _, size := range strings.Split(value, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(size))
+			if err != nil || n <= 0 || n > ImageSize {
+				return fmt.Errorf("invalid size %q", size)
+			}
+			cfg.MaskSweep = append(cfg.MaskSweep, n)
+		}
+		return nil
+	})
+	fs.Func("k-sweep", "comma separated K values (e.g. 1,3,5,7,9) to vote with from one query of the largest per test image, print the accuracy of each and exit", func(value string) error {
+		for _, k := range strings.Split(value, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(k))
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid K %q", k)
+			}
+			cfg.KSweep = append(cfg.KSweep, n)
+		}
+		return nil
+	})
+	fs.StringVar(&cfg.MixedIndex, "mixed-index", "", "store each class in a FLAT or an HNSW throwaway index, as label:ALGORITHM pairs (e.g. 2:HNSW,8:HNSW) or random, compare them and exit")
+	fs.StringVar(&cfg.MixedSearch, "mixed-search", "both", "indexes searched by -mixed-index: both, flat or hnsw")
+	fs.BoolVar(&cfg.CompareIndexBuild, "compare-index-build", false, "load the training images with an index built on arrival and with one created after the load, compare the timings and exit")
+	fs.BoolVar(&cfg.LeaveOneOut, "leave-one-out", false, "index the training and test images together, classify every test image against all others but itself and exit")
+	fs.BoolVar(&cfg.CompareNormalization, "compare-normalization", false, "index and evaluate raw, scaled and standardized pixels under three throwaway indexes, compare them and exit")
+	fs.BoolVar(&cfg.ColdWarm, "cold-warm", false, "run the test queries twice, compare the latency of the cold and the warm pass and exit")
+	fs.BoolVar(&cfg.DebugReload, "debug-reload", false, "with -cold-warm, also run the queries after DEBUG RELOAD rebuilt the index")
+	fs.StringVar(&cfg.RecallOut, "recall-out", "", "compare the k neighbors of the index with the exact ones of a FLAT index, write them per test image to this CSV file and exit")
+	fs.IntVar(&cfg.RecallStream, "recall-stream", 0, "with -recall-out, find the exact neighbors by streaming the training CSV once per batch of this many test images instead of building a FLAT index, 0 builds the index")
+	fs.IntVar(&cfg.Stability, "stability", 0, "run every test query this many times, report how often the label or the neighbors change and exit")
+	fs.IntVar(&cfg.AverageQueries, "average-queries", 0, "average the embeddings of this many test images of the same label into one query, compare its accuracy per label with the single images and exit")
+}
+
+// printCreateFlags registers the option printing the FT.CREATE command instead of running it
+func printCreateFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.BoolVar(&cfg.PrintCreate, "print-create", false, "print the FT.CREATE command of the index for redis-cli and exit without running it")
+}
+
+// printFlags registers the options printing the query of a test image instead of
+// running it, they read -test-file
+func printFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.BoolVar(&cfg.PrintSearch, "print-search", false, "print the KNN FT.SEARCH command of the first test image for redis-cli and exit without running it")
+	fs.Func("dump-embedding", "print the query embedding of the test image at this index after normalization, -mask and -noise and exit without connecting", func(value string) error {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 {
+			return fmt.Errorf("invalid index %q", value)
+		}
+		cfg.DumpEmbedding = &i
+		return nil
+	})
+	fs.BoolVar(&cfg.DumpASCII, "dump-ascii", false, "also render the embedding of -dump-embedding as ASCII art")
+}
+
+// abstainFlags registers when /predict refuses to answer
+func abstainFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.Float64Var(&cfg.AbstainDistance, "abstain-distance", 0, "answer /predict with 422 and a null label when the nearest neighbor is farther than this, in the unit of -distance, 0 to disable")
+	fs.Float64Var(&cfg.AbstainConfidence, "abstain-confidence", 0, "answer /predict with 422 and a null label when a smaller share of the neighbors agrees with the vote")
+}
+
+// exportFlags registers the options of exporting the embeddings
+func exportFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.EmbeddingsOut, "embeddings-out", "", "write label and embedding of every sample to this CSV file and exit")
+	fs.StringVar(&cfg.EmbeddingsSplit, "embeddings-split", "test", "data set exported by -embeddings-out: train or test")
+	fs.IntVar(&cfg.PCAComponents, "pca", 0, "reduce exported embeddings to this many principal components, 0 to export them as is")
+}
+
+// parseFlags reads the command line options of the run without a subcommand into a
+// Config. Every option is available and the mode flags pick what the run does.
+func parseFlags() Config {
+	var cfg Config
+	fs := flag.CommandLine
+	redisFlags(fs, &cfg)
+	dataFlags(fs, &cfg)
+	loadFlags(fs, &cfg)
+	searchFlags(fs, &cfg)
+	benchFlags(fs, &cfg)
+	abstainFlags(fs, &cfg)
+	exportFlags(fs, &cfg)
+	printCreateFlags(fs, &cfg)
+	printFlags(fs, &cfg)
+	fs.BoolVar(&cfg.BenchmarkClients, "benchmark-clients", false, "evaluate with both a shared client and per-worker clients and report the faster one")
+	fs.StringVar(&cfg.Serve, "serve", "", "serve a drawing page and the /predict endpoint on this address (e.g. :8080) using the stored data")
+	fs.BoolVar(&cfg.SelfTest, "selftest", false, "index a tiny synthetic set, check that KNN finds the expected labels and exit")
+	flag.Parse()
+	if err := validateConfig(&cfg); err != nil {
+		slog.Error("Invalid options.", slog.String("error", err.Error()))
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// validateConfig checks the options that the flag package cannot check itself
+func validateConfig(cfg *Config) error {
+	if cfg.Classifier != classifierKNN && cfg.Classifier != classifierCentroid {
+		return fmt.Errorf("invalid -classifier %q, expected knn or centroid", cfg.Classifier)
+	}
+	if cfg.TrainFile == "-" && cfg.TestFile == "-" {
+		return fmt.Errorf("only one of -train-file and -test-file can read stdin")
+	}
+	if _, err := parseSearchConfig(cfg.SearchConfig); err != nil {
+		return err
+	}
+	if cfg.PixelType != "" {
+		if err := validPixelType(cfg.PixelType); err != nil {
+			return err
+		}
+	}
+	if cfg.SortErrors < -1 {
+		return fmt.Errorf("invalid -sort-errors %d, expected a count, -1 for all or 0", cfg.SortErrors)
+	}
+	if cfg.RecallStream < 0 {
+		return fmt.Errorf("invalid -recall-stream %d, expected a batch size or 0", cfg.RecallStream)
+	}
+	if cfg.RecallStream > 0 && cfg.TrainFile == "-" {
+		return fmt.Errorf("-recall-stream reads -train-file once per batch and cannot read it from stdin")
+	}
+	if cfg.Reconcile && cfg.Append {
+		return fmt.Errorf("-reconcile would delete the rows -append adds to")
+	}
+	if cfg.Protocol != 2 && cfg.Protocol != 3 {
+		return fmt.Errorf("invalid -protocol %d, expected 2 or 3", cfg.Protocol)
+	}
+	if cfg.HeadlineAccuracy != "" && cfg.HeadlineAccuracy != accuracyAccepted && cfg.HeadlineAccuracy != accuracyAll {
+		return fmt.Errorf("invalid -headline-accuracy %q, expected accepted or all", cfg.HeadlineAccuracy)
+	}
+	if cfg.Batch < 0 || cfg.LoadBatch < 0 {
+		return fmt.Errorf("invalid -batch %d or -load-batch %d, expected at least 1", cfg.Batch, cfg.LoadBatch)
+	}
+	if cfg.LoadBatch == 0 {
+		cfg.LoadBatch = max(cfg.Batch, 1)
+	}
+	if _, err := parseMask(cfg.Mask); err != nil {
+		return err
+	}
+	if err := validNoise(cfg.Noise, cfg.NoiseLevels); err != nil {
+		return err
+	}
+	if cfg.Distance != "" {
+		if err := validDistanceUnit(cfg.Distance); err != nil {
+			return err
+		}
+	}
+	if cfg.VerifyDecimals < 0 || cfg.VerifyAbsTol < 0 || cfg.VerifyRelTol < 0 {
+		return fmt.Errorf("invalid -verify-decimals %d, -verify-abs-tol %g or -verify-rel-tol %g, expected 0 or more", cfg.VerifyDecimals, cfg.VerifyAbsTol, cfg.VerifyRelTol)
+	}
+	if cfg.Import != "" && (cfg.Append || cfg.Reconcile || cfg.ValFile != "") {
+		return fmt.Errorf("-import stores an export as is and cannot be combined with -append, -reconcile or -val-file")
+	}
+	if cfg.ValFile != "" && cfg.IndexAfterLoad {
+		return fmt.Errorf("-val-file searches the index while loading, which -index-after-load only creates at the end")
+	}
+	if cfg.ValEvery < 0 {
+		return fmt.Errorf("invalid -val-every %d, expected 0 or more", cfg.ValEvery)
+	}
+	if _, err := parseMixedIndex(cfg.MixedIndex); err != nil {
+		return err
+	}
+	switch strings.ToLower(cfg.MixedSearch) {
+	case "", "both", "flat", "hnsw":
+	default:
+		return fmt.Errorf("invalid -mixed-search %q, expected both, flat or hnsw", cfg.MixedSearch)
+	}
+	if cfg.MinAccuracy < 0 || cfg.MinAccuracy > 1 {
+		return fmt.Errorf("invalid -min-accuracy %g, expected a fraction in [0, 1]", cfg.MinAccuracy)
+	}
+	if cfg.History && cfg.HistoryFile == "" {
+		return fmt.Errorf("-history prints the runs of -history-file, which is not set")
+	}
+	if cfg.IsolatedEvery < 0 {
+		return fmt.Errorf("invalid -isolated-every %d, expected 0 or more", cfg.IsolatedEvery)
+	}
+	if cfg.Passes < 1 {
+		return fmt.Errorf("invalid -passes %d, expected at least 1", cfg.Passes)
+	}
+	if cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+		return fmt.Errorf("invalid -sample-rate %g, expected a value in (0, 1]", cfg.SampleRate)
+	}
+	if _, err := parseDelimiter(*cfg); err != nil {
+		return err
+	}
+	if cfg.LabelCol != "" {
+		if err := validLabelColumn(cfg.LabelCol); err != nil {
+			return err
+		}
+	}
+	if _, err := newStorage(cfg.Storage, cfg.DistanceAlias); err != nil {
+		return err
+	}
+	keys, err := parseKeyTemplate(cfg.KeyTemplate)
+	if err != nil {
+		return err
+	}
+	if err := checkReservedPrefix(keys); err != nil {
+		return err
+	}
+	cfg.Metric = strings.ToUpper(cfg.Metric)
+	if err := validMetric(cfg.Metric); err != nil {
+		return err
+	}
+	cfg.Algorithm = strings.ToUpper(cfg.Algorithm)
+	if err := validAlgorithm(cfg.Algorithm); err != nil {
+		return err
+	}
+	cfg.VectorType = strings.ToUpper(cfg.VectorType)
+	if cfg.VectorType == "" {
+		cfg.VectorType = vectorFloat32
+	}
+	if err := validVectorType(cfg.VectorType); err != nil {
+		return err
+	}
+	return validTieBreak(cfg.TieBreak)
+}
+
+// command is a subcommand of the CLI with the flag groups it accepts
+type command struct {
+	name    string
+	summary string
+	flags   []func(*flag.FlagSet, *Config)
+	run     func(rdb *redis.Client, cfg Config) error
+}
+
+// commands lists the subcommands in the order of the usage message
+var commands = []command{
+	{"index", "create the vector index", []func(*flag.FlagSet, *Config){redisFlags, printCreateFlags}, runIndex},
+	{"load", "store the training images, creating the index when needed", []func(*flag.FlagSet, *Config){redisFlags, dataFlags, loadFlags, exportFlags}, runLoad},
+	{"search", "classify the test images against the stored data", []func(*flag.FlagSet, *Config){redisFlags, dataFlags, searchFlags, printCreateFlags, printFlags}, runSearch},
+	{"drop", "drop the indexes with their documents and settings", []func(*flag.FlagSet, *Config){redisFlags}, runDrop},
+	{"serve", "serve the drawing page and /predict", []func(*flag.FlagSet, *Config){redisFlags, dataFlags, searchFlags, abstainFlags, serveFlags}, runServe},
+	{"bench", "compare shared and per-worker clients, or run one of the benchmark modes", []func(*flag.FlagSet, *Config){redisFlags, dataFlags, loadFlags, searchFlags, benchFlags}, runBench},
+	{"selftest", "index a tiny synthetic set and check the KNN results", []func(*flag.FlagSet, *Config){redisFlags}, runSelfTest},
+}
+
+// mode is a run picked by a mode flag instead of the one of the subcommand, or of the
+// load and search without a subcommand
+type mode struct {
+	// selected reports whether the options pick the mode
+	selected func(cfg Config) bool
+	// offline modes run before connecting, with a nil client
+	offline bool
+	run     func(rdb *redis.Client, cfg Config) error
+	// failure is the message logged when run fails
+	failure string
+}
+
+// modes are the mode flags in the order they take precedence, both without a subcommand
+// and with one. A subcommand only sees the modes of the flags it registers.
+var modes = []mode{
+	{func(cfg Config) bool { return cfg.PrintCreate || cfg.PrintSearch }, true,
+		func(_ *redis.Client, cfg Config) error { return PrintCommands(cfg) }, "Could not print commands."},
+	{func(cfg Config) bool { return cfg.DumpEmbedding != nil }, true,
+		func(_ *redis.Client, cfg Config) error { return DumpEmbedding(cfg, *cfg.DumpEmbedding) }, "Could not dump the embedding."},
+	{func(cfg Config) bool { return cfg.History }, true,
+		func(_ *redis.Client, cfg Config) error { return PrintHistory(cfg.HistoryFile) }, "Could not print the history."},
+	{func(cfg Config) bool { return cfg.EmbeddingsOut != "" }, true, runExportEmbeddings, "Could not export embeddings."},
+	{func(cfg Config) bool { return cfg.ListIndexes }, false,
+		func(rdb *redis.Client, _ Config) error { return ListIndexes(rdb) }, "Could not list the indexes."},
+	{func(cfg Config) bool { return cfg.SelfTest }, false, runSelfTest, "Self-test failed."},
+	{func(cfg Config) bool { return len(cfg.LearningCurve) > 0 }, false, LearningCurve, "Could not measure learning curve."},
+	{func(cfg Config) bool { return cfg.Verify }, false, runVerify, "Verification failed."},
+	{func(cfg Config) bool { return cfg.CompressionReport > 0 }, false, CompressionReport, "Could not report the compression."},
+	{func(cfg Config) bool { return cfg.Export != "" }, false, ExportData, "Could not export data."},
+	{func(cfg Config) bool { return cfg.Serve != "" }, false, Serve, "Could not serve."},
+	{func(cfg Config) bool { return cfg.PreviewDim > 0 }, false, TwoStageSearch, "Could not compare two-stage search."},
+	{func(cfg Config) bool { return cfg.CompareStorage }, false, CompareStorage, "Could not compare storage."},
+	{func(cfg Config) bool { return cfg.CompareIndexBuild }, false, CompareIndexBuild, "Could not compare the index builds."},
+	{func(cfg Config) bool { return cfg.MixedIndex != "" }, false, MixedIndex, "Could not evaluate the mixed index."},
+	{func(cfg Config) bool { return len(cfg.MaskSweep) > 0 }, false, MaskSweep, "Could not run the mask sweep."},
+	{func(cfg Config) bool { return len(cfg.KSweep) > 0 }, false, KSweep, "Could not run the K sweep."},
+	{func(cfg Config) bool { return cfg.LeaveOneOut }, false, LeaveOneOut, "Could not run the leave-one-out evaluation."},
+	{func(cfg Config) bool { return cfg.CompareNormalization }, false, CompareNormalization, "Could not compare normalization."},
+	{func(cfg Config) bool { return cfg.ColdWarm }, false, ColdWarm, "Could not compare cold and warm queries."},
+	{func(cfg Config) bool { return cfg.RecallOut != "" }, false, Recall, "Could not measure recall."},
+	{func(cfg Config) bool { return cfg.Stability > 0 }, false, Stability, "Could not measure stability."},
+	{func(cfg Config) bool { return cfg.AverageQueries > 0 }, false, AveragedQueries, "Could not run the averaged queries."},
+	{func(cfg Config) bool { return cfg.ProfileQuery }, false, ProfileQuery, "Could not profile query."},
+	{func(cfg Config) bool { return cfg.QueryKey != "" }, false, QueryByKey, "Could not query key."},
+}
+
+// selectMode returns the first of the modes picked by the options of cfg
+func selectMode(cfg Config) (mode, bool) {
+	for _, m := range modes {
+		if m.selected(cfg) {
+			return m, true
+		}
+	}
+	return mode{}, false
+}
+
+// exitCode logs the error of a run with failure and the attributes and returns the exit
+// code of the process
+func exitCode(err error, failure string, attrs ...any) int {
+	if errors.Is(err, errBelowMinAccuracy) {
+		slog.Error("Accuracy check failed.", append(attrs, slog.String("error", err.Error()))...)
+		return exitBelowMinAccuracy
+	}
+	if err != nil {
+		slog.Error(failure, append(attrs, slog.String("error", err.Error()))...)
+		return 1
+	}
+	return 0
+}
+
+// runExportEmbeddings writes the embeddings of -embeddings-out
+func runExportEmbeddings(_ *redis.Client, cfg Config) error {
+	err := ExportEmbeddings(cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("Embeddings exported.", slog.String("file", cfg.EmbeddingsOut))
+	return nil
+}
+
+// runVerify compares the stored embeddings with the training CSV
+func runVerify(rdb *redis.Client, cfg Config) error {
+	err := VerifyData(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("Stored data matches the CSV.")
+	return nil
+}
+
+// serveFlags registers the listen address of the serve subcommand
+func serveFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.StringVar(&cfg.Serve, "addr", ":8080", "address to serve the drawing page and /predict on")
+}
+
+// isCommand reports whether the first argument names a subcommand rather than a flag
+func isCommand(args []string) bool {
+	return len(args) > 0 && !strings.HasPrefix(args[0], "-")
+}
+
+// runCommand parses the flags of a subcommand, connects to Redis and runs it. It
+// returns the exit code.
+func runCommand(args []string) int {
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		var cfg Config
+		fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+		for _, register := range cmd.flags {
+			register(fs, &cfg)
+		}
+		fs.Parse(args[1:])
+		// Options of the groups a subcommand does not take keep usable defaults
+		if cfg.Classifier == "" {
+			cfg.Classifier = classifierKNN
+		}
+		if cfg.TieBreak == "" {
+			cfg.TieBreak = tieBreakNearest
+		}
+		if fs.Lookup("sample-rate") == nil {
+			cfg.SampleRate = 1
+		}
+		if fs.Lookup("passes") == nil {
+			cfg.Passes = 1
+		}
+		if err := validateConfig(&cfg); err != nil {
+			slog.Error("Invalid options.", slog.String("error", err.Error()))
+			return 2
+		}
+
+		m, ok := selectMode(cfg)
+		if ok && m.offline {
+			// Nothing is run against Redis, so no connection is needed
+			return exitCode(m.run(nil, cfg), m.failure, slog.String("command", cmd.name))
+		}
+
+		rdb, cleanup, err := setup(&cfg)
+		if err != nil {
+			slog.Error("Could not set up.", slog.String("command", cmd.name), slog.String("error", err.Error()))
+			return 1
+		}
+		defer func() {
+			rdb.Close()
+			cleanup()
+		}()
+		if ok {
+			return exitCode(m.run(rdb, cfg), m.failure, slog.String("command", cmd.name))
+		}
+		return exitCode(cmd.run(rdb, cfg), "Command failed.", slog.String("command", cmd.name))
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\nUsage: %s [command] [flags]\n\nCommands:\n", args[0], os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nWithout a command the index is created, loaded and searched in one run.\n")
+	return 2
+}
+
+// runIndex creates the vector index
+func runIndex(rdb *redis.Client, cfg Config) error {
+	err := CreateIndex(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("Index Created.")
+	return nil
+}
+
+// runLoad stores the training images, or imports them with -import
+func runLoad(rdb *redis.Client, cfg Config) error {
+	if !cfg.IndexAfterLoad {
+		err := createIndexIfMissing(rdb, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	if !cfg.Append {
+		err := checkExistingData(rdb, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Import != "" {
+		return ImportData(rdb, cfg)
+	}
+	client, err := StoreData(rdb, cfg)
+	if client != rdb {
+		// The client was rebuilt after a lost connection
+		client.Close()
+	}
+	if errors.Is(err, errLoadInterrupted) {
+		// The rows stored so far are committed, the summary is printed
+		return nil
+	}
+	return err
+}
+
+// runSearch classifies the test images
+func runSearch(rdb *redis.Client, cfg Config) error {
+	return SearchData(rdb, cfg)
+}
+
+// runDrop drops the indexes together with their documents
+func runDrop(rdb *redis.Client, cfg Config) error {
+	return DropData(rdb)
+}
+
+// runServe serves the drawing page and /predict
+func runServe(rdb *redis.Client, cfg Config) error {
+	return Serve(rdb, cfg)
+}
+
+// runBench compares the shared and per-worker clients
+func runBench(rdb *redis.Client, cfg Config) error {
+	cfg.BenchmarkClients = true
+	return SearchData(rdb, cfg)
+}
+
+// runSelfTest checks the KNN results on a tiny synthetic index
+func runSelfTest(rdb *redis.Client, cfg Config) error {
+	err := SelfTest(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("Self-test passed.")
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ColdWarm runs the KNN queries of the test set twice and prints the latency of the
+// first, cold pass next to the second, warm one. With cfg.DebugReload the server then
+// reloads its dataset with DEBUG RELOAD, which rebuilds the index from the reloaded
+// documents, and a third pass measures the queries after the reload.
+func ColdWarm(rdb *redis.Client, cfg Config) error {
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	c, err := NewClassifier(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	embeddings := make([][]float32, len(test))
+	for i, record := range test {
+		embeddings[i], err = cfg.parsePixels(record[1:])
+		if err != nil {
+			return err
+		}
+		c.weights.apply(embeddings[i])
+	}
+
+	passes := []string{"cold", "warm"}
+	if cfg.DebugReload {
+		passes = append(passes, "after reload")
+	}
+	results := make([]*Stats, len(passes))
+	for p, pass := range passes {
+		if pass == "after reload" {
+			err := debugReload(rdb, c.Index())
+			if err != nil {
+				return err
+			}
+		}
+		results[p] = &Stats{}
+		start := time.Now()
+		for _, embedding := range embeddings {
+			if cfg.MaxTestDuration > 0 && time.Since(start) >= cfg.MaxTestDuration {
+				break
+			}
+			_, duration, err := c.search(rdb, embedding)
+			if err != nil {
+				return err
+			}
+			results[p].Record(duration)
+		}
+		slog.Info("Pass finished.", slog.String("pass", pass), slog.Int("queries", results[p].Count()), slog.Duration("elapsed", time.Since(start)))
+	}
+
+	fmt.Printf("%-14s %8s %8s %8s %8s %8s %8s\n", "Pass", "Queries", "Min", "Avg", "P50", "P95", "P99")
+	for p, pass := range passes {
+		s := results[p]
+		fmt.Printf("%-14s %8d %6dms %6dms %6dms %6dms %6dms\n", pass, s.Count(), s.Min(), s.Average(), s.Percentile(50), s.Percentile(95), s.Percentile(99))
+	}
+	return nil
+}
+
+// debugReload saves and reloads the dataset of the server and waits until the index
+// is rebuilt. Servers started without enable-debug-command refuse DEBUG.
+func debugReload(rdb *redis.Client, index string) error {
+	slog.Info("Reloading the dataset with DEBUG RELOAD.")
+	err := rdb.Do(ctx, "DEBUG", "RELOAD").Err()
+	if err != nil {
+		if strings.Contains(err.Error(), "DEBUG command not allowed") {
+			return fmt.Errorf("%w, start Redis with --enable-debug-command yes to use -debug-reload", err)
+		}
+		return err
+	}
+	_, err = waitForIndexing(rdb, index)
+	return err
+}
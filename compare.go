@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// compareSample is the number of documents whose MEMORY USAGE is averaged per storage
+const compareSample = 100
+
+// storageRun holds the measurements of one storage mode in CompareStorage
+type storageRun struct {
+	mode       string
+	vectorType string
+	load       time.Duration
+	indexMB    float64
+	docBytes   float64
+	durations  *Stats
+	correct    int
+	processed  int
+}
+
+// CompareStorage loads the training images once as JSON documents and once as hashes,
+// each under its own mnist_compare_<mode> index over compare:<mode>: keys, classifies
+// the test images against both and prints load time, memory, query latency and
+// accuracy side by side. With -vector-type FLOAT16 both are also loaded as half
+// precision vectors under mnist_compare_<mode>_float16, to weigh the memory saved
+// against the accuracy lost. The comparison indexes are dropped with their documents
+// at the end.
+func CompareStorage(rdb *redis.Client, cfg Config) error {
+	modules, err := loadedModules(rdb)
+	if err != nil {
+		return err
+	}
+	if !modules["rejson"] {
+		return fmt.Errorf("comparing the storage needs the RedisJSON module")
+	}
+	train, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return err
+	}
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+
+	types := []string{vectorFloat32}
+	if cfg.VectorType != "" && cfg.VectorType != vectorFloat32 {
+		types = append(types, cfg.VectorType)
+	}
+
+	var runs []storageRun
+	for _, t := range types {
+		for _, mode := range []string{storageJSON, storageHash} {
+			// Every run gets its own copy of the options, pixels are not stored
+			runCfg := cfg
+			runCfg.Storage, runCfg.VectorType, runCfg.StorePixels = mode, t, false
+			run, err := compareStorageRun(rdb, runCfg, train, test)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", mode, t, err)
+			}
+			runs = append(runs, run)
+		}
+	}
+
+	fmt.Printf("Storage comparison over %d training and %d test images, k = %d\n", len(train), runs[0].processed, max(cfg.K, 1))
+	fmt.Printf("%-8s %-8s %12s %12s %14s %12s %12s %10s\n", "Storage", "Type", "Load", "Index MB", "Bytes/Doc", "Avg Query", "P95 Query", "Accuracy")
+	for _, run := range runs {
+		fmt.Printf("%-8s %-8s %12s %12.2f %14.0f %10dms %10dms %9.2f%%\n",
+			run.mode, run.vectorType, run.load.Round(time.Millisecond), run.indexMB, run.docBytes,
+			run.durations.Average(), run.durations.Percentile(95), 100*float64(run.correct)/float64(run.processed))
+	}
+	return nil
+}
+
+// compareIndexes are the throwaway indexes of CompareStorage by storage mode, with the
+// vector type appended unless FLOAT32
+var compareIndexes = map[string]string{
+	storageJSON:              modeIndex("mnist_compare_json"),
+	storageHash:              modeIndex("mnist_compare_hash"),
+	storageJSON + "_float16": modeIndex("mnist_compare_json_float16"),
+	storageHash + "_float16": modeIndex("mnist_compare_hash_float16"),
+}
+
+// compareStorageRun loads and evaluates the data with the storage and vector type of cfg
+func compareStorageRun(rdb *redis.Client, cfg Config, train, test [][]string) (storageRun, error) {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return storageRun{}, err
+	}
+	run := storageRun{mode: storage.Mode, vectorType: storage.vectorType(), durations: &Stats{}}
+	name := storage.Mode
+	if run.vectorType != vectorFloat32 {
+		name += "_" + strings.ToLower(run.vectorType)
+	}
+	index := compareIndexes[name]
+	prefix := "compare:" + name + ":"
+
+	// It is fine if the index does not exist yet
+	rdb.Do(ctx, "FT.DROPINDEX", index, "DD")
+	defer rdb.Do(ctx, "FT.DROPINDEX", index, "DD")
+	err = createIndex(rdb, cfg, index, prefix)
+	if err != nil {
+		return run, err
+	}
+
+	start := time.Now()
+	writer := newDocWriter(rdb, storage, cfg.LoadBatch, cfg.MaxInFlight)
+	var keys []string
+	for i, record := range train {
+		label, err := strconv.Atoi(record[0])
+		if err != nil {
+			return run, err
+		}
+		embedding, err := cfg.parsePixels(record[1:])
+		if err != nil {
+			return run, err
+		}
+		key := fmt.Sprintf("%s%d:%d", prefix, i, label)
+		cmd, err := storage.setCommand(key, label, embedding)
+		if err != nil {
+			return run, err
+		}
+		err = writer.write(key, cmd)
+		if err != nil {
+			return run, err
+		}
+		if len(keys) < compareSample {
+			keys = append(keys, key)
+		}
+	}
+	err = writer.close()
+	if err != nil {
+		return run, err
+	}
+	_, err = waitForIndexing(rdb, index)
+	if err != nil {
+		return run, err
+	}
+	run.load = time.Since(start)
+
+	run.indexMB, err = indexInfoValue(rdb, index, "vector_index_sz_mb")
+	if err != nil {
+		return run, err
+	}
+	var total int64
+	for _, key := range keys {
+		usage, err := rdb.MemoryUsage(ctx, key).Result()
+		if err != nil {
+			return run, err
+		}
+		total += usage
+	}
+	if len(keys) > 0 {
+		run.docBytes = float64(total) / float64(len(keys))
+	}
+
+	k := max(cfg.K, 1)
+	v := newVoter(cfg.TieBreak, cfg.Seed)
+	s := newSearcher(cfg, storage)
+	evalStart := time.Now()
+	for _, record := range test {
+		if cfg.MaxTestDuration > 0 && time.Since(evalStart) >= cfg.MaxTestDuration {
+			break
+		}
+		expected, err := strconv.Atoi(record[0])
+		if err != nil {
+			return run, err
+		}
+		embedding, err := cfg.parsePixels(record[1:])
+		if err != nil {
+			return run, err
+		}
+		neighbors, _, duration, err := s.searchIndex(rdb, index, embedding, k)
+		if err != nil {
+			return run, err
+		}
+		run.durations.Record(duration)
+		run.processed++
+		if v.vote(neighbors) == expected {
+			run.correct++
+		}
+	}
+	if run.processed == 0 {
+		return run, fmt.Errorf("no test images were evaluated")
+	}
+	return run, nil
+}
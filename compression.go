@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/redis/go-redis/v9"
+)
+
+// CompressionReport reads back up to cfg.CompressionReport stored training documents
+// and prints their raw size next to their gzip and zstd compressed size, each
+// document compressed on its own as a client side scheme storing compressed blobs
+// would. MEMORY USAGE adds what Redis actually spends on the keys.
+func CompressionReport(rdb *redis.Client, cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	iter := rdb.Scan(ctx, 0, storage.Keys.scanPattern(), 1000).Iterator()
+	for len(keys) < cfg.CompressionReport && iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no %s keys found, store the training data first", storage.Keys.scanPattern())
+	}
+	sort.Strings(keys)
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+
+	var raw, gzipped, zstded, memory int64
+	for _, key := range keys {
+		doc, err := storedDocument(rdb, storage, key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		var buf bytes.Buffer
+		gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		gz.Write(doc)
+		err = gz.Close()
+		if err != nil {
+			return err
+		}
+		raw += int64(len(doc))
+		gzipped += int64(buf.Len())
+		zstded += int64(len(encoder.EncodeAll(doc, nil)))
+
+		usage, err := rdb.MemoryUsage(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		memory += usage
+	}
+
+	n := int64(len(keys))
+	fmt.Printf("Compression of %d stored %s documents\n", n, storage.indexType())
+	fmt.Printf("%-14s %12s %12s %8s\n", "Encoding", "Total", "Per Doc", "Ratio")
+	for _, row := range []struct {
+		name string
+		size int64
+	}{
+		{"raw", raw},
+		{"gzip", gzipped},
+		{"zstd", zstded},
+		{"MEMORY USAGE", memory},
+	} {
+		fmt.Printf("%-14s %12d %12d %7.2fx\n", row.name, row.size, row.size/n, float64(raw)/float64(row.size))
+	}
+	return nil
+}
+
+// storedDocument returns the stored document of a key as bytes: the JSON text of a
+// JSON document, the field names and values of a hash
+func storedDocument(rdb *redis.Client, storage Storage, key string) ([]byte, error) {
+	if storage.Mode == storageHash {
+		fields, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var doc []byte
+		for _, name := range names {
+			doc = append(doc, name...)
+			doc = append(doc, fields[name]...)
+		}
+		return doc, nil
+	}
+	doc, err := rdb.Do(ctx, "JSON.GET", key).Text()
+	return []byte(doc), err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LearningCurve measures accuracy on the test set for growing prefixes of the training
+// set. The index is dropped together with its documents and rebuilt, then every step
+// only loads the rows added since the previous size. With -sample-rate the prefixes are
+// taken from the sampled rows.
+func LearningCurve(rdb *redis.Client, cfg Config) error {
+	train, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return err
+	}
+	if cfg.SampleRate > 0 && cfg.SampleRate < 1 {
+		train = sampleRecords(train, cfg.SampleRate, cfg.Seed)
+	}
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+
+	sizes := append([]int(nil), cfg.LearningCurve...)
+	sort.Ints(sizes)
+
+	// It is fine if the index does not exist yet
+	rdb.Do(ctx, "FT.DROPINDEX", "mnist_index", "DD")
+	err = rdb.Del(ctx, priorsKey).Err()
+	if err != nil {
+		return err
+	}
+	err = resetPrototypes(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	err = CreateIndex(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	cfg.loadWeights, err = resolvePixelWeights(cfg, train)
+	if err != nil {
+		return err
+	}
+	err = saveSettings(rdb, cfg)
+	if err != nil {
+		return err
+	}
+
+	type point struct {
+		size     int
+		accuracy float64
+		elapsed  time.Duration
+	}
+	var curve []point
+	loaded := 0
+	for _, size := range sizes {
+		if size > len(train) {
+			size = len(train)
+		}
+		if size > loaded {
+			_, err = storeRecords(rdb, cfg, train[loaded:size], loaded, &loadProfile{}, nil, nil)
+			if err != nil {
+				return err
+			}
+			loaded = size
+		}
+
+		c, err := NewClassifier(rdb, cfg)
+		if err != nil {
+			return err
+		}
+		summary, err := c.Evaluate(test, nil)
+		if err != nil {
+			return err
+		}
+		curve = append(curve, point{size: size, accuracy: summary.accuracy(), elapsed: summary.elapsed})
+	}
+
+	fmt.Println("Training Size | Accuracy | Evaluation Time")
+	for _, p := range curve {
+		fmt.Printf("%13d | %7.2f%% | %s\n", p.size, p.accuracy, p.elapsed.Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// debugQuery prints the command and the raw reply of a query for the first -debug-query
+// queries of the searcher
+func (s *searcher) debugQuery(query []interface{}, reply interface{}, err error) {
+	if s.debug.Add(-1) < 0 {
+		return
+	}
+	fmt.Printf("Query command: %s\n", formatCommand(query))
+	if err != nil {
+		fmt.Printf("Query error: %v\n", err)
+		return
+	}
+	fmt.Printf("Query reply (%T):\n%s", reply, formatReply(reply, 1))
+}
+
+// formatCommand joins the arguments of a command, showing binary blobs by size only
+func formatCommand(args []interface{}) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		if blob, ok := arg.([]byte); ok {
+			parts[i] = fmt.Sprintf("<%d bytes>", len(blob))
+			continue
+		}
+		parts[i] = fmt.Sprint(arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatReply renders a reply tree with one indented line per element
+func formatReply(reply interface{}, depth int) string {
+	indent := strings.Repeat("  ", depth)
+	switch v := reply.(type) {
+	case []interface{}:
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%sarray(%d)\n", indent, len(v))
+		for _, item := range v {
+			sb.WriteString(formatReply(item, depth+1))
+		}
+		return sb.String()
+	case map[interface{}]interface{}:
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%smap(%d)\n", indent, len(v))
+		for key, item := range v {
+			fmt.Fprintf(&sb, "%s  key %q\n", indent, fmt.Sprint(key))
+			sb.WriteString(formatReply(item, depth+2))
+		}
+		return sb.String()
+	case string:
+		return fmt.Sprintf("%s%q\n", indent, v)
+	default:
+		return fmt.Sprintf("%s%v (%T)\n", indent, v, v)
+	}
+}
+
+// redisCLICommand quotes the arguments of a command so the line can be pasted into
+// redis-cli. Arguments with spaces, quotes or binary bytes are double quoted with the
+// \xHH escapes redis-cli understands.
+func redisCLICommand(args []interface{}) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		var value string
+		if blob, ok := arg.([]byte); ok {
+			value = string(blob)
+		} else {
+			value = fmt.Sprint(arg)
+		}
+		parts[i] = redisCLIQuote(value)
+	}
+	return strings.Join(parts, " ")
+}
+
+// redisCLIQuote returns value as a single redis-cli argument
+func redisCLIQuote(value string) string {
+	plain := value != ""
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '\'' || c == '\\' {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return value
+	}
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ExportEmbeddings writes the label and embedding of every sample of the selected
+// split to cfg.EmbeddingsOut, optionally reduced with PCA, for use in notebooks
+// (t-SNE, UMAP, ...)
+func ExportEmbeddings(cfg Config) error {
+	var path string
+	switch cfg.EmbeddingsSplit {
+	case "train":
+		path = cfg.TrainFile
+	case "test":
+		path = cfg.TestFile
+	default:
+		return fmt.Errorf("unknown split %q, expected train or test", cfg.EmbeddingsSplit)
+	}
+
+	records, err := cfg.readRecords(path)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%s has no rows to export", path)
+	}
+
+	labels := make([]int, len(records))
+	embeddings := make([][]float32, len(records))
+	for i, record := range records {
+		labels[i], err = strconv.Atoi(record[0])
+		if err != nil {
+			return err
+		}
+		embeddings[i], err = cfg.parsePixels(record[1:])
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.PCAComponents > 0 {
+		pca, err := FitPCA(embeddings, cfg.PCAComponents)
+		if err != nil {
+			return err
+		}
+		for i, embedding := range embeddings {
+			embeddings[i] = pca.Transform(embedding)
+		}
+	}
+
+	file, err := os.Create(cfg.EmbeddingsOut)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out := bufio.NewWriter(file)
+	writer := csv.NewWriter(out)
+	header := []string{"label"}
+	for j := range embeddings[0] {
+		header = append(header, fmt.Sprintf("e%d", j))
+	}
+	err = writer.Write(header)
+	if err != nil {
+		return err
+	}
+	for i, embedding := range embeddings {
+		row := make([]string, 0, len(embedding)+1)
+		row = append(row, strconv.Itoa(labels[i]))
+		for _, v := range embedding {
+			row = append(row, strconv.FormatFloat(float64(v), 'g', -1, 32))
+		}
+		err = writer.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// distanceHistogram counts nearest neighbor distances of correct and wrong guesses
+// in the same equally sized bins, so the overlap of the two is visible
+type distanceHistogram struct {
+	width   float64
+	correct []int
+	wrong   []int
+}
+
+// newDistanceHistogram bins the distances between 0 and the largest one observed
+func newDistanceHistogram(bins int, correct, wrong []float64) distanceHistogram {
+	var largest float64
+	for _, distances := range [][]float64{correct, wrong} {
+		for _, d := range distances {
+			if d > largest {
+				largest = d
+			}
+		}
+	}
+	if largest == 0 {
+		largest = 1
+	}
+
+	h := distanceHistogram{
+		width:   largest / float64(bins),
+		correct: make([]int, bins),
+		wrong:   make([]int, bins),
+	}
+	h.fill(h.correct, correct)
+	h.fill(h.wrong, wrong)
+	return h
+}
+
+func (h distanceHistogram) fill(counts []int, distances []float64) {
+	for _, d := range distances {
+		bin := int(d / h.width)
+		if bin >= len(counts) {
+			bin = len(counts) - 1
+		}
+		if bin < 0 {
+			bin = 0
+		}
+		counts[bin]++
+	}
+}
+
+// print writes one line per bin with the counts of correct and wrong guesses, under a
+// header naming the distance
+func (h distanceHistogram) print(distance string) {
+	fmt.Printf("Nearest Neighbor Distance (%s) | Correct | Wrong\n", distance)
+	for bin := range h.correct {
+		fmt.Printf("%11.4f - %11.4f | %7d | %5d\n", float64(bin)*h.width, float64(bin+1)*h.width, h.correct[bin], h.wrong[bin])
+	}
+}
+
+// writeCSV writes the histogram with a header row to path
+func (h distanceHistogram) writeCSV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"bin_start", "bin_end", "correct", "wrong"})
+	for bin := range h.correct {
+		writer.Write([]string{
+			strconv.FormatFloat(float64(bin)*h.width, 'g', -1, 64),
+			strconv.FormatFloat(float64(bin+1)*h.width, 'g', -1, 64),
+			strconv.Itoa(h.correct[bin]),
+			strconv.Itoa(h.wrong[bin]),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
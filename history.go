@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runSettings are the options that change the outcome of an evaluation. Runs with the
+// same settings share a fingerprint and are compared with each other by -history.
+type runSettings struct {
+	TrainFile      string    `json:"train_file"`
+	TestFile       string    `json:"test_file"`
+	Classifier     string    `json:"classifier"`
+	K              int       `json:"k"`
+	PriorWeighting bool      `json:"prior_weighting"`
+	TieBreak       string    `json:"tiebreak"`
+	Normalize      bool      `json:"normalize"`
+	PixelType      string    `json:"pixel_type"`
+	PixelWeights   string    `json:"pixel_weights"`
+	Storage        string    `json:"storage"`
+	Metric         string    `json:"metric"`
+	Algorithm      string    `json:"algorithm"`
+	VectorType     string    `json:"vector_type"`
+	Mask           string    `json:"mask"`
+	Noise          string    `json:"noise"`
+	NoiseLevels    []float64 `json:"noise_levels"`
+	Headline       string    `json:"headline_accuracy"`
+}
+
+// latencySummary holds the query durations of a run in milliseconds
+type latencySummary struct {
+	Average int64 `json:"avg"`
+	P50     int64 `json:"p50"`
+	P95     int64 `json:"p95"`
+	P99     int64 `json:"p99"`
+	Max     int64 `json:"max"`
+}
+
+// runRecord is one line of the -history-file, the summary of one evaluation
+type runRecord struct {
+	Time        time.Time   `json:"time"`
+	Fingerprint string      `json:"fingerprint"`
+	Settings    runSettings `json:"settings"`
+	Processed   int         `json:"processed"`
+	Correct     int         `json:"correct"`
+	Wrong       int         `json:"wrong"`
+	Rejected    int         `json:"rejected"`
+	Timeouts    int         `json:"timeouts"`
+	// Accuracy is the headline accuracy in percent, the other two both definitions
+	Accuracy         float64        `json:"accuracy"`
+	AcceptedAccuracy float64        `json:"accepted_accuracy"`
+	AllAccuracy      float64        `json:"all_accuracy"`
+	QueriesPerSecond float64        `json:"qps"`
+	LatencyMs        latencySummary `json:"latency_ms"`
+}
+
+// settingsOf returns the settings of cfg recorded in the history
+func settingsOf(cfg Config) runSettings {
+	return runSettings{
+		TrainFile:      cfg.TrainFile,
+		TestFile:       cfg.TestFile,
+		Classifier:     cfg.Classifier,
+		K:              cfg.K,
+		PriorWeighting: cfg.PriorWeighting,
+		TieBreak:       cfg.TieBreak,
+		Normalize:      cfg.Normalize,
+		PixelType:      cfg.PixelType,
+		PixelWeights:   cfg.PixelWeights,
+		Storage:        cfg.Storage,
+		Metric:         cfg.Metric,
+		Algorithm:      cfg.Algorithm,
+		VectorType:     cfg.VectorType,
+		Mask:           cfg.Mask,
+		Noise:          cfg.Noise,
+		NoiseLevels:    cfg.NoiseLevels,
+		Headline:       cfg.HeadlineAccuracy,
+	}
+}
+
+// fingerprint is a short hash of the settings
+func (s runSettings) fingerprint() string {
+	encoded, _ := json.Marshal(s)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:6])
+}
+
+// appendHistory appends the summary of an evaluation to the JSON lines file at path
+func appendHistory(path string, cfg Config, summary evalSummary) error {
+	settings := settingsOf(cfg)
+	record := runRecord{
+		Time:             time.Now().UTC().Truncate(time.Second),
+		Fingerprint:      settings.fingerprint(),
+		Settings:         settings,
+		Processed:        summary.processed(),
+		Correct:          summary.correct,
+		Wrong:            summary.wrong,
+		Rejected:         summary.rejected,
+		Timeouts:         summary.timeouts,
+		Accuracy:         summary.accuracy(),
+		AcceptedAccuracy: summary.acceptedAccuracy(),
+		AllAccuracy:      summary.allAccuracy(),
+	}
+	if summary.elapsed > 0 {
+		record.QueriesPerSecond = summary.queriesPerSecond()
+	}
+	if summary.durations.Count() > 0 {
+		record.LatencyMs = latencySummary{
+			Average: summary.durations.Average(),
+			P50:     summary.durations.Percentile(50),
+			P95:     summary.durations.Percentile(95),
+			P99:     summary.durations.Percentile(99),
+			Max:     summary.durations.Max(),
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(file).Encode(record)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readHistory reads the runs of a -history-file in the order they were appended
+func readHistory(path string) ([]runRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var runs []runRecord
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var run runRecord
+		err := json.Unmarshal(scanner.Bytes(), &run)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, scanner.Err()
+}
+
+// PrintHistory prints the runs of the -history-file with the change of the accuracy and
+// the median latency against the previous run of the same settings, then one line per
+// fingerprint from its first to its last run and the settings it stands for
+func PrintHistory(path string) error {
+	runs, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		return fmt.Errorf("%s holds no runs", path)
+	}
+
+	previous := map[string]runRecord{}
+	first := map[string]runRecord{}
+	count := map[string]int{}
+	var order []string
+	fmt.Printf("%-20s %-12s %8s %9s %8s %6s %6s %6s %8s\n", "Time", "Fingerprint", "Images", "Accuracy", "Change", "p50", "p95", "p99", "p50 Diff")
+	for _, run := range runs {
+		change, latency := "", ""
+		if before, ok := previous[run.Fingerprint]; ok {
+			change = fmt.Sprintf("%+.2f", run.Accuracy-before.Accuracy)
+			latency = fmt.Sprintf("%+dms", run.LatencyMs.P50-before.LatencyMs.P50)
+		} else {
+			first[run.Fingerprint] = run
+			order = append(order, run.Fingerprint)
+		}
+		previous[run.Fingerprint] = run
+		count[run.Fingerprint]++
+		fmt.Printf("%-20s %-12s %8d %8.2f%% %8s %4dms %4dms %4dms %8s\n", run.Time.Local().Format("2006-01-02 15:04:05"), run.Fingerprint, run.Processed,
+			run.Accuracy, change, run.LatencyMs.P50, run.LatencyMs.P95, run.LatencyMs.P99, latency)
+	}
+
+	fmt.Println()
+	for _, fingerprint := range order {
+		start, last := first[fingerprint], previous[fingerprint]
+		settings, _ := json.Marshal(last.Settings)
+		fmt.Printf("%s: runs = %d, accuracy %.2f%% -> %.2f%%, p50 %dms -> %dms, settings %s\n", fingerprint, count[fingerprint], start.Accuracy, last.Accuracy, start.LatencyMs.P50, last.LatencyMs.P50, settings)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// indexBuildRun holds the timings of one way of building the index in CompareIndexBuild
+type indexBuildRun struct {
+	mode     string
+	transfer time.Duration
+	build    time.Duration
+}
+
+// CompareIndexBuild loads the training images twice under throwaway indexes, once into
+// an index created up front that indexes every document on arrival and once before
+// creating the index, so RediSearch indexes the existing documents in one pass as
+// -index-after-load does. It prints the data transfer, index build and total time of
+// both. Each index is dropped with its documents before the next run starts.
+func CompareIndexBuild(rdb *redis.Client, cfg Config) error {
+	train, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return err
+	}
+	labels := make([]int, len(train))
+	embeddings := make([][]float32, len(train))
+	for i, record := range train {
+		labels[i], err = strconv.Atoi(record[0])
+		if err != nil {
+			return err
+		}
+		embeddings[i], err = cfg.parsePixels(record[1:])
+		if err != nil {
+			return err
+		}
+	}
+
+	var runs []indexBuildRun
+	for _, afterLoad := range []bool{false, true} {
+		run, err := compareIndexBuildRun(rdb, cfg, afterLoad, labels, embeddings)
+		if err != nil {
+			return fmt.Errorf("%s: %w", run.mode, err)
+		}
+		runs = append(runs, run)
+	}
+
+	fmt.Printf("Index build comparison over %d training images, %s\n", len(train), cfg.indexAlgorithm())
+	fmt.Printf("%-12s %12s %12s %12s\n", "Mode", "Transfer", "Index Build", "Total")
+	for _, run := range runs {
+		fmt.Printf("%-12s %12s %12s %12s\n", run.mode, run.transfer.Round(time.Millisecond), run.build.Round(time.Millisecond), (run.transfer + run.build).Round(time.Millisecond))
+	}
+	incremental, afterLoad := runs[0].transfer+runs[0].build, runs[1].transfer+runs[1].build
+	faster := runs[1].mode
+	if incremental < afterLoad {
+		faster = runs[0].mode
+	}
+	fmt.Printf("Building %s is faster by %s (%.2fx)\n", faster, (max(incremental, afterLoad) - min(incremental, afterLoad)).Round(time.Millisecond),
+		max(incremental, afterLoad).Seconds()/min(incremental, afterLoad).Seconds())
+	return nil
+}
+
+// indexBuildIndexes are the throwaway indexes of CompareIndexBuild, built before or after
+// the load
+var indexBuildIndexes = map[bool]string{
+	false: modeIndex("mnist_build_incremental"),
+	true:  modeIndex("mnist_build_after_load"),
+}
+
+// compareIndexBuildRun loads the embeddings and builds the index before or after them
+func compareIndexBuildRun(rdb *redis.Client, cfg Config, afterLoad bool, labels []int, embeddings [][]float32) (indexBuildRun, error) {
+	run := indexBuildRun{mode: "incremental"}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return run, err
+	}
+	name := "incremental"
+	if afterLoad {
+		run.mode, name = "after load", "after_load"
+	}
+	index := indexBuildIndexes[afterLoad]
+	prefix := "build:" + name + ":"
+
+	// It is fine if the index does not exist yet
+	rdb.Do(ctx, "FT.DROPINDEX", index, "DD")
+	defer rdb.Do(ctx, "FT.DROPINDEX", index, "DD")
+	if !afterLoad {
+		err := createIndex(rdb, cfg, index, prefix)
+		if err != nil {
+			return run, err
+		}
+	}
+
+	start := time.Now()
+	writer := newDocWriter(rdb, storage, cfg.LoadBatch, cfg.MaxInFlight)
+	for i, embedding := range embeddings {
+		key := fmt.Sprintf("%s%d:%d", prefix, i, labels[i])
+		cmd, err := storage.setCommand(key, labels[i], embedding)
+		if err != nil {
+			return run, err
+		}
+		err = writer.write(key, cmd)
+		if err != nil {
+			return run, err
+		}
+	}
+	err = writer.close()
+	if err != nil {
+		return run, err
+	}
+	run.transfer = time.Since(start)
+
+	start = time.Now()
+	if afterLoad {
+		err := createIndex(rdb, cfg, index, prefix)
+		if err != nil {
+			return run, err
+		}
+	}
+	_, err = waitForIndexing(rdb, index)
+	if err != nil {
+		return run, err
+	}
+	run.build = time.Since(start)
+	return run, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// indexSummary is what ListIndexes prints of one index
+type indexSummary struct {
+	name     string
+	docs     string
+	on       string
+	prefixes string
+	// The vector attribute, empty when the index has none
+	dataType  string
+	algorithm string
+	dim       string
+	metric    string
+	memoryMB  float64
+	indexing  bool
+}
+
+// indexMemoryFields are the FT.INFO sizes summed when the server does not report
+// total_index_memory_sz_mb, which older RediSearch versions lack
+var indexMemoryFields = []string{"inverted_sz_mb", "vector_index_sz_mb", "offset_vectors_sz_mb", "doc_table_size_mb", "sortable_values_size_mb", "key_table_size_mb"}
+
+// describeIndex summarizes the FT.INFO of an index. The attributes are matched without
+// regard to case, RediSearch versions disagree on it.
+func describeIndex(rdb *redis.Client, name string) (indexSummary, error) {
+	s := indexSummary{name: name}
+	reply, err := rdb.Do(ctx, "FT.INFO", name).Result()
+	if err != nil {
+		return s, err
+	}
+	info, ok := replyMap(reply)
+	if !ok {
+		return s, fmt.Errorf("unexpected FT.INFO reply for %s", name)
+	}
+	s.docs = replyString(info["num_docs"])
+	indexing, _ := replyFloat(info["indexing"])
+	s.indexing = indexing != 0
+
+	definition, _ := replyMap(info["index_definition"])
+	s.on = replyString(definition["key_type"])
+	prefixes, _ := definition["prefixes"].([]interface{})
+	names := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		names[i] = replyString(prefix)
+	}
+	s.prefixes = strings.Join(names, ",")
+
+	attributes, _ := info["attributes"].([]interface{})
+	for _, attribute := range attributes {
+		fields, _ := replyMap(attribute)
+		lower := make(map[string]string, len(fields))
+		for field, value := range fields {
+			lower[strings.ToLower(field)] = replyString(value)
+		}
+		if !strings.EqualFold(lower["type"], "VECTOR") {
+			continue
+		}
+		s.dataType, s.algorithm, s.dim, s.metric = lower["data_type"], lower["algorithm"], lower["dim"], lower["distance_metric"]
+		break
+	}
+
+	if total, err := replyFloat(info["total_index_memory_sz_mb"]); err == nil {
+		s.memoryMB = total
+	} else {
+		for _, field := range indexMemoryFields {
+			size, err := replyFloat(info[field])
+			if err == nil {
+				s.memoryMB += size
+			}
+		}
+	}
+	return s, nil
+}
+
+// ListIndexes prints every index of FT._LIST with its document count, key type and
+// prefixes, the type, algorithm, dimension and metric of its vector attribute and the
+// memory it uses, so an existing index is seen before it is dropped or queried with the
+// wrong options. Indexes still indexing are marked with a star.
+func ListIndexes(rdb *redis.Client) error {
+	reply, err := rdb.Do(ctx, "FT._LIST").Slice()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(reply))
+	for i, name := range reply {
+		names[i] = replyString(name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		fmt.Println("No indexes.")
+		return nil
+	}
+
+	fmt.Printf("%-28s %9s %-5s %-20s %-8s %-9s %5s %-9s %10s\n", "Index", "Docs", "On", "Prefixes", "Type", "Algorithm", "Dim", "Metric", "Memory")
+	for _, name := range names {
+		s, err := describeIndex(rdb, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		docs := s.docs
+		if s.indexing {
+			docs += "*"
+		}
+		fmt.Printf("%-28s %9s %-5s %-20s %-8s %-9s %5s %-9s %8.2fMB\n",
+			s.name, docs, s.on, s.prefixes, dash(s.dataType), dash(s.algorithm), dash(s.dim), dash(s.metric), s.memoryMB)
+	}
+	return nil
+}
+
+// dash stands in for an empty column
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
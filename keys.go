@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultKeyTemplate is the layout of the training keys unless -key-template is set
+const defaultKeyTemplate = "number:{idx}:{label}"
+
+// keySplit is the value of {split} in the keys of the stored training rows
+const keySplit = "train"
+
+// placeholderPattern matches the named placeholders of a key template
+var placeholderPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// KeyTemplate lays out the key of a training row with the placeholders {idx}, the index
+// of the row, {label}, its label, and {split}, the dataset split. The text before the
+// first placeholder is the PREFIX of mnist_index, so every key stays within the index.
+type KeyTemplate struct {
+	text   string
+	prefix string
+	// pattern matches the keys of the template with the index and label as groups
+	pattern *regexp.Regexp
+	idx     int
+	label   int
+}
+
+// parseKeyTemplate checks a key template and expands its {split}. It needs {idx} once so
+// the keys are unique, takes {label} at most once, and a fixed prefix without glob
+// characters so SCAN and the index PREFIX select exactly the training keys. An empty
+// text is the default template.
+func parseKeyTemplate(text string) (KeyTemplate, error) {
+	if text == "" {
+		text = defaultKeyTemplate
+	}
+	t := KeyTemplate{text: strings.ReplaceAll(text, "{split}", keySplit)}
+	if strings.Contains(t.text, "}{") {
+		return KeyTemplate{}, fmt.Errorf("invalid -key-template %q, placeholders must be separated", text)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	last, group := 0, 0
+	for _, loc := range placeholderPattern.FindAllStringSubmatchIndex(t.text, -1) {
+		expr.WriteString(regexp.QuoteMeta(t.text[last:loc[0]]))
+		group++
+		switch name := t.text[loc[2]:loc[3]]; name {
+		case "idx":
+			if t.idx != 0 {
+				return KeyTemplate{}, fmt.Errorf("invalid -key-template %q, {idx} appears twice", text)
+			}
+			t.idx = group
+			expr.WriteString(`(\d+)`)
+		case "label":
+			if t.label != 0 {
+				return KeyTemplate{}, fmt.Errorf("invalid -key-template %q, {label} appears twice", text)
+			}
+			t.label = group
+			expr.WriteString(`(-?\d+)`)
+		default:
+			return KeyTemplate{}, fmt.Errorf("invalid -key-template %q, unknown placeholder {%s}, expected {idx}, {label} or {split}", text, name)
+		}
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(t.text[last:]))
+	expr.WriteString("$")
+	if t.idx == 0 {
+		return KeyTemplate{}, fmt.Errorf("invalid -key-template %q, {idx} is required to keep the keys unique", text)
+	}
+	if strings.ContainsAny(placeholderPattern.ReplaceAllString(t.text, ""), "{}") {
+		return KeyTemplate{}, fmt.Errorf("invalid -key-template %q, unbalanced braces", text)
+	}
+
+	t.prefix = t.text[:strings.Index(t.text, "{")]
+	if t.prefix == "" {
+		return KeyTemplate{}, fmt.Errorf("invalid -key-template %q, it must start with a fixed prefix such as number:", text)
+	}
+	if strings.ContainsAny(t.prefix, `*?[]\`) {
+		return KeyTemplate{}, fmt.Errorf("invalid -key-template %q, the prefix %q contains glob characters", text, t.prefix)
+	}
+	t.pattern = regexp.MustCompile(expr.String())
+	return t, nil
+}
+
+// reservedPrefixes are the key namespaces of the settings, label counts and row counter
+// of mnist_index and of the documents of the throwaway indexes
+var reservedPrefixes = []string{"mnist_index:", selfTestPrefix, previewPrefix, looPrefix, prototypePrefix, "compare:", "normalize:", "build:", "mixed:"}
+
+// checkReservedPrefix makes sure the keys of a template stay clear of reservedPrefixes.
+// A prefix of a reserved namespace or one within it would let the SCAN of -reconcile
+// delete the metadata, and the index PREFIX pick up the documents of the other indexes.
+func checkReservedPrefix(t KeyTemplate) error {
+	for _, reserved := range reservedPrefixes {
+		if strings.HasPrefix(t.prefix, reserved) || strings.HasPrefix(reserved, t.prefix) {
+			return fmt.Errorf("invalid -key-template %q, its prefix %q overlaps the reserved keys %s*", t.text, t.prefix, reserved)
+		}
+	}
+	return nil
+}
+
+// scanPattern is the SCAN MATCH pattern of the training keys
+func (t KeyTemplate) scanPattern() string {
+	return t.prefix + "*"
+}
+
+// key returns the key of the training row at index idx with the given label
+func (t KeyTemplate) key(idx, label int) string {
+	return strings.NewReplacer("{idx}", strconv.Itoa(idx), "{label}", strconv.Itoa(label)).Replace(t.text)
+}
+
+// parse returns the row index of a key, false when the key does not match the template
+func (t KeyTemplate) parse(key string) (int, bool) {
+	m := t.pattern.FindStringSubmatch(key)
+	if m == nil {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(m[t.idx])
+	return idx, err == nil
+}
+
+// parseLabel returns the label of a key, false when the key does not match the
+// template or the template has no {label}
+func (t KeyTemplate) parseLabel(key string) (int, bool) {
+	m := t.pattern.FindStringSubmatch(key)
+	if m == nil || t.label == 0 {
+		return 0, false
+	}
+	label, err := strconv.Atoi(m[t.label])
+	return label, err == nil
+}
+
+// checkKeyPrefix makes sure an existing mnist_index covers the keys of -key-template,
+// documents stored outside its PREFIX would silently never be found
+func checkKeyPrefix(rdb *redis.Client, keys KeyTemplate) error {
+	reply, err := rdb.Do(ctx, "FT.INFO", "mnist_index").Result()
+	if err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "unknown index") {
+			return nil
+		}
+		return err
+	}
+	info, _ := replyMap(reply)
+	definition, _ := replyMap(info["index_definition"])
+	prefixes, _ := definition["prefixes"].([]interface{})
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(keys.prefix, replyString(prefix)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("mnist_index indexes the prefixes %v, the keys of -key-template %q start with %q, drop the index first", prefixes, keys.text, keys.prefix)
+}
+
+// checkKeyTemplate makes sure rows appended with -append get keys of the same layout as
+// the stored ones
+func checkKeyTemplate(rdb *redis.Client, keys KeyTemplate) error {
+	stored, err := rdb.HGet(ctx, settingsKey, "key_template").Result()
+	if err == redis.Nil {
+		// Data stored before the setting existed always used the default keys
+		stored = defaultKeyTemplate
+	} else if err != nil {
+		return err
+	}
+	if stored != keys.text {
+		return fmt.Errorf("data was stored with -key-template %s but this run uses -key-template %s", stored, keys.text)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// KSweep queries the largest K of cfg.KSweep once per test image and votes the label
+// for every K of the list from the nearest K of those neighbors, so the accuracy of all
+// of them is measured with one query per image. The accuracy per K is printed with the
+// best one marked.
+func KSweep(rdb *redis.Client, cfg Config) error {
+	if cfg.Classifier == classifierCentroid {
+		return fmt.Errorf("-k-sweep needs the knn classifier, the centroid classifier always uses k = 1")
+	}
+	ks := append([]int(nil), cfg.KSweep...)
+	sort.Ints(ks)
+	ks = slices.Compact(ks)
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	cfg.K = ks[len(ks)-1]
+	c, err := NewClassifier(rdb, cfg)
+	if err != nil {
+		return err
+	}
+
+	correct := make([]int, len(ks))
+	var processed, rejected, timeouts, short int
+	durations := &Stats{}
+	start := time.Now()
+	for i, record := range test {
+		if cfg.MaxTestDuration > 0 && time.Since(start) >= cfg.MaxTestDuration {
+			break
+		}
+		r := c.classifyRecord(rdb, i, record)
+		if isTimeout(r.err) {
+			timeouts++
+			continue
+		}
+		if r.err != nil {
+			return fmt.Errorf("test image %d: %w", i, r.err)
+		}
+		processed++
+		if r.zeroVector {
+			rejected++
+			continue
+		}
+		durations.Record(r.duration)
+		if len(r.neighbors) < cfg.K {
+			short++
+		}
+		for n, k := range ks {
+			if c.voter.vote(r.neighbors[:min(k, len(r.neighbors))]) == r.expected {
+				correct[n]++
+			}
+		}
+	}
+	if processed == 0 {
+		return fmt.Errorf("no test images were evaluated")
+	}
+
+	best := 0
+	for n := range ks {
+		if correct[n] > correct[best] {
+			best = n
+		}
+	}
+	fmt.Printf("Accuracy by K over %d test images, one query of k = %d per image, average duration %dms\n", processed, cfg.K, durations.Average())
+	fmt.Printf("%6s %10s %10s\n", "K", "Correct", "Accuracy")
+	for n, k := range ks {
+		marker := ""
+		if n == best {
+			marker = "  best"
+		}
+		fmt.Printf("%6d %10d %9.2f%%%s\n", k, correct[n], 100*float64(correct[n])/float64(processed), marker)
+	}
+	if rejected > 0 {
+		fmt.Printf("Rejected all zero queries = %d (counted as wrong)\n", rejected)
+	}
+	if timeouts > 0 {
+		fmt.Printf("Timeouts = %d (not counted)\n", timeouts)
+	}
+	if short > 0 {
+		fmt.Printf("Queries with fewer than %d neighbors = %d, their larger K voted with the neighbors found\n", cfg.K, short)
+	}
+	return nil
+}
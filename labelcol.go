@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// Label column layouts selectable with -label-col
+const (
+	labelFirst = "first"
+	labelLast  = "last"
+	// labelAuto picks the first or last column, whichever looks like a label
+	labelAuto = "auto"
+)
+
+// labelSample is the number of records inspected to detect the label column
+const labelSample = 1000
+
+// validLabelColumn checks the value of -label-col
+func validLabelColumn(column string) error {
+	switch column {
+	case labelFirst, labelLast, labelAuto:
+		return nil
+	}
+	return fmt.Errorf("invalid -label-col %q, expected first, last or auto", column)
+}
+
+// arrangeLabel moves the label of every record to the front when the CSV at path has it
+// in the last column, so the rest of the code can always read record[0] as the label
+// and record[1:] as the pixels. The layout is logged, a pixel column misread as the
+// label would silently wreck the results.
+func (cfg *Config) arrangeLabel(path string, records [][]string) error {
+	column, err := cfg.labelLayout(path, records)
+	if err != nil {
+		return err
+	}
+	if column == labelLast {
+		moveLabels(records)
+	}
+	return nil
+}
+
+// labelLayout returns and logs the label column of the CSV at path, detected from the
+// records with -label-col auto. An empty -label-col is the first column.
+func (cfg *Config) labelLayout(path string, records [][]string) (string, error) {
+	selected := cfg.LabelCol
+	if selected == "" {
+		selected = labelFirst
+	}
+	column := selected
+	if column == labelAuto {
+		var err error
+		column, err = detectLabelColumn(path, records)
+		if err != nil {
+			return "", err
+		}
+	}
+	slog.Info("CSV layout.", slog.String("file", path), slog.String("label column", column), slog.String("selected by", "-label-col "+selected))
+	return column, nil
+}
+
+// moveLabels moves the last field of every record to the front
+func moveLabels(records [][]string) {
+	for _, record := range records {
+		label := record[len(record)-1]
+		copy(record[1:], record[:len(record)-1])
+		record[0] = label
+	}
+}
+
+// detectLabelColumn returns the column, first or last, whose values are all digits 0-9
+// with more than one distinct value across a sample of the records. The border pixels
+// of MNIST are all 0, which is why a single value does not count as a label column.
+func detectLabelColumn(path string, records [][]string) (string, error) {
+	sample := records[:min(len(records), labelSample)]
+	first := looksLikeLabels(sample, 0)
+	last := looksLikeLabels(sample, 1+NumPixels-1)
+	switch {
+	case first && !last:
+		return labelFirst, nil
+	case last && !first:
+		return labelLast, nil
+	}
+	return "", fmt.Errorf("%s: cannot tell whether the label is the first or the last column, set -label-col first or last", path)
+}
+
+// looksLikeLabels reports whether column holds only the digits 0-9 and at least two of them
+func looksLikeLabels(records [][]string, column int) bool {
+	seen := map[int]bool{}
+	for _, record := range records {
+		value, err := strconv.Atoi(record[column])
+		if err != nil || value < 0 || value > 9 {
+			return false
+		}
+		seen[value] = true
+	}
+	return len(seen) > 1
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// searchConfigKeys are the RediSearch configs -search-config can set, with the name
+// CONFIG SET knows them by on Redis 8, where the search module is built in. Only these
+// bound a KNN query:
+//   - MAXSEARCHRESULTS caps the number of results a FT.SEARCH returns, whatever its K.
+//   - MAXAGGREGATERESULTS is the same for FT.AGGREGATE.
+//   - MAXPREFIXEXPANSIONS caps the terms a prefix, e.g. in a -filter, expands to. The
+//     filter then silently matches fewer documents and the KNN runs over them only.
+//   - TIMEOUT and ON_TIMEOUT decide when a query stops and whether it then fails or
+//     returns what it found so far, see serverTimeout.
+var searchConfigKeys = map[string]string{
+	"MAXSEARCHRESULTS":    "search-max-search-results",
+	"MAXAGGREGATERESULTS": "search-max-aggregate-results",
+	"MAXPREFIXEXPANSIONS": "search-max-prefix-expansions",
+	"TIMEOUT":             "search-timeout",
+	"ON_TIMEOUT":          "search-on-timeout",
+}
+
+// parseSearchConfig parses the comma separated KEY=VALUE pairs of -search-config
+func parseSearchConfig(text string) (map[string]string, error) {
+	settings := map[string]string{}
+	if text == "" {
+		return settings, nil
+	}
+	for _, pair := range strings.Split(text, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid -search-config %q, expected KEY=VALUE pairs", pair)
+		}
+		if _, known := searchConfigKeys[key]; !known {
+			keys := make([]string, 0, len(searchConfigKeys))
+			for k := range searchConfigKeys {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return nil, fmt.Errorf("invalid -search-config key %s, expected one of %s", key, strings.Join(keys, ", "))
+		}
+		settings[key] = strings.TrimSpace(value)
+	}
+	return settings, nil
+}
+
+// applySearchConfig sets the RediSearch configs of -search-config with FT.CONFIG SET,
+// or with CONFIG SET on servers that dropped it, and logs the value every key of
+// searchConfigKeys has then
+func applySearchConfig(rdb *redis.Client, text string) error {
+	settings, err := parseSearchConfig(text)
+	if err != nil {
+		return err
+	}
+	for key, value := range settings {
+		err := rdb.Do(ctx, "FT.CONFIG", "SET", key, value).Err()
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return err
+			}
+			err = rdb.ConfigSet(ctx, searchConfigKeys[key], value).Err()
+			if err != nil {
+				return fmt.Errorf("set %s to %s: %w", key, value, err)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(searchConfigKeys))
+	for key := range searchConfigKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attrs := make([]any, 0, len(keys))
+	for _, key := range keys {
+		value, err := searchConfigValue(rdb, key)
+		if err != nil {
+			// Older servers lack some of the keys
+			continue
+		}
+		attrs = append(attrs, slog.String(strings.ToLower(key), value))
+	}
+	slog.Info("RediSearch limits.", attrs...)
+	return nil
+}
+
+// searchConfigValue returns the value of a RediSearch config key
+func searchConfigValue(rdb *redis.Client, key string) (string, error) {
+	reply, err := rdb.Do(ctx, "FT.CONFIG", "GET", key).Result()
+	if err == nil {
+		// RESP2 replies [[key, value]], RESP3 a map of key to value
+		if m, ok := reply.(map[interface{}]interface{}); ok {
+			return replyString(m[key]), nil
+		}
+		if pairs, ok := reply.([]interface{}); ok && len(pairs) > 0 {
+			if pair, ok := pairs[0].([]interface{}); ok && len(pair) == 2 {
+				return replyString(pair[1]), nil
+			}
+		}
+		return "", fmt.Errorf("unexpected FT.CONFIG GET reply %v", reply)
+	}
+	values, err := rdb.ConfigGet(ctx, searchConfigKeys[key]).Result()
+	if err != nil {
+		return "", err
+	}
+	value, ok := values[searchConfigKeys[key]]
+	if !ok {
+		return "", fmt.Errorf("unknown config %s", key)
+	}
+	return value, nil
+}
+
+// warnSearchLimits logs to the logger of the searcher when a FT.SEARCH reply may have
+// been cut short by a limit of the server: a RESP3 reply lists the reason in its warning
+// field, for example a reached timeout or prefix expansion limit. RESP2 cannot flag it,
+// so fewer than k neighbors while more documents matched counts as capped as well.
+// Every warning is logged once per searcher.
+func (s *searcher) warnSearchLimits(reply interface{}, total int64, returned, k int) {
+	if m, ok := reply.(map[interface{}]interface{}); ok {
+		list, _ := m["warning"].([]interface{})
+		for _, warning := range list {
+			s.warnSearchLimit(replyString(warning), replyString(warning))
+		}
+	}
+	if returned < k && total > int64(returned) {
+		// The counts differ between queries, one line for the cause is enough
+		s.warnSearchLimit("capped", fmt.Sprintf("%d of %d matching documents returned for k = %d, MAXSEARCHRESULTS may cap the results, raise it with -search-config", returned, total, k))
+	}
+}
+
+// warnSearchLimit logs warning unless one with the same key was logged before
+func (s *searcher) warnSearchLimit(key, warning string) {
+	if _, seen := s.warned.LoadOrStore(key, true); !seen {
+		s.logger.Warn("KNN results may be partial.", slog.String("warning", warning))
+	}
+}
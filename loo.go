@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The index and key prefix of the leave-one-out evaluation, which indexes the training
+// and the test images together under their own prefix
+var looIndex = modeIndex("mnist_loo_index")
+
+const looPrefix = "loo:"
+
+// LeaveOneOut indexes the training and the test images together in mnist_loo_index and
+// classifies every test image against all other images, its own key excluded. Unlike
+// the train/test split a test image may be voted on by other test images. Neighbors at
+// distance 0 are duplicates of the query and point at memorization rather than
+// generalization. The index and its documents are dropped at the end.
+func LeaveOneOut(rdb *redis.Client, cfg Config) error {
+	train, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return err
+	}
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+
+	// It is fine if the index does not exist yet
+	rdb.Do(ctx, "FT.DROPINDEX", looIndex, "DD")
+	defer rdb.Do(ctx, "FT.DROPINDEX", looIndex, "DD")
+	err = createIndex(rdb, cfg, looIndex, looPrefix)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	writer := newDocWriter(rdb, storage, cfg.LoadBatch, cfg.MaxInFlight)
+	testEmbeddings := make([][]float32, len(test))
+	for _, split := range []struct {
+		name    string
+		records [][]string
+	}{
+		{"train", train},
+		{"test", test},
+	} {
+		for i, record := range split.records {
+			label, err := strconv.Atoi(record[0])
+			if err != nil {
+				return err
+			}
+			embedding, err := cfg.parsePixels(record[1:])
+			if err != nil {
+				return err
+			}
+			if split.name == "test" {
+				testEmbeddings[i] = embedding
+			}
+			key := looKey(split.name, i, label)
+			cmd, err := storage.setCommand(key, label, embedding)
+			if err != nil {
+				return err
+			}
+			err = writer.write(key, cmd)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = writer.close()
+	if err != nil {
+		return err
+	}
+	_, err = waitForIndexing(rdb, looIndex)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d training and %d test images in %s in %s\n", len(train), len(test), looIndex, time.Since(start).Round(time.Millisecond))
+
+	k := max(cfg.K, 1)
+	v := newVoter(cfg.TieBreak, cfg.Seed)
+	s := newSearcher(cfg, storage)
+	var processed, correct, byTest, duplicates int
+	evalStart := time.Now()
+	for i, record := range test {
+		if cfg.MaxTestDuration > 0 && time.Since(evalStart) >= cfg.MaxTestDuration {
+			break
+		}
+		expected, err := strconv.Atoi(record[0])
+		if err != nil {
+			return err
+		}
+		neighbors, _, err := s.searchIndexExcluding(rdb, looIndex, testEmbeddings[i], k, looKey("test", i, expected))
+		if err != nil {
+			return err
+		}
+		processed++
+		if v.vote(neighbors) == expected {
+			correct++
+		}
+		if strings.HasPrefix(neighbors[0].Key, looPrefix+"test:") {
+			byTest++
+		}
+		if neighbors[0].Distance == 0 {
+			duplicates++
+		}
+	}
+	if processed == 0 {
+		return fmt.Errorf("no test images were evaluated")
+	}
+
+	fmt.Printf("Leave-one-out over %d test images, k = %d\n", processed, k)
+	fmt.Printf("Accuracy = %.2f%%\n", 100*float64(correct)/float64(processed))
+	fmt.Printf("Nearest neighbor is another test image = %d (%.2f%%)\n", byTest, 100*float64(byTest)/float64(processed))
+	fmt.Printf("Nearest neighbor is a duplicate at distance 0 = %d (%.2f%%)\n", duplicates, 100*float64(duplicates)/float64(processed))
+	return nil
+}
+
+// looKey is the key of an image of the given split in mnist_loo_index
+func looKey(split string, i, label int) string {
+	return fmt.Sprintf("%s%s:%d:%d", looPrefix, split, i, label)
+}
@@ -2,262 +2,1633 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/binary"
 	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var ctx = context.Background()
-var minDuration, maxDuration, totalDuration int64
+
+// settingsKey holds the options the stored vectors were built with. It is outside
+// of the number: prefix so it is not indexed.
+const settingsKey = "mnist_index:settings"
+
+// nextIndexKey holds the index the next stored row gets
+const nextIndexKey = "mnist_index:next_index"
+
+// Config holds the options given on the command line.
+type Config struct {
+	// TrainFile is the CSV file with the training images that are stored in Redis.
+	TrainFile string
+	// TestFile is the CSV file with the test images that are searched.
+	TestFile string
+	// Delimiter separates the fields of the CSV files, a single character or \t.
+	Delimiter string
+	// LabelCol is the column holding the label: first, last or auto.
+	LabelCol string
+	// TSV reads tab separated files, it overrides Delimiter.
+	TSV bool
+	// KeyTemplate lays out the keys of the training rows with {idx}, {label} and {split}.
+	KeyTemplate string
+	// Reconcile deletes the number:* keys not written by this load once it finished.
+	Reconcile bool
+	// SampleRate is the probability with which StoreData stores each training row.
+	SampleRate float64
+	// Append adds the training rows after the already stored ones instead of replacing them.
+	Append bool
+	// Password authenticates the connection, see redisPassword for the other sources.
+	Password string
+	// PasswordFile is a file whose first line is the password.
+	PasswordFile string
+	// Protocol is the RESP version of the connection, 2 or 3.
+	Protocol int
+	// DB is the logical Redis database the index and keys live in.
+	DB int
+	// Force loads the training data even if the DB already holds number:* keys.
+	Force bool
+	// Storage stores the training images as RedisJSON documents (json) or hashes (hash).
+	Storage string
+	// DistanceAlias is the name the KNN distance is returned under.
+	DistanceAlias string
+	// Metric is the DISTANCE_METRIC of the index: L2, COSINE or IP.
+	Metric string
+	// Algorithm is the vector algorithm of the index: FLAT or HNSW.
+	Algorithm string
+	// VectorType is the element type of the stored vectors and the queries, FLOAT32 or FLOAT16.
+	VectorType string
+	// IndexAfterLoad creates the index only after StoreData transferred every document.
+	IndexAfterLoad bool
+	// PixelType is how the pixels of the CSV files are written: int for 0-255, float for
+	// values already in [0,1], or auto to tell from the first rows.
+	PixelType string
+	// PixelWeights weighs the pixels of the stored and query embeddings: "variance" of the
+	// training set, or a file of NumPixels weights. Empty disables it.
+	PixelWeights string
+	// ValFile is a small validation CSV evaluated against the index every ValEvery rows
+	// while StoreData loads, and once more at the end. Empty disables it.
+	ValFile  string
+	ValEvery int
+	// StoreNorms stores the L2 norm of every embedding next to it.
+	StoreNorms bool
+	// StorePixels stores the pixels of every training image so -show-errors can render
+	// the nearest neighbor of a misclassified image from Redis.
+	StorePixels bool
+	// DialTimeout bounds establishing a new connection.
+	DialTimeout time.Duration
+	// ReadTimeout bounds waiting for the reply of a command on an established connection.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds sending a command on an established connection.
+	WriteTimeout time.Duration
+	// ServerTimeout is sent as the TIMEOUT of every KNN query. Zero keeps the server default.
+	ServerTimeout time.Duration
+	// ReconnectAttempts is the number of times a load rebuilds the client after losing the
+	// connection. Zero exits on the first connection error.
+	ReconnectAttempts int
+	// QueryTimeout bounds a whole KNN query, including waiting for a pooled connection. Zero means no limit.
+	QueryTimeout time.Duration
+	// MaxTestDuration is the wall-clock budget for SearchData. Zero means no budget.
+	MaxTestDuration time.Duration
+	// QueryKey is a stored key whose nearest neighbors are printed instead of running the full flow.
+	QueryKey string
+	// QueryK is the number of neighbors printed for QueryKey.
+	QueryK int
+	// Workers is the number of goroutines running test queries concurrently.
+	Workers int
+	// ClientPerWorker gives each worker its own client instead of sharing one connection pool.
+	ClientPerWorker bool
+	// BenchmarkClients runs the evaluation with both client strategies and reports the faster one.
+	BenchmarkClients bool
+	// Normalize divides pixel values by 255 when storing and querying.
+	Normalize bool
+	// EmbeddingsOut is a CSV file the labeled embeddings are exported to instead of running the full flow.
+	EmbeddingsOut string
+	// EmbeddingsSplit selects the exported data set, "train" or "test".
+	EmbeddingsSplit string
+	// PCAComponents reduces the exported embeddings to this many principal components. Zero exports them as is.
+	PCAComponents int
+	// Classifier is knn to vote among the nearest training images or centroid to pick the nearest class mean.
+	Classifier string
+	// K is the number of nearest neighbors voting on the label of a test image.
+	K int
+	// PriorWeighting divides the vote of each neighbor by the training frequency of its label.
+	PriorWeighting bool
+	// TieBreak resolves ties of the K neighbor vote: nearest, lowest-label or random.
+	TieBreak string
+	// Seed seeds the random generator, so runs are reproducible.
+	Seed int64
+	// LearningCurve lists training set sizes to evaluate the test set against.
+	LearningCurve []int
+	// LoadBatch is the number of JSON documents StoreData writes per round trip, with
+	// JSON.MSET when the server supports it and pipelined JSON.SET otherwise. Zero
+	// takes Batch.
+	LoadBatch int
+	// MaxMemoryMB stops the load once Redis uses more memory. Zero disables the guard.
+	MaxMemoryMB int
+	// MemoryCheckEvery is the number of stored rows between two checks of MaxMemoryMB.
+	MemoryCheckEvery int
+	// MaxInFlight bounds the documents sent but not yet acknowledged while loading.
+	// Batches are sent in the background when it is set, zero sends them synchronously.
+	MaxInFlight int
+	// ProfileLoad prints the time StoreData spends reading, parsing, serializing and writing.
+	ProfileLoad bool
+	// Batch is the number of parsed rows buffered before a pipeline flush, the test queries
+	// sent together and the documents written per round trip unless LoadBatch is set. 1
+	// sends them one by one.
+	Batch int
+	// ProgressEvery prints the running accuracy and latency every this many test images. Zero disables it.
+	ProgressEvery int
+	// HistogramBins is the number of bins of the nearest neighbor distance histograms. Zero disables them.
+	HistogramBins int
+	// HistogramOut is a CSV file the histograms are also written to.
+	HistogramOut string
+	// ShowErrors is the number of misclassified test images rendered as ASCII art.
+	ShowErrors int
+	// SortErrors lists this many misclassified test images by ascending distance after
+	// the evaluation, -1 for all and 0 for none. SortErrorsASCII renders them.
+	SortErrors      int
+	SortErrorsASCII bool
+	// Verify compares the stored embeddings with the training CSV instead of running the full flow.
+	Verify bool
+	// VerifySample is the number of random rows checked by Verify.
+	VerifySample int
+	// CompressionReport reads back this many stored documents and reports how well they
+	// compress. Zero disables the report.
+	CompressionReport int
+	// VerifyAll checks every row instead of a sample.
+	VerifyAll bool
+	// Export writes the stored training documents to this file with ExportData and exits.
+	Export string
+	// Import stores the documents of a file written by Export instead of the training CSV.
+	Import string
+	// VerifyDecimals is the number of decimal places compared by Verify, it sets the
+	// absolute tolerance unless VerifyAbsTol is set. VerifyRelTol is added relative to
+	// the expected value.
+	VerifyDecimals int
+	VerifyAbsTol   float64
+	VerifyRelTol   float64
+	// OTelEndpoint is the OTLP/HTTP endpoint spans are exported to. Tracing is off when empty.
+	OTelEndpoint string
+	// PreviewDim compares single-stage search with a two-stage search over PCA previews of
+	// this many dimensions and exits. Zero disables the comparison.
+	PreviewDim int
+	// PreviewCandidates is the number of preview neighbors re-ranked on the full vectors.
+	PreviewCandidates int
+	// CompareStorage loads and evaluates the data as JSON and as HASH and compares them.
+	CompareStorage bool
+	// CompareNormalization indexes and evaluates raw, scaled and standardized pixels.
+	CompareNormalization bool
+	// CompareIndexBuild loads the training images with an index built incrementally and
+	// with one created after the load, and compares their timings.
+	CompareIndexBuild bool
+	// MixedIndex assigns the training classes to a FLAT or an HNSW index, as label:ALGORITHM
+	// pairs or "random", and compares their accuracy and latency. MixedSearch picks the
+	// searched indexes: both, flat or hnsw.
+	MixedIndex  string
+	MixedSearch string
+	// MaskSweep lists the sizes of the centered square masks the test set is evaluated
+	// with to measure the accuracy degradation under occlusion.
+	MaskSweep []int
+	// KSweep lists the K values whose accuracy is compared from one query of the largest
+	// of them per test image.
+	KSweep []int
+	// LeaveOneOut indexes the training and test images together and classifies every
+	// test image against all other images.
+	LeaveOneOut bool
+	// ColdWarm runs the test queries cold and warm and compares their latency.
+	ColdWarm bool
+	// DebugReload adds a pass after reloading the dataset with DEBUG RELOAD to ColdWarm.
+	DebugReload bool
+	// RecallOut compares the neighbors of the index with the exact ones and writes them
+	// per test image to this CSV file. Empty disables the comparison.
+	RecallOut string
+	// RecallStream computes the exact neighbors of RecallOut by streaming the training CSV
+	// once per batch of this many test images instead of building a FLAT index. Zero
+	// builds the index.
+	RecallStream int
+	// Stability runs every test query this many times and reports how often the results
+	// differ between runs. Zero disables the check.
+	Stability int
+	// AverageQueries averages the embeddings of this many test images of a label into one
+	// query and compares its accuracy with the single images. Zero disables it.
+	AverageQueries int
+	// Mask is a x,y,width,height rectangle zeroed in the test images before querying.
+	Mask string
+	// Noise is the noise added to the test images before querying: gaussian or sp.
+	Noise string
+	// NoiseLevels lists the noise levels, the test set is evaluated at each of several.
+	NoiseLevels []float64
+	// Distance is the unit of every reported distance, distanceNative or distanceEuclidean.
+	Distance string
+	// HeadlineAccuracy picks the reported accuracy, accuracyAccepted or accuracyAll.
+	HeadlineAccuracy string
+	// TopConfused prints this many of the most frequent expected and found label pairs
+	// of the wrong guesses. Zero disables it.
+	TopConfused int
+	// MinAccuracy fails the search with exitBelowMinAccuracy when the headline accuracy,
+	// as a fraction, is below it. Zero disables the check.
+	MinAccuracy float64
+	// HistoryFile is a JSON lines file the summary of every evaluation is appended to.
+	// History prints the trend of its runs and exits.
+	HistoryFile string
+	History     bool
+	// IsolatedEvery reruns the first query of every this many batches on its own to
+	// compare the amortized per-sample cost of -batch with a single query.
+	IsolatedEvery int
+	// Passes evaluates the test set this many times and reports the mean and standard
+	// deviation of the accuracy and latency.
+	Passes int
+	// ProfileEvery repeats every this many KNN queries under FT.PROFILE to report the server time.
+	ProfileEvery int
+	// ProfileQuery prints the FT.PROFILE of the KNN query of a random test image and exits.
+	ProfileQuery bool
+	// DebugQuery is the number of first KNN queries whose command and raw reply are printed.
+	DebugQuery int
+	// SearchConfig holds KEY=VALUE pairs of RediSearch configs set at startup, such as
+	// MAXSEARCHRESULTS.
+	SearchConfig string
+	// ListIndexes prints a summary of every existing index and exits.
+	ListIndexes bool
+	// Serve is the address of the HTTP server classifying drawn digits, run instead of the full flow.
+	Serve string
+	// AbstainDistance makes /predict answer 422 when the nearest neighbor is farther. Zero disables it.
+	AbstainDistance float64
+	// AbstainConfidence makes /predict answer 422 when fewer neighbors agree with the vote.
+	AbstainConfidence float64
+	// PrintCreate prints the FT.CREATE command of the index for redis-cli and exits.
+	PrintCreate bool
+	// PrintSearch prints the KNN FT.SEARCH command of the first test image for redis-cli and exits.
+	PrintSearch bool
+	// DumpEmbedding prints the query embedding of the test image at this index and
+	// exits, nil unless -dump-embedding is given. DumpASCII adds its ASCII render.
+	DumpEmbedding *int
+	DumpASCII     bool
+	// SelfTest indexes a tiny synthetic set and checks the KNN results instead of running the full flow.
+	SelfTest bool
+	// Logger receives the logs of a Classifier built from the config, slog.Default()
+	// when nil. There is no flag, it is set by an application embedding the classifier.
+	Logger *slog.Logger
+	// Context bounds the queries of a Classifier or a mode built from the config,
+	// context.Background() when nil. Like Logger it has no flag.
+	Context context.Context
+
+	// detectedPixelType is the encoding -pixel-type auto resolved to for the first CSV
+	// read with the config, which every other CSV of the run must share
+	detectedPixelType string
+	// loadWeights are the weights applied to the embeddings stored by this run, recorded
+	// in the settings by saveSettings so the queries apply the same ones
+	loadWeights pixelWeights
+}
+
+// indexAlgorithm returns cfg.Algorithm or FLAT
+func (cfg Config) indexAlgorithm() string {
+	if cfg.Algorithm == "" {
+		return algorithmFlat
+	}
+	return cfg.Algorithm
+}
+
+// distanceMetric returns cfg.Metric or L2
+func (cfg Config) distanceMetric() string {
+	if cfg.Metric == "" {
+		return metricL2
+	}
+	return cfg.Metric
+}
+
+// context returns cfg.Context or the background context
+func (cfg Config) context() context.Context {
+	if cfg.Context != nil {
+		return cfg.Context
+	}
+	return context.Background()
+}
+
+// logger returns cfg.Logger or the default logger
+func (cfg Config) logger() *slog.Logger {
+	if cfg.Logger != nil {
+		return cfg.Logger
+	}
+	return slog.Default()
+}
+
+// createIndexIfMissing creates the index, an existing one is kept with a warning
+func createIndexIfMissing(rdb *redis.Client, cfg Config) error {
+	err := CreateIndex(rdb, cfg)
+	if err != nil && strings.Contains(err.Error(), "Index already exists") {
+		slog.Warn("Index already exists.")
+		storage, err := storageOf(cfg)
+		if err != nil {
+			return err
+		}
+		return checkKeyPrefix(rdb, storage.Keys)
+	}
+	if err == nil {
+		slog.Info("Index Created.")
+	}
+	return err
+}
+
+// DropData drops mnist_index, the prototype and the preview index together with their
+// documents, and deletes the settings, label counts and next index kept next to them
+func DropData(rdb *redis.Client) error {
+	for _, index := range append([]string{"mnist_index"}, modeIndexes...) {
+		err := rdb.Do(ctx, "FT.DROPINDEX", index, "DD").Err()
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "unknown index") {
+			return err
+		}
+		if err == nil {
+			slog.Info("Index dropped.", slog.String("index", index))
+		}
+	}
+	return rdb.Del(ctx, settingsKey, priorsKey, nextIndexKey).Err()
+}
+
+// modeIndexes are the indexes the modes build besides mnist_index. Each mode registers
+// its own with modeIndex so DropData removes whatever a run left behind.
+var modeIndexes []string
+
+// modeIndex registers an index of a mode for DropData and returns its name
+func modeIndex(name string) string {
+	modeIndexes = append(modeIndexes, name)
+	return name
+}
 
 // CreateIndex creates redis index for
 // FT.CREATE mnist_index ON JSON PREFIX 1 number: SCHEMA $.embedding AS embedding VECTOR FLAT 6 DIM 784 DISTANCE_METRIC L2 TYPE FLOAT32
-func CreateIndex(rdb *redis.Client) error {
-	createIndex := []interface{}{
-		"FT.CREATE", "mnist_index", "ON", "JSON",
-		"PREFIX", "1", "number:",
-		"SCHEMA", "$.embedding", "AS", "embedding",
-		"VECTOR", "FLAT", "6", "DIM", "784",
-		"DISTANCE_METRIC", "L2", "TYPE", "FLOAT32",
+// or its ON HASH equivalent with -storage hash, with the DISTANCE_METRIC of -metric, the
+// algorithm of -algorithm and the prefix of -key-template, all taken from cfg
+func CreateIndex(rdb *redis.Client, cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
 	}
+	return createIndex(rdb, cfg, "mnist_index", storage.Keys.prefix)
+}
 
+// createIndex creates a vector index with the given name over the keys starting with prefix
+func createIndex(rdb *redis.Client, cfg Config, index, prefix string) error {
+	return createVectorIndex(rdb, cfg, index, prefix, NumPixels)
+}
+
+// createVectorIndex creates a vector index of dim dimensional embeddings
+func createVectorIndex(rdb *redis.Client, cfg Config, index, prefix string, dim int) error {
+	command, err := createIndexCommand(cfg, index, prefix, dim)
+	if err != nil {
+		return err
+	}
 	// Execute the FT.SEARCH command using Do()
-	_, err := rdb.Do(ctx, createIndex...).Result()
+	_, err = rdb.Do(ctx, command...).Result()
 	return err
 }
 
-func StoreData(rdb *redis.Client) error {
-	// Open the MNIST CSV file
-	file, err := os.Open("mnist_train.csv")
+// createIndexCommand builds the FT.CREATE command of a vector index of dim dimensional
+// embeddings with the storage, metric, algorithm and vector type of cfg
+func createIndexCommand(cfg Config, index, prefix string, dim int) ([]interface{}, error) {
+	storage, err := storageOf(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
+	createIndex := []interface{}{
+		"FT.CREATE", index, "ON", storage.indexType(),
+		"PREFIX", "1", prefix,
+		"SCHEMA",
+	}
+	createIndex = append(createIndex, storage.embeddingField()...)
+	createIndex = append(createIndex,
+		"VECTOR", cfg.indexAlgorithm(), "6", "DIM", strconv.Itoa(dim),
+		"DISTANCE_METRIC", cfg.distanceMetric(), "TYPE", storage.vectorType(),
+	)
+	return createIndex, nil
+}
 
-	// Create a CSV reader
-	reader := csv.NewReader(bufio.NewReader(file))
+// readRecords reads every record of a CSV file, or of stdin when path is "-". Gzip
+// compressed input is detected by its magic bytes and decompressed on the fly. Every
+// record must hold a label and NumPixels pixels, the label is moved to the front when
+// -label-col puts it last. -pixel-type auto is resolved on cfg by the first CSV read.
+func (cfg *Config) readRecords(path string) ([][]string, error) {
+	reader, closeInput, err := cfg.openRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
 
 	// Read each record from the CSV file
 	records, err := reader.ReadAll()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	err = cfg.arrangeLabel(path, records)
+	if err != nil {
+		return nil, err
 	}
+	err = cfg.checkPixelType(path, records)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
 
-	// Iterate over each row in the CSV file
-	for i, record := range records {
-		// The first value is the result (the number)
-		result, err := strconv.Atoi(record[0])
+// openRecords opens the CSV reader of readRecords, closeInput closes the file
+func (cfg *Config) openRecords(path string) (reader *csv.Reader, closeInput func(), err error) {
+	// Open the CSV file
+	var input io.Reader = os.Stdin
+	var closers []io.Closer
+	closeInput = func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i].Close()
+		}
+	}
+	if path != "-" {
+		file, err := os.Open(path)
 		if err != nil {
-			return err
+			return nil, nil, err
+		}
+		closers = append(closers, file)
+		input = file
+	}
+
+	// Peeking keeps the bytes in the buffer, so this works on a stream too
+	buffered := bufio.NewReader(input)
+	magic, _ := buffered.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			closeInput()
+			return nil, nil, err
 		}
+		closers = append(closers, gz)
+		input = gz
+	} else {
+		input = buffered
+	}
 
-		// The rest are pixel values
-		pixelValues := record[1:]
+	// Create a CSV reader, a row with a missing or extra pixel fails the read
+	reader = csv.NewReader(input)
+	reader.Comma, _ = parseDelimiter(*cfg)
+	reader.FieldsPerRecord = 1 + NumPixels
+	return reader, closeInput, nil
+}
 
-		// Convert pixel values to float32 and normalize them by dividing by 255
-		var pixelStrings []string
-		for _, pixel := range pixelValues {
-			pixelInt, err := strconv.Atoi(pixel)
+// streamRecords reads the CSV at path like readRecords, but size records at a time, and
+// calls fn with every batch and the index of its first record, so only one batch is
+// held in memory. The label column is chosen from the first batch. An error of fn stops
+// the read and is returned.
+func (cfg *Config) streamRecords(path string, size int, fn func(offset int, batch [][]string) error) error {
+	reader, closeInput, err := cfg.openRecords(path)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+
+	column := ""
+	for offset := 0; ; {
+		batch := make([][]string, 0, size)
+		for len(batch) < size {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			batch = append(batch, record)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		first := column == ""
+		if first {
+			column, err = cfg.labelLayout(path, batch)
 			if err != nil {
 				return err
 			}
-			// If the pixel value is 0, directly append "0", else format as float32 with 6 decimals
-			if pixelInt == 0 {
-				pixelStrings = append(pixelStrings, "0")
-			} else {
-				pixelFloat := float32(pixelInt) / 255.0
-				pixelStrings = append(pixelStrings, fmt.Sprintf("%.6f", pixelFloat))
+		}
+		if column == labelLast {
+			moveLabels(batch)
+		}
+		if first {
+			err = cfg.checkPixelType(path, batch)
+			if err != nil {
+				return err
 			}
 		}
-		embedding := strings.Join(pixelStrings, ",")
+		err = fn(offset, batch)
+		if err != nil {
+			return err
+		}
+		if len(batch) < size {
+			return nil
+		}
+		offset += len(batch)
+	}
+}
+
+// StoreData loads the training CSV into Redis in chunks of checkpointRows. When the
+// connection is lost it rebuilds the client and resumes from the last stored chunk, up
+// to cfg.ReconnectAttempts times per chunk. The returned client replaces rdb, which is
+// closed when it had to be rebuilt.
+func StoreData(rdb *redis.Client, cfg Config) (*redis.Client, error) {
+	var profile loadProfile
 
-		// Create JSON data for Redis
-		jsonData := fmt.Sprintf(`{"result": %d, "embedding": [%s]}`, result, embedding)
+	// Read the MNIST CSV file
+	readStart := time.Now()
+	records, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return rdb, err
+	}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return rdb, err
+	}
+	profile.read = time.Since(readStart)
+	if cfg.SampleRate > 0 && cfg.SampleRate < 1 {
+		records = sampleRecords(records, cfg.SampleRate, cfg.Seed)
+	}
 
-		// Execute the JSON.SET command directly in Redis
-		key := fmt.Sprintf("number:%d:%d", i, result)
-		err = rdb.Do(ctx, "JSON.SET", key, "$", jsonData).Err()
+	offset := 0
+	if cfg.Append {
+		// New rows must be built like the ones they are added to
+		err = checkNormalization(rdb, cfg.Normalize)
 		if err != nil {
-			return err
+			return rdb, err
+		}
+		err = checkStorage(rdb, storage)
+		if err != nil {
+			return rdb, err
+		}
+		err = checkMetric(rdb, cfg.distanceMetric())
+		if err != nil {
+			return rdb, err
+		}
+		err = checkVectorType(rdb, storage)
+		if err != nil {
+			return rdb, err
+		}
+		err = checkKeyTemplate(rdb, storage.Keys)
+		if err != nil {
+			return rdb, err
+		}
+		cfg.loadWeights, err = queryPixelWeights(rdb, cfg)
+		if err != nil {
+			return rdb, err
+		}
+		offset, err = nextKeyIndex(rdb, storage.Keys)
+		if err != nil {
+			return rdb, err
+		}
+		slog.Info("Appending to the existing data.", slog.Int("first index", offset))
+	} else {
+		// The label counts and class means are rebuilt from the rows stored below
+		err = rdb.Del(ctx, priorsKey).Err()
+		if err != nil {
+			return rdb, err
 		}
-		fmt.Printf("Stored JSON for number:%d:%d\n", i, result)
+		cfg.loadWeights, err = resolvePixelWeights(cfg, records)
+		if err != nil {
+			return rdb, err
+		}
+		err = resetPrototypes(rdb, cfg)
+		if err != nil {
+			return rdb, err
+		}
+	}
+
+	// A SIGINT or SIGTERM, e.g. from a pod being rescheduled, or the -max-memory-mb
+	// budget stops the load after the pending batch is flushed and its checkpoint recorded
+	sd := newShutdown()
+	defer sd.release()
+	val, err := newValidator(cfg, offset)
+	if err != nil {
+		return rdb, err
+	}
+	loadStart := time.Now()
+	committed := 0
+	for start := 0; start < len(records) && !sd.requested(); start += checkpointRows {
+		end := min(start+checkpointRows, len(records))
+		stored, err := storeRecords(rdb, cfg, records[start:end], offset+start, &profile, sd, val)
+		// Rewriting the documents of the chunk is harmless. Only a connection lost while
+		// the label counts of the chunk were added can count some of them twice.
+		for retry := 0; err != nil && isConnectionError(err) && retry < cfg.ReconnectAttempts; retry++ {
+			client, reconnectErr := reconnect(rdb, cfg.ReconnectAttempts)
+			if reconnectErr != nil {
+				return rdb, reconnectErr
+			}
+			rdb = client
+			slog.Info("Resuming the load.", slog.Int("first index", offset+start))
+			stored, err = storeRecords(rdb, cfg, records[start:end], offset+start, &profile, sd, val)
+		}
+		if err != nil {
+			return rdb, err
+		}
+		committed += stored
+	}
+	err = val.evaluate(rdb, committed)
+	if err != nil {
+		return rdb, err
+	}
+
+	// Remember how the vectors were built so SearchData can refuse mismatching queries
+	err = saveSettings(rdb, cfg)
+	if err != nil {
+		return rdb, err
+	}
+
+	if committed < len(records) {
+		fmt.Printf("Stopped the load, %s: committed %d of %d rows (up to index %d) in %s, run again with -append to store the rest\n",
+			sd.reason, committed, len(records), offset+committed, time.Since(loadStart).Round(time.Millisecond))
+		return rdb, sd.err
+	}
+
+	if cfg.Reconcile {
+		written, err := trainingKeys(records, offset, storage.Keys)
+		if err != nil {
+			return rdb, err
+		}
+		removed, err := reconcileKeys(rdb, written, storage.Keys)
+		if err != nil {
+			return rdb, err
+		}
+		fmt.Printf("Removed %d stale %s keys not written by this load\n", removed, storage.Keys.scanPattern())
 	}
 
 	fmt.Println("All data has been stored in Redis.")
-	return nil
+	loadElapsed := time.Since(loadStart)
+	fmt.Printf("Stored %d rows in %s (%.1f rows/sec, batch %d)\n", len(records), loadElapsed.Round(time.Millisecond), float64(len(records))/loadElapsed.Seconds(), max(cfg.LoadBatch, 1))
+	// The first batch pays for the connection setup and the index initialization
+	if steadyRows := len(records) - profile.firstBatchRows; steadyRows > 0 && !profile.firstBatch.IsZero() {
+		steady := loadStart.Add(loadElapsed).Sub(profile.firstBatch)
+		fmt.Printf("Steady-State Load Throughput = %.1f rows/sec over the %d rows after the first batch (%d rows in %s)\n",
+			float64(steadyRows)/steady.Seconds(), steadyRows, profile.firstBatchRows, profile.firstBatch.Sub(loadStart).Round(time.Millisecond))
+	}
+	build, err := buildIndex(rdb, cfg)
+	if err != nil {
+		return rdb, err
+	}
+	fmt.Printf("Data Transfer = %s, Index Build = %s (%s, %s)\n", loadElapsed.Round(time.Millisecond), build.Round(time.Millisecond), cfg.indexAlgorithm(), buildMode(cfg))
+	if cfg.ProfileLoad {
+		profile.print()
+	}
+	if cfg.Append {
+		numDocs, err := indexNumDocs(rdb, "mnist_index")
+		if err != nil {
+			return rdb, err
+		}
+		fmt.Printf("Index now holds %d documents\n", numDocs)
+	}
+	return rdb, nil
 }
 
-func SearchData(rdb *redis.Client) error {
-	// Open the MNIST test CSV file
-	file, err := os.Open("mnist_test.csv")
-	if err != nil {
-		return err
+// sampleRecords keeps each record with probability rate, drawn from a generator seeded
+// with seed so the same rows are picked on every run
+func sampleRecords(records [][]string, rate float64, seed int64) [][]string {
+	rng := rand.New(rand.NewSource(seed))
+	var sampled [][]string
+	for _, record := range records {
+		if rng.Float64() < rate {
+			sampled = append(sampled, record)
+		}
 	}
-	defer file.Close()
+	slog.Info("Sampled training rows.", slog.Int("stored", len(sampled)), slog.Int("of", len(records)), slog.Float64("rate", rate))
+	return sampled
+}
 
-	// Create a CSV reader
-	reader := csv.NewReader(bufio.NewReader(file))
+// nextKeyIndex returns the index the next stored row gets. It is kept in nextIndexKey,
+// data stored before the counter existed is scanned for its highest index instead.
+func nextKeyIndex(rdb *redis.Client, keys KeyTemplate) (int, error) {
+	next, err := rdb.Get(ctx, nextIndexKey).Int()
+	if err != redis.Nil {
+		return next, err
+	}
 
-	// Read each record from the CSV file
-	records, err := reader.ReadAll()
+	iter := rdb.Scan(ctx, 0, keys.scanPattern(), 1000).Iterator()
+	for iter.Next(ctx) {
+		i, ok := keys.parse(iter.Val())
+		if ok && i >= next {
+			next = i + 1
+		}
+	}
+	return next, iter.Err()
+}
+
+// indexNumDocs returns the number of documents in an index as reported by FT.INFO
+func indexNumDocs(rdb *redis.Client, index string) (int64, error) {
+	numDocs, err := indexInfoValue(rdb, index, "num_docs")
+	return int64(numDocs), err
+}
+
+// loadProfile accumulates the time spent in each stage of StoreData
+type loadProfile struct {
+	read      time.Duration
+	parse     time.Duration
+	serialize time.Duration
+	write     time.Duration
+	// firstBatch is when the first batch of the load was acknowledged and firstBatchRows
+	// its size, the steady state throughput is measured from there
+	firstBatch     time.Time
+	firstBatchRows int
+}
+
+// print writes the time of every stage and its share of the total
+func (p loadProfile) print() {
+	total := p.read + p.parse + p.serialize + p.write
+	stages := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"Read", p.read},
+		{"Parse", p.parse},
+		{"Serialize", p.serialize},
+		{"Write", p.write},
+	}
+	for _, stage := range stages {
+		fmt.Printf("Load %s Duration = %s (%.1f%%)\n", stage.name, stage.duration.Round(time.Millisecond), 100*stage.duration.Seconds()/total.Seconds())
+	}
+}
+
+// storeRecords stores training CSV rows as documents of the configured storage. The row at position i is
+// stored under the key of -key-template for index offset+i and its label. The time of each stage is added to profile.
+// Once sd is requested no further rows are read, the ones before are committed and
+// their number is returned. When val is due after a row the stored rows are flushed
+// and the validation set is evaluated.
+func storeRecords(rdb *redis.Client, cfg Config, records [][]string, offset int, profile *loadProfile, sd *shutdown, val *validator) (int, error) {
+	storage, err := storageOf(cfg)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	writer := newDocWriter(rdb, storage, cfg.LoadBatch, cfg.MaxInFlight)
+	labelCounts := map[int]int{}
+	centroids := newCentroidSums()
+
+	// Iterate over each row in the CSV file
+	for n, record := range records {
+		if sd != nil && cfg.MaxMemoryMB > 0 && (offset+n)%max(cfg.MemoryCheckEvery, 1) == 0 {
+			err := checkMemoryBudget(rdb, cfg.MaxMemoryMB, sd)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if sd.requested() {
+			slog.Warn("Stopping the load, flushing the pending rows.", slog.String("reason", sd.reason), slog.Int("rows", n))
+			records = records[:n]
+			break
+		}
+		i := offset + n
+		stageStart := time.Now()
 
-	correctGuess := 0
-	wrongGuess := 0
-	// Iterate over each row in the test CSV file
-	for i, record := range records {
-		// The first value is the expected result (the label)
-		expectedResult, err := strconv.Atoi(record[0])
+		// The first value is the result (the number)
+		result, err := strconv.Atoi(record[0])
 		if err != nil {
-			return err
+			return 0, err
 		}
 
 		// The rest are pixel values
-		pixelValues := record[1:]
+		pixels, err := cfg.parsePixels(record[1:])
+		if err != nil {
+			return 0, err
+		}
+		// The pixels encoded by -store-pixels stay unweighted
+		var raw []float32
+		if storage.Pixels && cfg.loadWeights != nil {
+			raw = append(raw, pixels...)
+		}
+		cfg.loadWeights.apply(pixels)
+		centroids.add(result, pixels)
+		profile.parse += time.Since(stageStart)
+		stageStart = time.Now()
+
+		key := storage.Keys.key(i, result)
+		cmd, err := storage.setCommand(key, result, pixels)
+		if err != nil {
+			return 0, err
+		}
+		if storage.Pixels {
+			if raw == nil {
+				raw = pixels
+			}
+			cmd = storage.withPixels(cmd, encodePixels(raw, cfg.Normalize))
+		}
+		profile.serialize += time.Since(stageStart)
+		stageStart = time.Now()
 
-		// Convert pixel values to float32 and normalize them by dividing by 255
-		var embedding []float32
-		for _, pixel := range pixelValues {
-			pixelInt, err := strconv.Atoi(pixel)
+		err = writer.write(key, cmd)
+		if err != nil {
+			return 0, err
+		}
+		profile.write += time.Since(stageStart)
+		labelCounts[result]++
+		if val.due(i) {
+			// close sends the pending batch and waits for the background ones, the
+			// writer stays usable afterwards
+			err = writer.close()
 			if err != nil {
-				return err
+				return 0, err
+			}
+			err = val.evaluate(rdb, i+1-val.offset)
+			if err != nil {
+				return 0, err
 			}
-			// Normalize the pixel value
-			pixelFloat := float32(pixelInt) / 255.0
-			embedding = append(embedding, pixelFloat)
 		}
+	}
+	flushStart := time.Now()
+	err = writer.close()
+	if err != nil {
+		return 0, err
+	}
+	profile.write += time.Since(flushStart)
+	if profile.firstBatch.IsZero() {
+		profile.firstBatch, profile.firstBatchRows = writer.firstDone, writer.firstRows
+	}
+	if cfg.MaxInFlight > 0 {
+		fmt.Printf("Max In-Flight Documents = %d of %d allowed\n", writer.maxInFlight.Load(), cfg.MaxInFlight)
+	}
 
-		// Perform the FT.SEARCH query using the normalized embedding
-		foundLabel, duration, err := searchVectorInRedis(rdb, embedding)
+	// An -append load continues after the rows stored here
+	err = rdb.Set(ctx, nextIndexKey, offset+len(records), 0).Err()
+	if err != nil {
+		return 0, err
+	}
+	err = updatePrototypes(rdb, cfg, centroids)
+	if err != nil {
+		return 0, err
+	}
+	return len(records), recordLabelCounts(rdb, labelCounts)
+}
+
+// jsonDocument is the stored JSON of a labeled embedding
+type jsonDocument struct {
+	Result int `json:"result"`
+	// Norm is the L2 norm of Embedding, only stored with -store-norms.
+	Norm      *float64  `json:"norm,omitempty"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// storeDocument stores a labeled embedding as a document of the given storage
+func storeDocument(rdb *redis.Client, storage Storage, key string, result int, embedding []float32) error {
+	cmd, err := storage.setCommand(key, result, embedding)
+	if err != nil {
+		return err
+	}
+	return rdb.Do(ctx, cmd...).Err()
+}
+
+func SearchData(rdb *redis.Client, cfg Config) error {
+	// Read the MNIST test CSV file
+	records, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+
+	err = checkSettings(rdb, cfg)
+	if err != nil {
+		return err
+	}
+
+	if cfg.BenchmarkClients {
+		return benchmarkClients(rdb, cfg, records)
+	}
+	c, err := NewClassifier(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg.NoiseLevels) > 1 {
+		// Every level has to reach -min-accuracy
+		accuracy, err := evaluateNoiseLevels(cfg, c, records)
 		if err != nil {
 			return err
 		}
-		if duration < minDuration {
-			minDuration = duration
-		}
-		if duration > maxDuration {
-			maxDuration = duration
+		return checkMinAccuracy(cfg.MinAccuracy, accuracy)
+	}
+	if cfg.Passes > 1 {
+		accuracy, err := evaluatePasses(c, records, cfg.Passes)
+		if err != nil {
+			return err
 		}
-		totalDuration += duration
-		// Print the expected result and the found label
-		fmt.Printf("Test image %d: expected = %d, found = %d in %dms\n", i, expectedResult, foundLabel, duration)
-		if expectedResult == foundLabel {
-			correctGuess++
-		} else {
-			wrongGuess++
+		return checkMinAccuracy(cfg.MinAccuracy, accuracy)
+	}
+	summary, err := c.Evaluate(records, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.HistoryFile != "" {
+		err = appendHistory(cfg.HistoryFile, cfg, summary)
+		if err != nil {
+			return err
 		}
 	}
-	fmt.Printf("Number of Correct guess = %d\n", correctGuess)
-	fmt.Printf("Number of Wrong guess = %d\n", wrongGuess)
-	fmt.Printf("Accuracy = %d%%\n", 100*correctGuess/(wrongGuess+correctGuess))
-	fmt.Printf("Redis Vector Search Min Duration = %dms\n", minDuration)
-	fmt.Printf("Redis Vector Search Max Duration = %dms\n", maxDuration)
-	fmt.Printf("Redis Vector Search Average Duration = %dms\n", totalDuration/int64(len(records)))
+	return checkMinAccuracy(cfg.MinAccuracy, summary.accuracy())
+}
+
+// exitBelowMinAccuracy is the exit code of a search whose accuracy is below
+// -min-accuracy, distinct from the 1 of a failed run so a CI job can tell them apart
+const exitBelowMinAccuracy = 3
 
+// errBelowMinAccuracy is returned by SearchData when the accuracy is below -min-accuracy
+var errBelowMinAccuracy = errors.New("accuracy below -min-accuracy")
+
+// checkMinAccuracy compares the accuracy in percent with the minimum as a fraction
+func checkMinAccuracy(minimum, accuracy float64) error {
+	if minimum > 0 && accuracy < 100*minimum {
+		return fmt.Errorf("%w: measured %.2f%%, expected at least %.2f%%", errBelowMinAccuracy, accuracy, 100*minimum)
+	}
 	return nil
 }
 
-func convertFloat32ArrayToBlob(vector []float32) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	for _, v := range vector {
-		err := binary.Write(buf, binary.LittleEndian, v)
+// testResult is the outcome of classifying a single test image
+type testResult struct {
+	worker   int
+	index    int
+	expected int
+	found    int
+	// unweighted is the label voted without the prior weighting
+	unweighted int
+	distance   float64
+	// nearest is the nearest neighbor found for the record, neighbors all of them
+	nearest   SearchResult
+	neighbors []SearchResult
+	// agreeing is the number of neighbors with the voted label
+	agreeing int
+	// fetched is the number of neighbors FT.SEARCH returned
+	fetched  int
+	duration int64
+	// amortized is the wall clock time of the batch of the query divided by its size,
+	// isolated the time of the same query run on its own, zero unless it was sampled
+	amortized time.Duration
+	isolated  time.Duration
+	// embedding is the query vector, kept for reviewing errors
+	embedding []float32
+	// zeroVector is set when the query was rejected by checkQueryVector
+	zeroVector bool
+	err        error
+}
+
+// evalSummary holds the totals of one evaluation run
+type evalSummary struct {
+	correct int
+	wrong   int
+	// timeouts counts the queries stopped by the server TIMEOUT or the client -query-timeout, they are left out of the accuracy
+	timeouts int
+	// unweightedCorrect counts the correct guesses of the vote without prior weighting
+	unweightedCorrect int
+	// zeroVectors counts the rejected queries whose vector was all zero
+	zeroVectors int
+	// rejected counts the queries answered with rejectedLabel, they are left out of the
+	// accepted accuracy and count as wrong in the accuracy over all samples
+	rejected int
+	// headline is the accuracy reported by accuracy, accuracyAccepted or accuracyAll
+	headline string
+	classes  classCounts
+	// confused counts the wrong guesses by expected and found label
+	confused confusions
+	// agreement counts the queries by the number of neighbors that agreed with the vote
+	agreement map[int]int
+	// fetched and used total the neighbors returned by FT.SEARCH and counted in the votes
+	fetched int
+	used    int
+	// short counts the queries that returned fewer than K neighbors
+	short int
+	// shortFetched totals the neighbors of the short queries
+	shortFetched int
+	// amortized totals the per-sample cost of every query in its batch. isolated totals
+	// the single query time of the isolatedCount sampled queries, isolatedAmortized their
+	// amortized cost.
+	amortized         time.Duration
+	isolated          time.Duration
+	isolatedAmortized time.Duration
+	isolatedCount     int
+	// durations holds the duration of every query
+	durations *Stats
+	elapsed   time.Duration
+}
+
+// processed is the number of test images that got an answer, rejections included
+func (s evalSummary) processed() int {
+	return s.correct + s.wrong + s.rejected
+}
+
+// Accuracy definitions selectable with -headline-accuracy
+const (
+	// accuracyAccepted leaves rejected test images out, the precision when an answer is given.
+	accuracyAccepted = "accepted"
+	// accuracyAll counts rejected test images as wrong, the end-to-end usefulness.
+	accuracyAll = "all"
+)
+
+// accuracy is the headline accuracy of the summary, over the accepted test images
+// unless headline is accuracyAll
+func (s evalSummary) accuracy() float64 {
+	if s.headline == accuracyAll {
+		return s.allAccuracy()
+	}
+	return s.acceptedAccuracy()
+}
+
+// acceptedAccuracy is the percentage of correct guesses among the non rejected test images
+func (s evalSummary) acceptedAccuracy() float64 {
+	if s.correct+s.wrong == 0 {
+		return 0
+	}
+	return 100 * float64(s.correct) / float64(s.correct+s.wrong)
+}
+
+// allAccuracy is the percentage of correct guesses among all answered test images,
+// rejections counting as wrong
+func (s evalSummary) allAccuracy() float64 {
+	if s.processed() == 0 {
+		return 0
+	}
+	return 100 * float64(s.correct) / float64(s.processed())
+}
+
+// queriesPerSecond is the aggregate search throughput over the wall clock of the run
+func (s evalSummary) queriesPerSecond() float64 {
+	return float64(s.processed()) / s.elapsed.Seconds()
+}
+
+// parsePixels converts pixel values to float32, normalized by dividing by 255 unless
+// cfg.Normalize is false in which case the raw 0-255 values are kept. Pixels read with
+// -pixel-type float are normalized already and kept as they are.
+func (cfg *Config) parsePixels(pixelValues []string) ([]float32, error) {
+	if cfg.Normalize && cfg.floatPixels() {
+		return parseFloatPixels(pixelValues)
+	}
+	embedding, err := cfg.parseRawPixels(pixelValues)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Normalize {
+		scalePixels(embedding)
+	}
+	return embedding, nil
+}
+
+// parseRawPixels converts the pixel columns of a CSV row into their 0-255 values,
+// pixels read with -pixel-type float are scaled up to them
+func (cfg *Config) parseRawPixels(pixelValues []string) ([]float32, error) {
+	if cfg.floatPixels() {
+		pixels, err := parseFloatPixels(pixelValues)
+		if err != nil {
+			return nil, err
+		}
+		for i := range pixels {
+			pixels[i] *= 255
+		}
+		return pixels, nil
+	}
+	pixels := make([]float32, 0, len(pixelValues))
+	for _, pixel := range pixelValues {
+		pixelInt, err := strconv.Atoi(pixel)
 		if err != nil {
 			return nil, err
 		}
+		pixels = append(pixels, float32(pixelInt))
+	}
+	return pixels, nil
+}
+
+// scalePixels divides 0-255 pixel values by 255 in place
+func scalePixels(pixels []float32) {
+	for i := range pixels {
+		pixels[i] /= 255.0
 	}
-	return buf.Bytes(), nil
+}
+
+// checkExistingData counts the training keys already in the target DB. Loading on top
+// of them is refused unless cfg.Force is set, so two datasets are not mixed by accident.
+func checkExistingData(rdb *redis.Client, cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	var existing int
+	iter := rdb.Scan(ctx, 0, storage.Keys.scanPattern(), 1000).Iterator()
+	for iter.Next(ctx) {
+		existing++
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if existing == 0 {
+		return nil
+	}
+	if !cfg.Force && !cfg.Reconcile {
+		return fmt.Errorf("DB %d already holds %d %s keys, use -force to load anyway or -db to pick another DB", cfg.DB, existing, storage.Keys.scanPattern())
+	}
+	slog.Warn("Loading on top of existing keys.", slog.Int("db", cfg.DB), slog.Int("keys", existing))
+	return nil
+}
+
+// saveSettings records the options the stored vectors are built with
+func saveSettings(rdb *redis.Client, cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.loadWeights == nil {
+		err := rdb.HDel(ctx, settingsKey, "pixel_weights").Err()
+		if err != nil {
+			return err
+		}
+	} else {
+		err := rdb.HSet(ctx, settingsKey, "pixel_weights", cfg.loadWeights.encode()).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return rdb.HSet(ctx, settingsKey, "normalize", cfg.Normalize, "storage", storage.Mode, "metric", cfg.distanceMetric(), "vector_type", storage.vectorType(), "key_template", storage.Keys.text).Err()
+}
+
+// checkSettings makes sure the stored data matches the normalization, storage, metric
+// and vector type of cfg, the queries would not compare with it otherwise
+func checkSettings(rdb *redis.Client, cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	err = checkNormalization(rdb, cfg.Normalize)
+	if err != nil {
+		return err
+	}
+	err = checkStorage(rdb, storage)
+	if err != nil {
+		return err
+	}
+	err = checkMetric(rdb, cfg.distanceMetric())
+	if err != nil {
+		return err
+	}
+	return checkVectorType(rdb, storage)
+}
+
+// checkNormalization makes sure the stored vectors were built with the same
+// normalization setting that is used for the queries
+func checkNormalization(rdb *redis.Client, normalize bool) error {
+	stored, err := rdb.HGet(ctx, settingsKey, "normalize").Result()
+	if err == redis.Nil {
+		slog.Warn("Normalization used for the stored data is unknown.", slog.Bool("normalize", normalize))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	storedNormalize, err := strconv.ParseBool(stored)
+	if err != nil {
+		return err
+	}
+	if storedNormalize != normalize {
+		return fmt.Errorf("data was stored with normalize=%t but queries use normalize=%t", storedNormalize, normalize)
+	}
+	return nil
+}
+
+// benchmarkClients evaluates the test records once with a shared client and once with
+// a dedicated client per worker, and reports which was faster at cfg.Workers workers
+func benchmarkClients(rdb *redis.Client, cfg Config, records [][]string) error {
+	cfg.ClientPerWorker = false
+	c, err := NewClassifier(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	shared, err := c.Evaluate(records, nil)
+	if err != nil {
+		return err
+	}
+
+	cfg.ClientPerWorker = true
+	c, err = NewClassifier(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	perWorker, err := c.Evaluate(records, nil)
+	if err != nil {
+		return err
+	}
+
+	sharedRate := shared.queriesPerSecond()
+	perWorkerRate := perWorker.queriesPerSecond()
+	fmt.Printf("Shared client with %d workers = %s (%.1f queries/sec)\n", cfg.Workers, shared.elapsed.Round(time.Millisecond), sharedRate)
+	fmt.Printf("Client per worker with %d workers = %s (%.1f queries/sec)\n", cfg.Workers, perWorker.elapsed.Round(time.Millisecond), perWorkerRate)
+	if perWorkerRate > sharedRate {
+		fmt.Println("Client per worker performed better.")
+	} else {
+		fmt.Println("Shared client performed better.")
+	}
+	return nil
+}
+
+// convertFloat32ArrayToBlob encodes the vector as little endian float32 values, the
+// format RediSearch expects for a FLOAT32 vector blob
+func convertFloat32ArrayToBlob(vector []float32) []byte {
+	blob := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(blob[4*i:], math.Float32bits(v))
+	}
+	return blob
+}
+
+// SearchResult is a single neighbor returned by a KNN query
+type SearchResult struct {
+	Key      string  `json:"key"`
+	Label    int     `json:"label"`
+	Distance float64 `json:"distance"`
+	// Norm is the stored L2 norm of the neighbor, 0 unless the norms are stored.
+	Norm float64 `json:"norm,omitempty"`
+	// Similarity is 1 - Distance with the COSINE metric, nil otherwise.
+	Similarity *float64 `json:"similarity,omitempty"`
+}
+
+// searcher runs the KNN queries of one setup: the layout and vector type of the stored
+// documents, the metric of the index, the unit of the reported distances, the timeouts
+// of a query and the FT.PROFILE sampling. Each classifier and each mode has its own, so
+// setups with different options can be searched side by side in one process.
+type searcher struct {
+	ctx     context.Context
+	storage Storage
+	metric  string
+	// distance is the unit of the reported distances, see reportedDistances
+	distance string
+	// serverTimeout is sent as the TIMEOUT of every query, see timeoutError, and
+	// queryTimeout bounds a whole query, see withQueryTimeout. Zero disables either.
+	serverTimeout time.Duration
+	queryTimeout  time.Duration
+	profile       *profileSampler
+	// debug is the number of queries whose command and raw reply are still to be
+	// printed, see debugQuery
+	debug atomic.Int64
+	// logger receives the warnings of the searches, warned holds the ones logged already
+	logger *slog.Logger
+	warned sync.Map
+}
+
+// newSearcher returns the searcher of documents stored as storage with the metric,
+// distance unit, timeouts, profiling, context and logger of cfg
+func newSearcher(cfg Config, storage Storage) *searcher {
+	s := &searcher{
+		ctx:           cfg.context(),
+		storage:       storage,
+		metric:        cfg.distanceMetric(),
+		distance:      cfg.Distance,
+		serverTimeout: cfg.ServerTimeout,
+		queryTimeout:  cfg.QueryTimeout,
+		profile:       newProfileSampler(cfg.ProfileEvery),
+		logger:        cfg.logger(),
+	}
+	s.debug.Store(int64(cfg.DebugQuery))
+	if s.distance == "" {
+		s.distance = distanceNative
+	}
+	return s
 }
 
 // searchVectorInRedis performs an FT.SEARCH query on the mnist_index using the embedding
-func searchVectorInRedis(rdb *redis.Client, embedding []float32) (int, int64, error) {
-	// Convert the embedding to a byte slice (binary format)
-	embeddingBytes, err := convertFloat32ArrayToBlob(embedding)
+// and returns the nearest neighbor
+func (s *searcher) searchVectorInRedis(rdb *redis.Client, embedding []float32) (SearchResult, int64, error) {
+	neighbors, _, duration, err := s.searchNeighbors(rdb, embedding, 1)
+	if err != nil {
+		return SearchResult{}, 0, err
+	}
+	return neighbors[0], duration, nil
+}
+
+// searchNeighbors performs a KNN FT.SEARCH query on the mnist_index and returns
+// the k nearest stored vectors sorted by distance with the total of matching documents
+func (s *searcher) searchNeighbors(rdb *redis.Client, embedding []float32, k int) ([]SearchResult, int64, int64, error) {
+	return s.knnSearch(s.ctx, rdb, "mnist_index", embedding, k)
+}
+
+// searchIndex performs a KNN FT.SEARCH query on the given index and returns the neighbors
+// with the total of matching documents
+func (s *searcher) searchIndex(rdb *redis.Client, index string, embedding []float32, k int) ([]SearchResult, int64, int64, error) {
+	return s.knnSearch(s.ctx, rdb, index, embedding, k)
+}
+
+// searchIndexExcluding performs a KNN FT.SEARCH query on the given index and leaves the
+// document stored under key out of the k neighbors. One more neighbor is requested so
+// k remain when the query finds itself.
+func (s *searcher) searchIndexExcluding(rdb *redis.Client, index string, embedding []float32, k int, key string) ([]SearchResult, int64, error) {
+	neighbors, _, duration, err := s.searchIndex(rdb, index, embedding, k+1)
 	if err != nil {
-		return 0, 0, err
+		return nil, 0, err
+	}
+	others := make([]SearchResult, 0, k)
+	for _, neighbor := range neighbors {
+		if neighbor.Key != key && len(others) < k {
+			others = append(others, neighbor)
+		}
+	}
+	if len(others) == 0 {
+		return nil, 0, errNoNeighbors
+	}
+	return others, duration, nil
+}
+
+// knnSearch performs a KNN FT.SEARCH query on the given index with the storage, metric
+// and timeouts of the searcher. It returns the neighbors, the total of matching documents
+// reported by the server and the query duration in milliseconds.
+func (s *searcher) knnSearch(ctx context.Context, rdb *redis.Client, index string, embedding []float32, k int) ([]SearchResult, int64, int64, error) {
+	// A degenerate query is rejected instead of sent
+	if err := checkQueryVector(embedding, s.metric); err != nil {
+		return nil, 0, 0, err
 	}
 
-	searchQuery := []interface{}{
-		"FT.SEARCH",                           // Explicitly using the FT.SEARCH command
-		"mnist_index",                         // Index name
-		"*=>[KNN 1 @embedding $blob AS dist]", // KNN search query
-		"SORTBY", "dist",                      // Sort by distance
-		"PARAMS", "2", "blob", embeddingBytes, // Params: search vector blob
-		"DIALECT", "2", // RedisSearch dialect 2
+	// Convert the embedding to a byte slice (binary format)
+	embeddingBytes := s.storage.vectorBlob(embedding)
+
+	searchQuery, err := buildKNNQuery(KNNQuery{Index: index, K: k, Storage: s.storage, Timeout: s.serverTimeout, Blob: embeddingBytes})
+	if err != nil {
+		return nil, 0, 0, err
 	}
 
+	queryCtx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+	spanCtx, span := tracer.Start(queryCtx, "FT.SEARCH KNN", trace.WithAttributes(
+		attribute.String("index", index),
+		attribute.Int("k", k),
+		attribute.String("metric", s.metric),
+	))
+	defer span.End()
+
 	start := time.Now()
 
 	// Execute the FT.SEARCH command using Do()
-	result, err := rdb.Do(ctx, searchQuery...).Result()
-	duration := time.Since(start).Milliseconds()
+	result, err := rdb.Do(spanCtx, searchQuery...).Result()
+	elapsed := time.Since(start)
+	duration := elapsed.Milliseconds()
+	s.debugQuery(searchQuery, result, err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, 0, 0, s.timeoutError(err, nil)
+	}
+
+	neighbors, total, err := parseSearchReply(result, s.storage)
+	if err == nil && len(neighbors) == 0 {
+		err = errNoNeighbors
+	}
+	err = s.timeoutError(err, result)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, total, 0, err
+	}
+	s.warnSearchLimits(result, total, len(neighbors), k)
+	neighbors = s.reportedDistances(neighbors)
+	span.SetAttributes(
+		attribute.Int64("total_results", total),
+		attribute.Int("label", neighbors[0].Label),
+		attribute.Float64("distance", neighbors[0].Distance),
+	)
+	s.sampleProfile(ctx, rdb, searchQuery, elapsed)
+	return neighbors, total, duration, nil
+}
+
+// errNoNeighbors is returned by the KNN searches for a FT.SEARCH reply without any document
+var errNoNeighbors = errors.New("no neighbors found")
+
+// parseSearchReply converts a FT.SEARCH reply of the form
+// [total, key1, [field, value, ...], key2, [field, value, ...], ...] into SearchResults,
+// reading the distance and the label from the fields named by storage. It also returns
+// the total, the number of documents matching the query, which can exceed the returned
+// ones past the LIMIT. A reply without documents is no error, the result is empty.
+func parseSearchReply(result interface{}, storage Storage) ([]SearchResult, int64, error) {
+	total, err := searchTotal(result)
+	if err != nil {
+		return nil, 0, err
+	}
+	docs, err := searchDocuments(result)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(docs) == 0 {
+		return nil, total, nil
+	}
+	alias := storage.DistanceAlias
+	if alias == "" {
+		alias = defaultDistanceAlias
+	}
+
+	var neighbors []SearchResult
+	for _, doc := range docs {
+		neighbor := SearchResult{Key: doc.key}
+
+		for name, value := range doc.fields {
+			switch name {
+			case alias:
+				neighbor.Distance, err = replyFloat(value)
+				if err != nil {
+					return nil, 0, err
+				}
+			case storage.normField():
+				neighbor.Norm, err = replyFloat(value)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+
+		neighbor.Label, err = storage.label(doc)
+		if err != nil {
+			return nil, 0, err
+		}
+		neighbors = append(neighbors, neighbor)
+	}
+	return neighbors, total, nil
+}
+
+// QueryByKey fetches the embedding stored under cfg.QueryKey and prints its cfg.QueryK
+// nearest neighbors. The stored vector itself is expected to come back first at distance 0.
+func QueryByKey(rdb *redis.Client, cfg Config) error {
+	key := cfg.QueryKey
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	embedding, err := fetchEmbedding(rdb, storage, key)
 	if err != nil {
-		return 0, 0, err
+		return err
 	}
 
-	items, ok := result.([]interface{})
-	if !ok || len(items) == 0 {
-		return 0, 0, fmt.Errorf("unexpected result format")
+	neighbors, total, duration, err := newSearcher(cfg, storage).searchNeighbors(rdb, embedding, cfg.QueryK)
+	if err != nil {
+		return err
 	}
 
-	parts := strings.Split(items[1].(string), ":")
+	fmt.Printf("Nearest %d neighbors of %s (out of %d matching documents) found in %dms:\n", len(neighbors), key, total, duration)
+	for i, neighbor := range neighbors {
+		if neighbor.Similarity != nil {
+			fmt.Printf("%d. %s label = %d, distance = %f, cosine similarity = %f\n", i+1, neighbor.Key, neighbor.Label, neighbor.Distance, *neighbor.Similarity)
+			continue
+		}
+		fmt.Printf("%d. %s label = %d, distance = %f\n", i+1, neighbor.Key, neighbor.Label, neighbor.Distance)
+	}
+	return nil
+}
 
-	// Get the last part (which should be the digit)
-	lastPart := parts[len(parts)-1]
+// fetchEmbedding reads the embedding of a document stored as storage
+func fetchEmbedding(rdb *redis.Client, storage Storage, key string) ([]float32, error) {
+	reply, err := rdb.Do(ctx, storage.getEmbeddingCommand(key)...).Text()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("key %s not found", key)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	// Convert the last part to an integer
-	parsedInt, err := strconv.Atoi(lastPart)
+	embedding, err := storage.decodeEmbedding(reply)
 	if err != nil {
-		return 0, 0, err
+		return nil, fmt.Errorf("key %s: %w", key, err)
 	}
+	return embedding, nil
+}
 
-	return parsedInt, duration, nil
+// parseDelimiter returns the CSV delimiter selected by -delimiter and -tsv
+func parseDelimiter(cfg Config) (rune, error) {
+	if cfg.TSV || cfg.Delimiter == `\t` {
+		return '\t', nil
+	}
+	if cfg.Delimiter == "" {
+		return ',', nil
+	}
+	runes := []rune(cfg.Delimiter)
+	if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' || runes[0] == utf8.RuneError {
+		return 0, fmt.Errorf("invalid -delimiter %q, expected a single character other than a quote or a line break", cfg.Delimiter)
+	}
+	return runes[0], nil
 }
 
-func main() {
-	minDuration = 999999
-	maxDuration = 0
-	totalDuration = 0
+// setup starts tracing, connects to Redis and checks its modules, falling back to the
+// hash storage in cfg without RedisJSON. cleanup stops tracing. When any of it fails
+// what was started is stopped again and the error is returned.
+func setup(cfg *Config) (*redis.Client, func(), error) {
+	cleanup := func() {}
+	if cfg.OTelEndpoint != "" {
+		shutdown, err := setupTracing(cfg.OTelEndpoint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("set up tracing: %w", err)
+		}
+		cleanup = shutdown
+	}
+
+	password, err := redisPassword(*cfg)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("read the Redis password: %w", err)
+	}
+
 	// Connect to Redis
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379", // Replace with your Redis server address
-		Password: "thepassword",    // Set Redis password if needed
-		DB:       0,                // Use default DB
+		Addr:         "localhost:6379", // Replace with your Redis server address
+		Password:     password,         // -password, -password-file, REDIS_PASSWORD or the prompt
+		DB:           cfg.DB,           // Use default DB unless -db is given
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		// Without it go-redis ignores context deadlines on the socket and -query-timeout
+		// cannot stop a query the server never answers
+		ContextTimeoutEnabled: true,
+		// go-redis v9 speaks RESP3 unless told otherwise, the replies are parsed either way
+		Protocol: cfg.Protocol,
 	})
 
-	defer rdb.Close()
+	err = checkModules(rdb, cfg)
+	if err != nil {
+		rdb.Close()
+		cleanup()
+		return nil, nil, fmt.Errorf("required Redis module missing: %w", err)
+	}
 
-	err := CreateIndex(rdb)
+	err = applySearchConfig(rdb, cfg.SearchConfig)
 	if err != nil {
-		if strings.Contains(err.Error(), "Index already exists") {
-			slog.Warn("Index already exists.")
-		} else {
+		rdb.Close()
+		cleanup()
+		return nil, nil, fmt.Errorf("set the RediSearch config: %w", err)
+	}
+	return rdb, cleanup, nil
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// run runs the subcommand or the flag selected mode and returns the exit code. Every
+// failure returns instead of exiting so the deferred client and tracer cleanup runs
+// exactly once.
+func run() int {
+	if isCommand(os.Args[1:]) {
+		return runCommand(os.Args[1:])
+	}
+	cfg := parseFlags()
+
+	m, ok := selectMode(cfg)
+	if ok && m.offline {
+		return exitCode(m.run(nil, cfg), m.failure)
+	}
+
+	rdb, cleanup, err := setup(&cfg)
+	if err != nil {
+		slog.Error("Could not set up.", slog.String("error", err.Error()))
+		return 1
+	}
+	// StoreData may replace the client after a lost connection
+	defer func() {
+		rdb.Close()
+		cleanup()
+	}()
+
+	if ok {
+		return exitCode(m.run(rdb, cfg), m.failure)
+	}
+
+	if !cfg.IndexAfterLoad {
+		err = createIndexIfMissing(rdb, cfg)
+		if err != nil {
 			slog.Error("Could not create search index.", slog.String("error", err.Error()))
-			os.Exit(1)
+			return 1
 		}
-	} else {
-		slog.Info("Index Created.")
 	}
 
-	err = StoreData(rdb)
-	if err != nil {
-		slog.Error("Could not store data.", slog.String("error", err.Error()))
-		os.Exit(1)
+	if !cfg.Append {
+		err = checkExistingData(rdb, cfg)
+		if err != nil {
+			slog.Error("Refusing to store data.", slog.String("error", err.Error()))
+			return 1
+		}
 	}
 
-	err = SearchData(rdb)
-	if err != nil {
-		slog.Error("Could not search data.", slog.String("error", err.Error()))
-		os.Exit(1)
+	if cfg.Import != "" {
+		err = ImportData(rdb, cfg)
+		if err != nil {
+			slog.Error("Could not import data.", slog.String("error", err.Error()))
+			return 1
+		}
+	} else {
+		rdb, err = StoreData(rdb, cfg)
+		if errors.Is(err, errLoadInterrupted) {
+			return 0
+		}
+		if err != nil {
+			slog.Error("Could not store data.", slog.String("error", err.Error()))
+			return 1
+		}
 	}
+
+	return exitCode(SearchData(rdb, cfg), "Could not search data.")
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestConvertFloat32ArrayToBlobRoundTrip(t *testing.T) {
+	vector := []float32{0, 1, -1, 0.5, 1.0 / 255, math.MaxFloat32, math.SmallestNonzeroFloat32}
+	blob := convertFloat32ArrayToBlob(vector)
+	if len(blob) != 4*len(vector) {
+		t.Fatalf("blob has %d bytes, want %d", len(blob), 4*len(vector))
+	}
+	// RediSearch reads the values little endian
+	if want := []byte{0x00, 0x00, 0x80, 0x3f}; !bytes.Equal(blob[4:8], want) {
+		t.Errorf("encoding of 1 = % x, want % x", blob[4:8], want)
+	}
+
+	decoded, err := convertBlobToFloat32Array(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(vector) {
+		t.Fatalf("decoded %d values, want %d", len(decoded), len(vector))
+	}
+	for i := range vector {
+		if decoded[i] != vector[i] {
+			t.Errorf("value %d = %g, want %g", i, decoded[i], vector[i])
+		}
+	}
+
+	if _, err := convertBlobToFloat32Array(blob[:5]); err == nil {
+		t.Error("a blob of 5 bytes decoded without an error")
+	}
+}
+
+func BenchmarkConvertFloat32ArrayToBlob(b *testing.B) {
+	vector := make([]float32, NumPixels)
+	for i := range vector {
+		vector[i] = float32(i%256) / 255
+	}
+	b.SetBytes(int64(4 * len(vector)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		convertFloat32ArrayToBlob(vector)
+	}
+}
+
+func TestSelectModePrecedence(t *testing.T) {
+	tests := []struct {
+		cfg     Config
+		failure string
+		offline bool
+	}{
+		{Config{EmbeddingsOut: "emb.csv", Serve: ":8080"}, "Could not export embeddings.", true},
+		{Config{ListIndexes: true, Serve: ":8080"}, "Could not list the indexes.", false},
+		{Config{Serve: ":8080", ProfileQuery: true}, "Could not serve.", false},
+		{Config{ProfileQuery: true, QueryKey: "number:0:7"}, "Could not profile query.", false},
+	}
+	for _, test := range tests {
+		m, ok := selectMode(test.cfg)
+		if !ok || m.failure != test.failure || m.offline != test.offline {
+			t.Errorf("selectMode picked %q offline %t, want %q offline %t", m.failure, m.offline, test.failure, test.offline)
+		}
+	}
+	if _, ok := selectMode(Config{}); ok {
+		t.Error("a config without mode flags selected a mode")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pixelMask is a rectangle of the 28x28 image that is zeroed before querying, for
+// occlusion robustness experiments
+type pixelMask struct {
+	x, y, width, height int
+}
+
+// parseMask parses -mask given as x,y,width,height in pixels, with x and y the column
+// and row of the top left corner. An empty value is no mask.
+func parseMask(value string) (*pixelMask, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid -mask %q, expected x,y,width,height", value)
+	}
+	var v [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid -mask %q, expected x,y,width,height", value)
+		}
+		v[i] = n
+	}
+	m := &pixelMask{x: v[0], y: v[1], width: v[2], height: v[3]}
+	if m.width == 0 || m.height == 0 || m.x+m.width > ImageSize || m.y+m.height > ImageSize {
+		return nil, fmt.Errorf("invalid -mask %q, the rectangle must lie within the %dx%d image", value, ImageSize, ImageSize)
+	}
+	return m, nil
+}
+
+// centeredMask returns the size x size square in the middle of the image
+func centeredMask(size int) *pixelMask {
+	offset := (ImageSize - size) / 2
+	return &pixelMask{x: offset, y: offset, width: size, height: size}
+}
+
+// String formats the mask like -mask takes it
+func (m *pixelMask) String() string {
+	return fmt.Sprintf("%d,%d,%d,%d", m.x, m.y, m.width, m.height)
+}
+
+// apply zeroes the masked pixels of an embedding, a nil mask keeps it as it is
+func (m *pixelMask) apply(embedding []float32) {
+	if m == nil {
+		return
+	}
+	for row := m.y; row < m.y+m.height; row++ {
+		for col := m.x; col < m.x+m.width; col++ {
+			embedding[row*ImageSize+col] = 0
+		}
+	}
+}
+
+// MaskSweep evaluates the test set without a mask and then with a centered square
+// mask of every size in cfg.MaskSweep, and prints how much the accuracy degrades as
+// more of the digit is occluded
+func MaskSweep(rdb *redis.Client, cfg Config) error {
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+
+	sizes := append([]int{0}, cfg.MaskSweep...)
+	accuracy := make([]float64, len(sizes))
+	for i, size := range sizes {
+		cfg.Mask = ""
+		if size > 0 {
+			cfg.Mask = centeredMask(size).String()
+		}
+		c, err := NewClassifier(rdb, cfg)
+		if err != nil {
+			return err
+		}
+		summary, err := c.Evaluate(test, nil)
+		if err != nil {
+			return fmt.Errorf("mask size %d: %w", size, err)
+		}
+		accuracy[i] = summary.accuracy()
+	}
+
+	fmt.Printf("%-10s %-12s %8s %10s %8s\n", "Mask", "Rectangle", "Area", "Accuracy", "Drop")
+	for i, size := range sizes {
+		rectangle := "none"
+		if size > 0 {
+			rectangle = centeredMask(size).String()
+		}
+		fmt.Printf("%-10s %-12s %7.1f%% %9.2f%% %7.2f%%\n", fmt.Sprintf("%dx%d", size, size), rectangle,
+			100*float64(size*size)/float64(NumPixels), accuracy[i], accuracy[0]-accuracy[i])
+	}
+	return nil
+}
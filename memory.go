@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errMemoryBudget is returned by StoreData after -max-memory-mb stopped the load and the
+// rows stored so far were committed
+var errMemoryBudget = errors.New("memory budget of -max-memory-mb reached")
+
+// usedMemory returns the used_memory of INFO memory in bytes
+func usedMemory(rdb *redis.Client) (int64, error) {
+	info, err := rdb.Info(ctx, "memory").Result()
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "used_memory:")
+		if ok {
+			return strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("INFO memory has no used_memory")
+}
+
+// checkMemoryBudget stops the load through sd once Redis uses more than maxMB
+// megabytes, before an opaque OOM error rejects the writes
+func checkMemoryBudget(rdb *redis.Client, maxMB int, sd *shutdown) error {
+	used, err := usedMemory(rdb)
+	if err != nil {
+		return err
+	}
+	if used > int64(maxMB)<<20 {
+		sd.stop(fmt.Sprintf("Redis uses %d MB, above -max-memory-mb %d", used>>20, maxMB), errMemoryBudget)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Distance metrics selectable with -metric
+const (
+	// metricL2 is the Euclidean distance.
+	metricL2 = "L2"
+	// metricCosine is the cosine distance, 1 - cosine similarity.
+	metricCosine = "COSINE"
+	// metricIP is the inner product distance, 1 - inner product.
+	metricIP = "IP"
+)
+
+// validMetric reports an error for a metric RediSearch does not know
+func validMetric(m string) error {
+	switch m {
+	case metricL2, metricCosine, metricIP:
+		return nil
+	}
+	return fmt.Errorf("unknown metric %q, expected %s, %s or %s", m, metricL2, metricCosine, metricIP)
+}
+
+// vectorNorm returns the L2 norm of an embedding
+func vectorNorm(embedding []float32) float64 {
+	var sum float64
+	for _, v := range embedding {
+		sum += float64(v) * float64(v)
+	}
+	return math.Sqrt(sum)
+}
+
+// minQueryNorm is the L2 norm below which a query vector counts as all zero
+const minQueryNorm = 1e-6
+
+// errZeroVector marks a query that is not sent because its vector is all zero, an
+// all-black image. Its cosine distance is undefined and its inner product distance is 1
+// to every stored vector, so any neighbor RediSearch returned would be arbitrary. With
+// L2 the stored vector nearest to the origin is still a well-defined answer.
+var errZeroVector = errors.New("query vector is all zero")
+
+// checkQueryVector returns errZeroVector when the embedding cannot be meaningfully
+// searched with the metric
+func checkQueryVector(embedding []float32, m string) error {
+	if m == metricL2 || vectorNorm(embedding) >= minQueryNorm {
+		return nil
+	}
+	return fmt.Errorf("%w, the %s distance does not depend on the stored vectors", errZeroVector, m)
+}
+
+// Distance units selectable with -distance
+const (
+	// distanceNative keeps the distance RediSearch reports, the squared Euclidean
+	// distance for L2.
+	distanceNative = "native"
+	// distanceEuclidean reports the true Euclidean distance for L2, the other metrics
+	// are kept as they are.
+	distanceEuclidean = "euclidean"
+)
+
+// validDistanceUnit reports an error for an unknown -distance
+func validDistanceUnit(unit string) error {
+	switch unit {
+	case distanceNative, distanceEuclidean:
+		return nil
+	}
+	return fmt.Errorf("unknown -distance %q, expected %s or %s", unit, distanceNative, distanceEuclidean)
+}
+
+// reportedDistances turns the distances of the neighbors from the ones RediSearch
+// returns into the distance unit of the searcher, set from -distance, and fills in
+// their cosine similarity when the metric is COSINE, which RediSearch returns as the
+// cosine distance 1 - similarity. Every search passes its neighbors through here, so
+// the logs, CSV files, histograms and distance thresholds all use the same unit.
+func (s *searcher) reportedDistances(neighbors []SearchResult) []SearchResult {
+	for i := range neighbors {
+		switch {
+		case s.metric == metricCosine:
+			similarity := 1 - neighbors[i].Distance
+			neighbors[i].Similarity = &similarity
+		case s.metric == metricL2 && s.distance == distanceEuclidean:
+			neighbors[i].Distance = math.Sqrt(math.Max(0, neighbors[i].Distance))
+		}
+	}
+	return neighbors
+}
+
+// distanceName describes the distances reported by the searcher
+func (s *searcher) distanceName() string {
+	switch s.metric {
+	case metricCosine:
+		return "cosine distance"
+	case metricIP:
+		return "1 - inner product"
+	}
+	if s.distance == distanceEuclidean {
+		return "Euclidean"
+	}
+	return "squared Euclidean"
+}
+
+// checkMetric makes sure the index was created with the metric of this run, the
+// distances would not compare otherwise
+func checkMetric(rdb *redis.Client, metric string) error {
+	stored, err := rdb.HGet(ctx, settingsKey, "metric").Result()
+	if err == redis.Nil {
+		// Data stored before the setting existed is always indexed with L2
+		stored = metricL2
+	} else if err != nil {
+		return err
+	}
+	if stored != metric {
+		return fmt.Errorf("index was created with -metric %s but this run uses -metric %s", stored, metric)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckQueryVector(t *testing.T) {
+	zero := make([]float32, NumPixels)
+	tiny := make([]float32, NumPixels)
+	tiny[0] = 1e-9
+	stroke := make([]float32, NumPixels)
+	stroke[400] = 1
+	tests := []struct {
+		name      string
+		embedding []float32
+		metric    string
+		rejected  bool
+	}{
+		{"zero L2", zero, metricL2, false},
+		{"zero COSINE", zero, metricCosine, true},
+		{"zero IP", zero, metricIP, true},
+		{"below the norm COSINE", tiny, metricCosine, true},
+		{"below the norm L2", tiny, metricL2, false},
+		{"stroke COSINE", stroke, metricCosine, false},
+		{"stroke IP", stroke, metricIP, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkQueryVector(test.embedding, test.metric)
+			if test.rejected != errors.Is(err, errZeroVector) {
+				t.Errorf("checkQueryVector under %s = %v, want rejected %t", test.metric, err, test.rejected)
+			}
+			if !test.rejected && err != nil {
+				t.Errorf("checkQueryVector under %s = %v, want nil", test.metric, err)
+			}
+		})
+	}
+}
+
+func TestKnnSearchRejectsZeroVectorUnsent(t *testing.T) {
+	for _, metric := range []string{metricCosine, metricIP} {
+		s := newSearcher(Config{Metric: metric}, Storage{})
+		// A nil client would panic if the query were sent
+		_, _, _, err := s.knnSearch(s.ctx, nil, "mnist_index", make([]float32, NumPixels), 1)
+		if !errors.Is(err, errZeroVector) {
+			t.Errorf("knnSearch under %s = %v, want %v", metric, err, errZeroVector)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// mixedRandom assigns every class to FLAT or HNSW at random with -mixed-index
+const mixedRandom = "random"
+
+// mixedIndexes are the throwaway indexes of MixedIndex by algorithm, each over its own prefix
+var mixedIndexes = map[string]string{
+	algorithmFlat: modeIndex("mnist_mixed_flat"),
+	algorithmHNSW: modeIndex("mnist_mixed_hnsw"),
+}
+
+// mixedPrefix returns the key prefix of the mixed index of an algorithm
+func mixedPrefix(algorithm string) string {
+	return "mixed:" + strings.ToLower(algorithm) + ":"
+}
+
+// parseMixedIndex parses -mixed-index, a comma separated list of label:ALGORITHM pairs
+// or mixedRandom, which returns a nil map
+func parseMixedIndex(text string) (map[int]string, error) {
+	if text == "" || text == mixedRandom {
+		return nil, nil
+	}
+	kinds := map[int]string{}
+	for _, pair := range strings.Split(text, ",") {
+		label, algorithm, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		n, err := strconv.Atoi(label)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid -mixed-index %q, expected label:FLAT or label:HNSW pairs or %s", text, mixedRandom)
+		}
+		algorithm = strings.ToUpper(algorithm)
+		if err := validAlgorithm(algorithm); err != nil {
+			return nil, fmt.Errorf("invalid -mixed-index %q: %w", text, err)
+		}
+		kinds[n] = algorithm
+	}
+	return kinds, nil
+}
+
+// mixedKinds returns the algorithm of every label of the training rows. Labels not
+// listed in -mixed-index use -algorithm, with mixedRandom each label gets FLAT or HNSW
+// drawn from -seed.
+func mixedKinds(cfg Config, train []labeledPixels) (map[int]string, error) {
+	listed, err := parseMixedIndex(cfg.MixedIndex)
+	if err != nil {
+		return nil, err
+	}
+	var labels []int
+	seen := map[int]bool{}
+	for _, row := range train {
+		if !seen[row.label] {
+			seen[row.label] = true
+			labels = append(labels, row.label)
+		}
+	}
+	sort.Ints(labels)
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	kinds := map[int]string{}
+	for _, label := range labels {
+		switch algorithm, ok := listed[label]; {
+		case cfg.MixedIndex == mixedRandom:
+			kinds[label] = []string{algorithmFlat, algorithmHNSW}[rng.Intn(2)]
+		case ok:
+			kinds[label] = algorithm
+		default:
+			kinds[label] = cfg.indexAlgorithm()
+		}
+	}
+	return kinds, nil
+}
+
+// mixedKindResult holds the test results of the classes stored in one algorithm
+type mixedKindResult struct {
+	labels    []int
+	docs      int
+	processed int
+	correct   int
+	durations *Stats
+}
+
+// MixedIndex stores every training class either in a FLAT or in an HNSW index, as
+// assigned by -mixed-index, classifies the test images by the k nearest neighbors
+// merged from the indexes searched with -mixed-search and prints the accuracy and
+// latency of the classes of each algorithm and combined. Both indexes are dropped with
+// their documents at the end.
+func MixedIndex(rdb *redis.Client, cfg Config) error {
+	trainRecords, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return err
+	}
+	testRecords, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	train, err := parseLabeledPixels(cfg, trainRecords)
+	if err != nil {
+		return err
+	}
+	test, err := parseLabeledPixels(cfg, testRecords)
+	if err != nil {
+		return err
+	}
+	kinds, err := mixedKinds(cfg, train)
+	if err != nil {
+		return err
+	}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	embedding := func(row labeledPixels) []float32 {
+		e := append([]float32(nil), row.pixels...)
+		if cfg.Normalize {
+			scalePixels(e)
+		}
+		return e
+	}
+
+	for kind, index := range mixedIndexes {
+		// It is fine if the index does not exist yet
+		rdb.Do(ctx, "FT.DROPINDEX", index, "DD")
+		defer rdb.Do(ctx, "FT.DROPINDEX", index, "DD")
+		kindCfg := cfg
+		kindCfg.Algorithm = kind
+		err := createIndex(rdb, kindCfg, index, mixedPrefix(kind))
+		if err != nil {
+			return fmt.Errorf("%s: %w", index, err)
+		}
+	}
+
+	results := map[string]*mixedKindResult{}
+	for _, kind := range []string{algorithmFlat, algorithmHNSW} {
+		results[kind] = &mixedKindResult{durations: &Stats{}}
+	}
+	for label, kind := range kinds {
+		results[kind].labels = append(results[kind].labels, label)
+	}
+
+	start := time.Now()
+	writer := newDocWriter(rdb, storage, cfg.LoadBatch, cfg.MaxInFlight)
+	for i, row := range train {
+		kind := kinds[row.label]
+		key := fmt.Sprintf("%s%d:%d", mixedPrefix(kind), i, row.label)
+		cmd, err := storage.setCommand(key, row.label, embedding(row))
+		if err != nil {
+			return err
+		}
+		err = writer.write(key, cmd)
+		if err != nil {
+			return err
+		}
+		results[kind].docs++
+	}
+	err = writer.close()
+	if err != nil {
+		return err
+	}
+	for _, index := range mixedIndexes {
+		_, err := waitForIndexing(rdb, index)
+		if err != nil {
+			return err
+		}
+	}
+	load := time.Since(start)
+
+	// Only the indexes holding documents are searched, an empty one finds nothing
+	var searched []string
+	for _, kind := range []string{algorithmFlat, algorithmHNSW} {
+		if results[kind].docs > 0 && (cfg.MixedSearch == "" || cfg.MixedSearch == "both" || strings.EqualFold(cfg.MixedSearch, kind)) {
+			searched = append(searched, kind)
+		}
+	}
+	if len(searched) == 0 {
+		return fmt.Errorf("-mixed-search %s selects no index holding documents", cfg.MixedSearch)
+	}
+
+	k := max(cfg.K, 1)
+	v := newVoter(cfg.TieBreak, cfg.Seed)
+	s := newSearcher(cfg, storage)
+	combined := &mixedKindResult{durations: &Stats{}}
+	evalStart := time.Now()
+	for _, row := range test {
+		if cfg.MaxTestDuration > 0 && time.Since(evalStart) >= cfg.MaxTestDuration {
+			break
+		}
+		query := embedding(row)
+		var neighbors []SearchResult
+		var duration int64
+		for _, kind := range searched {
+			found, _, elapsed, err := s.searchIndex(rdb, mixedIndexes[kind], query, k)
+			if err != nil && !errors.Is(err, errNoNeighbors) {
+				return err
+			}
+			neighbors = append(neighbors, found...)
+			duration += elapsed
+		}
+		if len(neighbors) == 0 {
+			return errNoNeighbors
+		}
+		sort.SliceStable(neighbors, func(a, b int) bool { return neighbors[a].Distance < neighbors[b].Distance })
+		neighbors = neighbors[:min(k, len(neighbors))]
+
+		// A test label missing from the training set is only counted in the total
+		kind, ok := kinds[row.label]
+		for _, r := range []*mixedKindResult{combined, results[kind]} {
+			if r == results[kind] && !ok {
+				continue
+			}
+			r.processed++
+			r.durations.Record(duration)
+			if v.vote(neighbors) == row.label {
+				r.correct++
+			}
+		}
+	}
+	if combined.processed == 0 {
+		return fmt.Errorf("no test images were evaluated")
+	}
+
+	fmt.Printf("Mixed index over %d training and %d test images, metric = %s, k = %d, searching %s, loaded in %s\n",
+		len(train), combined.processed, cfg.distanceMetric(), k, strings.Join(searched, " and "), load.Round(time.Millisecond))
+	fmt.Printf("%-10s %-22s %8s %8s %10s %10s %10s\n", "Algorithm", "Classes", "Docs", "Tests", "Accuracy", "Avg Query", "P95 Query")
+	rows := []struct {
+		name string
+		r    *mixedKindResult
+	}{{algorithmFlat, results[algorithmFlat]}, {algorithmHNSW, results[algorithmHNSW]}, {"combined", combined}}
+	for _, row := range rows {
+		labels := make([]string, len(row.r.labels))
+		sort.Ints(row.r.labels)
+		for i, label := range row.r.labels {
+			labels[i] = strconv.Itoa(label)
+		}
+		if row.r == combined {
+			row.r.docs = len(train)
+			labels = []string{"all"}
+		}
+		if row.r.processed == 0 {
+			fmt.Printf("%-10s %-22s %8d %8d %10s %10s %10s\n", row.name, strings.Join(labels, ","), row.r.docs, 0, "-", "-", "-")
+			continue
+		}
+		fmt.Printf("%-10s %-22s %8d %8d %9.2f%% %8dms %8dms\n", row.name, strings.Join(labels, ","), row.r.docs, row.r.processed,
+			100*float64(row.r.correct)/float64(row.r.processed), row.r.durations.Average(), row.r.durations.Percentile(95))
+	}
+	return nil
+}
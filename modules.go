@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// loadedModules returns the lower case names of the modules reported by MODULE LIST.
+// Servers that refuse MODULE LIST are asked with COMMAND INFO whether the commands of
+// RediSearch and RedisJSON exist.
+func loadedModules(rdb *redis.Client) (map[string]bool, error) {
+	modules := map[string]bool{}
+	reply, err := rdb.Do(ctx, "MODULE", "LIST").Slice()
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			return nil, err
+		}
+		modules["search"] = supportsCommand(rdb, "FT.SEARCH")
+		modules["rejson"] = supportsCommand(rdb, "JSON.SET")
+		return modules, nil
+	}
+
+	// Every module is a list of name, value pairs, or a map with RESP3
+	for _, entry := range reply {
+		fields, _ := replyMap(entry)
+		if name := replyString(fields["name"]); name != "" {
+			modules[strings.ToLower(name)] = true
+		}
+	}
+	return modules, nil
+}
+
+// checkModules makes sure the modules needed by this run are loaded before anything is
+// stored. RediSearch is required. Without RedisJSON the JSON storage of cfg falls back
+// to hashes.
+func checkModules(rdb *redis.Client, cfg *Config) error {
+	modules, err := loadedModules(rdb)
+	if err != nil {
+		return err
+	}
+	if !modules["search"] {
+		return fmt.Errorf("the RediSearch module is not loaded, run Redis Stack (redis/redis-stack) or load redisearch.so")
+	}
+	if cfg.Storage == storageJSON && !modules["rejson"] {
+		slog.Warn("The RedisJSON module is not loaded, storing the training images as hashes. Load rejson.so to store JSON documents.")
+		cfg.Storage = storageHash
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// NeighborDocument is the stored document of a neighbor, fetched to explain a prediction
+type NeighborDocument struct {
+	Key       string    `json:"key"`
+	Label     int       `json:"label"`
+	Embedding []float32 `json:"embedding"`
+	// Pixels are the 0-255 pixels written with -store-pixels, nil without them.
+	Pixels []float32 `json:"pixels,omitempty"`
+}
+
+// storedJSONDocument is a whole JSON document as returned by JSON.GET key $
+type storedJSONDocument struct {
+	Result    int       `json:"result"`
+	Embedding []float32 `json:"embedding"`
+	Pixels    string    `json:"pixels"`
+}
+
+// fetchNeighborDocuments reads the documents of keys, stored as storage, with one
+// pipelined JSON.GET or HGETALL per key in a single round trip. The documents are
+// returned in the order of keys, a key that no longer exists is an error.
+func fetchNeighborDocuments(ctx context.Context, rdb *redis.Client, storage Storage, keys []string) ([]NeighborDocument, error) {
+	pipe := rdb.Pipeline()
+	jsonCmds := make([]*redis.Cmd, len(keys))
+	hashCmds := make([]*redis.MapStringStringCmd, len(keys))
+	for i, key := range keys {
+		if storage.Mode == storageHash {
+			hashCmds[i] = pipe.HGetAll(ctx, key)
+		} else {
+			jsonCmds[i] = pipe.Do(ctx, "JSON.GET", key, "$")
+		}
+	}
+	// Per command errors are checked below
+	pipe.Exec(ctx)
+
+	docs := make([]NeighborDocument, len(keys))
+	for i, key := range keys {
+		doc, err := decodeNeighborDocument(storage, key, jsonCmds[i], hashCmds[i])
+		if err != nil {
+			return nil, fmt.Errorf("neighbor %s: %w", key, err)
+		}
+		docs[i] = doc
+	}
+	return docs, nil
+}
+
+// decodeNeighborDocument decodes the reply of the command fetching one document
+func decodeNeighborDocument(storage Storage, key string, jsonCmd *redis.Cmd, hashCmd *redis.MapStringStringCmd) (NeighborDocument, error) {
+	doc := NeighborDocument{Key: key}
+	var encodedPixels string
+	if storage.Mode == storageHash {
+		fields, err := hashCmd.Result()
+		if err != nil {
+			return doc, err
+		}
+		if len(fields) == 0 {
+			return doc, fmt.Errorf("no longer exists")
+		}
+		doc.Embedding, err = storage.decodeVectorBlob([]byte(fields["embedding"]))
+		if err != nil {
+			return doc, err
+		}
+		doc.Label, err = storage.decodeLabel(fields["result"])
+		if err != nil {
+			return doc, err
+		}
+		encodedPixels = fields["pixels"]
+	} else {
+		reply, err := jsonCmd.Text()
+		if err == redis.Nil {
+			return doc, fmt.Errorf("no longer exists")
+		}
+		if err != nil {
+			return doc, err
+		}
+		var matches []storedJSONDocument
+		if err := json.Unmarshal([]byte(reply), &matches); err != nil {
+			return doc, err
+		}
+		if len(matches) == 0 {
+			return doc, fmt.Errorf("no document")
+		}
+		doc.Label, doc.Embedding, encodedPixels = matches[0].Result, matches[0].Embedding, matches[0].Pixels
+	}
+
+	if encodedPixels != "" {
+		var err error
+		doc.Pixels, err = decodePixels(encodedPixels)
+		if err != nil {
+			return doc, err
+		}
+	}
+	return doc, nil
+}
+
+// neighborKeysOf returns the keys of the neighbors
+func neighborKeysOf(neighbors []SearchResult) []string {
+	keys := make([]string, len(neighbors))
+	for i, neighbor := range neighbors {
+		keys[i] = neighbor.Key
+	}
+	return keys
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+)
+
+// Noise kinds selectable with -noise
+const (
+	// noiseGaussian adds normal noise with a standard deviation of the level to every pixel.
+	noiseGaussian = "gaussian"
+	// noiseSaltPepper sets a share of the level of the pixels to black or white.
+	noiseSaltPepper = "sp"
+)
+
+// pixelNoise degrades the test images before they are queried. The level is relative to
+// the full pixel range, 1 for normalized and 255 for raw pixels, so the same level
+// means the same degradation with -no-normalize.
+type pixelNoise struct {
+	kind  string
+	level float64
+	// white is the value of a white pixel
+	white float64
+	seed  int64
+}
+
+// validNoise checks -noise and the -noise-level values
+func validNoise(kind string, levels []float64) error {
+	if kind == "" {
+		if len(levels) > 0 {
+			return fmt.Errorf("-noise-level needs -noise gaussian or sp")
+		}
+		return nil
+	}
+	if kind != noiseGaussian && kind != noiseSaltPepper {
+		return fmt.Errorf("unknown -noise %q, expected %s or %s", kind, noiseGaussian, noiseSaltPepper)
+	}
+	if len(levels) == 0 {
+		return fmt.Errorf("-noise %s needs -noise-level", kind)
+	}
+	for _, level := range levels {
+		if level < 0 || (kind == noiseSaltPepper && level > 1) {
+			return fmt.Errorf("invalid -noise-level %g for -noise %s", level, kind)
+		}
+	}
+	return nil
+}
+
+// newPixelNoise returns the noise of the run, nil without -noise or with several
+// levels, which SearchData evaluates one by one
+func newPixelNoise(cfg Config) *pixelNoise {
+	if cfg.Noise == "" || len(cfg.NoiseLevels) != 1 {
+		return nil
+	}
+	white := 255.0
+	if cfg.Normalize {
+		white = 1
+	}
+	return &pixelNoise{kind: cfg.Noise, level: cfg.NoiseLevels[0], white: white, seed: cfg.Seed}
+}
+
+// apply adds the noise to the embedding of test image i. Every image draws from its own
+// generator seeded with the seed and i, so the noise does not depend on -workers or
+// -batch. A nil noise keeps the embedding as it is.
+func (n *pixelNoise) apply(embedding []float32, i int) {
+	if n == nil || n.level == 0 {
+		return
+	}
+	rng := rand.New(rand.NewSource(n.seed + int64(i)))
+	for p := range embedding {
+		switch n.kind {
+		case noiseGaussian:
+			v := float64(embedding[p]) + rng.NormFloat64()*n.level*n.white
+			embedding[p] = float32(min(max(v, 0), n.white))
+		case noiseSaltPepper:
+			if rng.Float64() < n.level {
+				embedding[p] = 0
+				if rng.Intn(2) == 1 {
+					embedding[p] = float32(n.white)
+				}
+			}
+		}
+	}
+}
+
+// evaluateNoiseLevels evaluates the test records once per -noise-level and prints the
+// accuracy at each level. Every level is appended to the -history-file with its own
+// settings. It returns the accuracy of the worst level.
+func evaluateNoiseLevels(cfg Config, c *Classifier, records [][]string) (float64, error) {
+	levels := cfg.NoiseLevels
+	accuracy := make([]float64, len(levels))
+	for i, level := range levels {
+		cfg.NoiseLevels = []float64{level}
+		c.noise = newPixelNoise(cfg)
+		fmt.Printf("Noise %s at level %g\n", cfg.Noise, level)
+		summary, err := c.Evaluate(records, nil)
+		if err != nil {
+			return 0, fmt.Errorf("noise level %g: %w", level, err)
+		}
+		if cfg.HistoryFile != "" {
+			err = appendHistory(cfg.HistoryFile, cfg, summary)
+			if err != nil {
+				return 0, err
+			}
+		}
+		accuracy[i] = summary.accuracy()
+	}
+
+	fmt.Printf("Accuracy under %s noise, seed %d\n", cfg.Noise, cfg.Seed)
+	fmt.Printf("%-12s %10s\n", "Noise Level", "Accuracy")
+	for i, level := range levels {
+		fmt.Printf("%-12g %9.2f%%\n", level, accuracy[i])
+	}
+	return slices.Min(accuracy), nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// normalization turns the 0-255 pixels of an image into the embedding that is indexed
+type normalization struct {
+	name  string
+	apply func(pixels []float32) []float32
+}
+
+// labeledPixels is a CSV row parsed once, kept as raw pixels so every normalization
+// can derive its embeddings from it
+type labeledPixels struct {
+	label  int
+	pixels []float32
+}
+
+// parseLabeledPixels parses the label and the raw pixels of every record read with cfg
+func parseLabeledPixels(cfg Config, records [][]string) ([]labeledPixels, error) {
+	rows := make([]labeledPixels, len(records))
+	for i, record := range records {
+		label, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, err
+		}
+		pixels, err := cfg.parseRawPixels(record[1:])
+		if err != nil {
+			return nil, err
+		}
+		rows[i] = labeledPixels{label: label, pixels: pixels}
+	}
+	return rows, nil
+}
+
+// normalizations returns the strategies compared by CompareNormalization. The
+// standardization is fitted on the training rows: every pixel is shifted by its mean and
+// divided by its standard deviation, constant pixels such as the borders are only shifted.
+func normalizations(train []labeledPixels) []normalization {
+	mean := make([]float64, NumPixels)
+	std := make([]float64, NumPixels)
+	for _, row := range train {
+		for i, v := range row.pixels {
+			mean[i] += float64(v)
+		}
+	}
+	for i := range mean {
+		mean[i] /= float64(len(train))
+	}
+	for _, row := range train {
+		for i, v := range row.pixels {
+			d := float64(v) - mean[i]
+			std[i] += d * d
+		}
+	}
+	for i := range std {
+		std[i] = math.Sqrt(std[i] / float64(len(train)))
+		if std[i] == 0 {
+			std[i] = 1
+		}
+	}
+
+	return []normalization{
+		{"none", func(pixels []float32) []float32 {
+			return append([]float32(nil), pixels...)
+		}},
+		{"scale", func(pixels []float32) []float32 {
+			embedding := append([]float32(nil), pixels...)
+			scalePixels(embedding)
+			return embedding
+		}},
+		{"standardize", func(pixels []float32) []float32 {
+			embedding := make([]float32, len(pixels))
+			for i, v := range pixels {
+				embedding[i] = float32((float64(v) - mean[i]) / std[i])
+			}
+			return embedding
+		}},
+	}
+}
+
+// normalizationRun holds the measurements of one normalization in CompareNormalization
+type normalizationRun struct {
+	name      string
+	load      time.Duration
+	durations *Stats
+	correct   int
+	processed int
+}
+
+// CompareNormalization indexes the training images as raw pixels, scaled by 1/255 and
+// standardized, and with -pixel-weights weighted on top of -normalize, each under its
+// own mnist_normalize_<name> index over normalize:<name>: keys, classifies the test images against each and prints the accuracy with the metric
+// of this run side by side. The CSV files are read once. The indexes are dropped with
+// their documents at the end.
+func CompareNormalization(rdb *redis.Client, cfg Config) error {
+	trainRecords, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return err
+	}
+	testRecords, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	train, err := parseLabeledPixels(cfg, trainRecords)
+	if err != nil {
+		return err
+	}
+	test, err := parseLabeledPixels(cfg, testRecords)
+	if err != nil {
+		return err
+	}
+	if len(train) == 0 {
+		return fmt.Errorf("%s has no training images", cfg.TrainFile)
+	}
+
+	strategies := normalizations(train)
+	if cfg.PixelWeights != "" {
+		weights, err := resolvePixelWeights(cfg, trainRecords)
+		if err != nil {
+			return err
+		}
+		strategies = append(strategies, normalization{"weighted", func(pixels []float32) []float32 {
+			embedding := append([]float32(nil), pixels...)
+			if cfg.Normalize {
+				scalePixels(embedding)
+			}
+			weights.apply(embedding)
+			return embedding
+		}})
+	}
+
+	var runs []normalizationRun
+	for _, n := range strategies {
+		run, err := compareNormalizationRun(rdb, cfg, n, train, test)
+		if err != nil {
+			return fmt.Errorf("%s: %w", n.name, err)
+		}
+		runs = append(runs, run)
+	}
+
+	fmt.Printf("Normalization comparison over %d training and %d test images, metric = %s, k = %d\n", len(train), runs[0].processed, cfg.distanceMetric(), max(cfg.K, 1))
+	fmt.Printf("%-12s %12s %12s %12s %10s\n", "Strategy", "Load", "Avg Query", "P95 Query", "Accuracy")
+	for _, run := range runs {
+		fmt.Printf("%-12s %12s %10dms %10dms %9.2f%%\n",
+			run.name, run.load.Round(time.Millisecond), run.durations.Average(), run.durations.Percentile(95),
+			100*float64(run.correct)/float64(run.processed))
+	}
+	return nil
+}
+
+// normalizeIndexes are the throwaway indexes of CompareNormalization by normalization name
+var normalizeIndexes = map[string]string{
+	"none":        modeIndex("mnist_normalize_none"),
+	"scale":       modeIndex("mnist_normalize_scale"),
+	"standardize": modeIndex("mnist_normalize_standardize"),
+	"weighted":    modeIndex("mnist_normalize_weighted"),
+}
+
+// compareNormalizationRun loads and evaluates the data with one normalization
+func compareNormalizationRun(rdb *redis.Client, cfg Config, n normalization, train, test []labeledPixels) (normalizationRun, error) {
+	run := normalizationRun{name: n.name, durations: &Stats{}}
+	index := normalizeIndexes[n.name]
+	prefix := "normalize:" + n.name + ":"
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return run, err
+	}
+
+	// It is fine if the index does not exist yet
+	rdb.Do(ctx, "FT.DROPINDEX", index, "DD")
+	defer rdb.Do(ctx, "FT.DROPINDEX", index, "DD")
+	err = createIndex(rdb, cfg, index, prefix)
+	if err != nil {
+		return run, err
+	}
+
+	start := time.Now()
+	writer := newDocWriter(rdb, storage, cfg.LoadBatch, cfg.MaxInFlight)
+	for i, row := range train {
+		key := fmt.Sprintf("%s%d:%d", prefix, i, row.label)
+		cmd, err := storage.setCommand(key, row.label, n.apply(row.pixels))
+		if err != nil {
+			return run, err
+		}
+		err = writer.write(key, cmd)
+		if err != nil {
+			return run, err
+		}
+	}
+	err = writer.close()
+	if err != nil {
+		return run, err
+	}
+	_, err = waitForIndexing(rdb, index)
+	if err != nil {
+		return run, err
+	}
+	run.load = time.Since(start)
+
+	k := max(cfg.K, 1)
+	v := newVoter(cfg.TieBreak, cfg.Seed)
+	s := newSearcher(cfg, storage)
+	evalStart := time.Now()
+	for _, row := range test {
+		if cfg.MaxTestDuration > 0 && time.Since(evalStart) >= cfg.MaxTestDuration {
+			break
+		}
+		neighbors, _, duration, err := s.searchIndex(rdb, index, n.apply(row.pixels), k)
+		if err != nil {
+			return run, err
+		}
+		run.durations.Record(duration)
+		run.processed++
+		if v.vote(neighbors) == row.label {
+			run.correct++
+		}
+	}
+	if run.processed == 0 {
+		return run, fmt.Errorf("no test images were evaluated")
+	}
+	return run, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// evaluatePasses evaluates the test records passes times with the same classifier and
+// prints the accuracy and latency of every pass, then their mean and standard
+// deviation. The accuracy of an exact FLAT index should not move between passes, a
+// spread under HNSW shows how stable its approximate neighbors are. Every pass is
+// appended to the -history-file as a run of its own. It returns the mean accuracy.
+func evaluatePasses(c *Classifier, records [][]string, passes int) (float64, error) {
+	accuracy := make([]float64, passes)
+	average := make([]float64, passes)
+	p95 := make([]float64, passes)
+	for p := 0; p < passes; p++ {
+		fmt.Printf("Pass %d of %d\n", p+1, passes)
+		summary, err := c.Evaluate(records, nil)
+		if err != nil {
+			return 0, fmt.Errorf("pass %d: %w", p+1, err)
+		}
+		if c.cfg.HistoryFile != "" {
+			err = appendHistory(c.cfg.HistoryFile, c.cfg, summary)
+			if err != nil {
+				return 0, err
+			}
+		}
+		accuracy[p] = summary.accuracy()
+		average[p] = float64(summary.durations.Average())
+		p95[p] = float64(summary.durations.Percentile(95))
+	}
+
+	fmt.Printf("%-8s %10s %12s %12s\n", "Pass", "Accuracy", "Avg Query", "P95 Query")
+	for p := 0; p < passes; p++ {
+		fmt.Printf("%-8d %9.2f%% %10.0fms %10.0fms\n", p+1, accuracy[p], average[p], p95[p])
+	}
+	accMean, accStd := meanStddev(accuracy)
+	avgMean, avgStd := meanStddev(average)
+	p95Mean, p95Std := meanStddev(p95)
+	fmt.Printf("%-8s %9.2f%% %10.1fms %10.1fms\n", "mean", accMean, avgMean, p95Mean)
+	fmt.Printf("%-8s %9.2f%% %10.1fms %10.1fms\n", "stddev", accStd, avgStd, p95Std)
+	return accMean, nil
+}
+
+// meanStddev returns the mean and the population standard deviation of values
+func meanStddev(values []float64) (float64, float64) {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// redisPassword returns the password of the Redis connection. It is taken from
+// -password, the first line of -password-file or REDIS_PASSWORD, in that order. Without
+// any of them it is prompted for without echo when stdin is a terminal that is not read
+// for the CSV data, and left empty otherwise.
+func redisPassword(cfg Config) (string, error) {
+	if cfg.Password != "" {
+		return cfg.Password, nil
+	}
+	if cfg.PasswordFile != "" {
+		data, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		password, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSuffix(password, "\r"), nil
+	}
+	if password, ok := os.LookupEnv("REDIS_PASSWORD"); ok {
+		return password, nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if cfg.TrainFile == "-" || cfg.TestFile == "-" || !term.IsTerminal(stdin) {
+		return "", nil
+	}
+	fmt.Fprint(os.Stderr, "Redis password (empty for none): ")
+	password, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// PCA projects embeddings onto their top principal components
+type PCA struct {
+	Mean       []float64
+	Components [][]float64
+}
+
+// FitPCA computes the mean and the top n principal components of the samples. The
+// components are the leading eigenvectors of the covariance matrix, found by power
+// iteration with every new vector kept orthogonal to the previous ones.
+func FitPCA(samples [][]float32, n int) (*PCA, error) {
+	if len(samples) == 0 {
+		return nil, errors.New("no samples to fit the PCA on")
+	}
+	dim := len(samples[0])
+	if n > dim {
+		n = dim
+	}
+
+	mean := make([]float64, dim)
+	for _, sample := range samples {
+		for j, v := range sample {
+			mean[j] += float64(v)
+		}
+	}
+	for j := range mean {
+		mean[j] /= float64(len(samples))
+	}
+
+	// Only the upper triangle is accumulated, the matrix is mirrored afterwards
+	cov := make([][]float64, dim)
+	for j := range cov {
+		cov[j] = make([]float64, dim)
+	}
+	centered := make([]float64, dim)
+	for _, sample := range samples {
+		for j, v := range sample {
+			centered[j] = float64(v) - mean[j]
+		}
+		for a := 0; a < dim; a++ {
+			if centered[a] == 0 {
+				continue
+			}
+			row := cov[a]
+			for b := a; b < dim; b++ {
+				row[b] += centered[a] * centered[b]
+			}
+		}
+	}
+	for a := 0; a < dim; a++ {
+		for b := a; b < dim; b++ {
+			cov[a][b] /= float64(len(samples))
+			cov[b][a] = cov[a][b]
+		}
+	}
+
+	components := make([][]float64, 0, n)
+	for c := 0; c < n; c++ {
+		v := make([]float64, dim)
+		for j := range v {
+			v[j] = 1 / math.Sqrt(float64(dim)+float64(j))
+		}
+		for iter := 0; iter < 200; iter++ {
+			next := make([]float64, dim)
+			for a := 0; a < dim; a++ {
+				var sum float64
+				for b, x := range cov[a] {
+					sum += x * v[b]
+				}
+				next[a] = sum
+			}
+			for _, prev := range components {
+				d := dot(next, prev)
+				for j := range next {
+					next[j] -= d * prev[j]
+				}
+			}
+			norm := math.Sqrt(dot(next, next))
+			if norm == 0 {
+				break
+			}
+			for j := range next {
+				next[j] /= norm
+			}
+			converged := math.Abs(math.Abs(dot(next, v))-1) < 1e-9
+			v = next
+			if converged {
+				break
+			}
+		}
+		components = append(components, v)
+	}
+
+	return &PCA{Mean: mean, Components: components}, nil
+}
+
+// Transform reduces an embedding to its coordinates along the principal components
+func (p *PCA) Transform(embedding []float32) []float32 {
+	reduced := make([]float32, len(p.Components))
+	for c, component := range p.Components {
+		var sum float64
+		for j, v := range embedding {
+			sum += (float64(v) - p.Mean[j]) * component[j]
+		}
+		reduced[c] = float32(sum)
+	}
+	return reduced
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ImageSize is the width and height of an MNIST image
+const ImageSize = 28
+
+// NumPixels is the number of pixels of an MNIST image and the dimension of its embedding
+const NumPixels = ImageSize * ImageSize
+
+// NormalizePixels validates the 784 grayscale values of an image and scales them from
+// 0-255 to 0-1, the same way StoreData and SearchData build embeddings
+func NormalizePixels(pixels []int) ([]float32, error) {
+	if len(pixels) != NumPixels {
+		return nil, fmt.Errorf("expected %d pixels, got %d", NumPixels, len(pixels))
+	}
+	embedding := make([]float32, NumPixels)
+	for i, pixel := range pixels {
+		if pixel < 0 || pixel > 255 {
+			return nil, fmt.Errorf("pixel %d out of range 0-255: %d", i, pixel)
+		}
+		embedding[i] = float32(pixel) / 255.0
+	}
+	return embedding, nil
+}
+
+// ReshapeToGrid lays out an embedding as rows of the 28x28 image. Missing values are
+// left at zero and extra values are ignored.
+func ReshapeToGrid(embedding []float32) [ImageSize][ImageSize]float32 {
+	var grid [ImageSize][ImageSize]float32
+	for i, v := range embedding {
+		if i >= NumPixels {
+			break
+		}
+		grid[i/ImageSize][i%ImageSize] = v
+	}
+	return grid
+}
+
+// RenderASCII draws a grid as text, one line per row, using darker characters for
+// brighter pixels. Values are expected in 0-1, raw 0-255 values are scaled down.
+func RenderASCII(grid [ImageSize][ImageSize]float32) string {
+	scale := float32(1)
+	for _, row := range grid {
+		for _, v := range row {
+			if v > 1 {
+				scale = 255
+			}
+		}
+	}
+
+	var sb strings.Builder
+	for _, row := range grid {
+		for _, v := range row {
+			v /= scale
+			switch {
+			case v >= 0.75:
+				sb.WriteString("@@")
+			case v >= 0.5:
+				sb.WriteString("##")
+			case v >= 0.25:
+				sb.WriteString("++")
+			case v > 0:
+				sb.WriteString("..")
+			default:
+				sb.WriteString("  ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// uniformPixels returns NumPixels copies of value
+func uniformPixels(value int) []int {
+	pixels := make([]int, NumPixels)
+	for i := range pixels {
+		pixels[i] = value
+	}
+	return pixels
+}
+
+func TestNormalizePixels(t *testing.T) {
+	ramp := make([]int, NumPixels)
+	for i := range ramp {
+		ramp[i] = i % 256
+	}
+	outOfRange := uniformPixels(0)
+	outOfRange[10] = 256
+	negative := uniformPixels(0)
+	negative[783] = -1
+
+	tests := []struct {
+		name   string
+		pixels []int
+		err    string
+	}{
+		{"ramp", ramp, ""},
+		{"black", uniformPixels(0), ""},
+		{"white", uniformPixels(255), ""},
+		{"too few", make([]int, NumPixels-1), "expected 784 pixels, got 783"},
+		{"too many", make([]int, NumPixels+1), "expected 784 pixels, got 785"},
+		{"empty", nil, "expected 784 pixels, got 0"},
+		{"above 255", outOfRange, "pixel 10 out of range 0-255: 256"},
+		{"negative", negative, "pixel 783 out of range 0-255: -1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			embedding, err := NormalizePixels(test.pixels)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("NormalizePixels error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, v := range embedding {
+				if v < 0 || v > 1 || v != float32(test.pixels[i])/255 {
+					t.Fatalf("value %d = %g, want %d/255 in [0,1]", i, v, test.pixels[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePixelsNonNumeric(t *testing.T) {
+	for _, pixelType := range []string{pixelInt, pixelFloat} {
+		values := make([]string, NumPixels)
+		for i := range values {
+			values[i] = "0"
+		}
+		values[42] = "x7"
+		cfg := Config{Normalize: true, PixelType: pixelType}
+		_, err := cfg.parsePixels(values)
+		if err == nil || !strings.Contains(err.Error(), "x7") {
+			t.Errorf("parsePixels with -pixel-type %s error = %v, want one naming x7", pixelType, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Pixel encodings of the CSV files selectable with -pixel-type
+const (
+	// pixelInt reads the pixels as integers in 0-255, the MNIST CSV layout.
+	pixelInt = "int"
+	// pixelFloat reads the pixels as floats already normalized to [0,1].
+	pixelFloat = "float"
+	// pixelAuto picks float when a pixel of the first rows is not an integer
+	pixelAuto = "auto"
+)
+
+// validPixelType checks the value of -pixel-type
+func validPixelType(t string) error {
+	switch t {
+	case pixelInt, pixelFloat, pixelAuto:
+		return nil
+	}
+	return fmt.Errorf("invalid -pixel-type %q, expected int, float or auto", t)
+}
+
+// floatPixels reports whether the pixels are read as floats in [0,1]
+func (cfg *Config) floatPixels() bool {
+	if cfg.PixelType == pixelAuto {
+		return cfg.detectedPixelType == pixelFloat
+	}
+	return cfg.PixelType == pixelFloat
+}
+
+// checkPixelType resolves -pixel-type auto from the first rows of the CSV at path and
+// checks their range, so normalized floats are not divided by 255 a second time and
+// 0-255 values are not taken for normalized ones
+func (cfg *Config) checkPixelType(path string, records [][]string) error {
+	sample := records[:min(len(records), labelSample)]
+	integers, largest := true, 0.0
+	for _, record := range sample {
+		for _, pixel := range record[1:] {
+			if integers && strings.ContainsAny(pixel, ".eE") {
+				integers = false
+			}
+			if v, err := strconv.ParseFloat(pixel, 64); err == nil {
+				largest = math.Max(largest, v)
+			}
+		}
+	}
+
+	if cfg.PixelType == pixelAuto {
+		detected := pixelInt
+		if !integers {
+			detected = pixelFloat
+		}
+		if cfg.detectedPixelType != "" && detected != cfg.detectedPixelType {
+			return fmt.Errorf("%s: the pixels look like %s values, the CSV read before had %s ones, set -pixel-type", path, detected, cfg.detectedPixelType)
+		}
+		cfg.detectedPixelType = detected
+		slog.Info("Pixel type.", slog.String("file", path), slog.String("pixel type", detected), slog.String("selected by", "-pixel-type auto"))
+	}
+	switch {
+	case !cfg.floatPixels() && !integers:
+		return fmt.Errorf("%s: the pixels are not integers, pass -pixel-type float for values in [0,1]", path)
+	case cfg.floatPixels() && largest > 1:
+		return fmt.Errorf("%s: a pixel is %g, -pixel-type float expects values in [0,1], the file looks like 0-255 values", path, largest)
+	case !cfg.floatPixels() && len(sample) > 0 && largest <= 1:
+		slog.Warn("Every pixel is 0 or 1. If they are normalized values, pass -pixel-type float.", slog.String("file", path))
+	}
+	return nil
+}
+
+// parseFloatPixels parses pixels given as floats and checks they are within [0,1]
+func parseFloatPixels(pixelValues []string) ([]float32, error) {
+	pixels := make([]float32, 0, len(pixelValues))
+	for _, pixel := range pixelValues {
+		v, err := strconv.ParseFloat(pixel, 32)
+		if err != nil {
+			return nil, err
+		}
+		if !(v >= 0 && v <= 1) {
+			return nil, fmt.Errorf("pixel %s is outside [0,1] of -pixel-type float", pixel)
+		}
+		pixels = append(pixels, float32(v))
+	}
+	return pixels, nil
+}
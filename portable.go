@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// portableFormat names the files written by ExportData in their header line
+const portableFormat = "redis-mnist-vectors/1"
+
+// portableHeader is the first line of an export. It records how the vectors were built
+// so an import can refuse queries that would not match them.
+type portableHeader struct {
+	Format      string `json:"format"`
+	Normalize   bool   `json:"normalize"`
+	Storage     string `json:"storage"`
+	Metric      string `json:"metric"`
+	KeyTemplate string `json:"key_template"`
+	// VectorType is the -vector-type of the exported embeddings. An export without one
+	// holds FLOAT32 vectors.
+	VectorType string `json:"vector_type,omitempty"`
+	// PixelWeights are the -pixel-weights the embeddings were weighted with, if any.
+	PixelWeights pixelWeights `json:"pixel_weights,omitempty"`
+}
+
+// portableDocument is one exported training document. encoding/json writes a float32
+// with the fewest digits that parse back to the same value, so the stored vectors
+// survive the round trip exactly.
+type portableDocument struct {
+	Key       string    `json:"key"`
+	Label     int       `json:"label"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// exportBatch is the number of documents read per pipeline by ExportData
+const exportBatch = 500
+
+// ExportData writes every stored training document with its key, label and embedding
+// to cfg.Export as JSON lines after a header line, in the order of their row index. The
+// file does not depend on the RDB format, the Redis version or -storage.
+func ExportData(rdb *redis.Client, cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	iter := rdb.Scan(ctx, 0, storage.Keys.scanPattern(), 1000).Iterator()
+	for iter.Next(ctx) {
+		if _, ok := storage.Keys.parse(iter.Val()); ok {
+			keys = append(keys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no %s keys found, store the training data first", storage.Keys.scanPattern())
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		i, _ := storage.Keys.parse(keys[a])
+		j, _ := storage.Keys.parse(keys[b])
+		return i < j
+	})
+
+	weights, err := storedPixelWeights(rdb)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(cfg.Export)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out := bufio.NewWriter(file)
+	encoder := json.NewEncoder(out)
+	err = encoder.Encode(portableHeader{Format: portableFormat, Normalize: cfg.Normalize, Storage: storage.Mode, Metric: cfg.distanceMetric(), KeyTemplate: storage.Keys.text, VectorType: storage.vectorType(), PixelWeights: weights})
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for first := 0; first < len(keys); first += exportBatch {
+		batch := keys[first:min(first+exportBatch, len(keys))]
+		pipe := rdb.Pipeline()
+		labels := make([]*redis.Cmd, len(batch))
+		embeddings := make([]*redis.Cmd, len(batch))
+		for n, key := range batch {
+			labels[n] = pipe.Do(ctx, storage.getLabelCommand(key)...)
+			embeddings[n] = pipe.Do(ctx, storage.getEmbeddingCommand(key)...)
+		}
+		// Per command errors are checked below
+		pipe.Exec(ctx)
+
+		for n, key := range batch {
+			doc := portableDocument{Key: key}
+			reply, err := labels[n].Text()
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			doc.Label, err = storage.decodeLabel(reply)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			reply, err = embeddings[n].Text()
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			doc.Embedding, err = storage.decodeEmbedding(reply)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			err = encoder.Encode(doc)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = out.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d documents to %s in %s\n", len(keys), cfg.Export, time.Since(start).Round(time.Millisecond))
+	return file.Close()
+}
+
+// ImportData stores the documents of a file written by ExportData under their exported
+// keys with the -storage of this run, and rebuilds the label counts, class means and
+// next row index of a load. The vectors are stored as exported, so the normalization
+// and key template of the run must match the header.
+func ImportData(rdb *redis.Client, cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(cfg.Import)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+
+	var header portableHeader
+	err = decoder.Decode(&header)
+	if err != nil {
+		return fmt.Errorf("%s: reading the header: %w", cfg.Import, err)
+	}
+	if header.Format != portableFormat {
+		return fmt.Errorf("%s is not an export of this tool, format %q", cfg.Import, header.Format)
+	}
+	if header.Normalize != cfg.Normalize {
+		return fmt.Errorf("%s was exported with normalize=%t but this run uses normalize=%t", cfg.Import, header.Normalize, cfg.Normalize)
+	}
+	if header.KeyTemplate != storage.Keys.text {
+		return fmt.Errorf("%s was exported with -key-template %s but this run uses -key-template %s", cfg.Import, header.KeyTemplate, storage.Keys.text)
+	}
+	if header.VectorType == "" {
+		header.VectorType = vectorFloat32
+	}
+	if header.VectorType != storage.vectorType() {
+		return fmt.Errorf("%s was exported with -vector-type %s but this run uses -vector-type %s", cfg.Import, header.VectorType, storage.vectorType())
+	}
+	if (header.PixelWeights == nil) != (cfg.PixelWeights == "") {
+		return fmt.Errorf("%s was exported with pixel weights %t but this run uses -pixel-weights %q", cfg.Import, header.PixelWeights != nil, cfg.PixelWeights)
+	}
+	// The exported embeddings are weighted already, the weights are only recorded
+	cfg.loadWeights = header.PixelWeights
+	if header.Metric != cfg.distanceMetric() {
+		slog.Warn("Importing vectors exported from an index with another metric.", slog.String("exported", header.Metric), slog.String("metric", cfg.distanceMetric()))
+	}
+
+	// The label counts and class means are rebuilt from the imported documents
+	err = rdb.Del(ctx, priorsKey).Err()
+	if err != nil {
+		return err
+	}
+	err = resetPrototypes(rdb, cfg)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	writer := newDocWriter(rdb, storage, cfg.LoadBatch, cfg.MaxInFlight)
+	labelCounts := map[int]int{}
+	centroids := newCentroidSums()
+	imported, next := 0, 0
+	for {
+		var doc portableDocument
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: document %d: %w", cfg.Import, imported, err)
+		}
+		i, ok := storage.Keys.parse(doc.Key)
+		if !ok {
+			return fmt.Errorf("%s: key %s does not match -key-template %s", cfg.Import, doc.Key, storage.Keys.text)
+		}
+		next = max(next, i+1)
+		cmd, err := storage.setCommand(doc.Key, doc.Label, doc.Embedding)
+		if err != nil {
+			return err
+		}
+		err = writer.write(doc.Key, cmd)
+		if err != nil {
+			return err
+		}
+		labelCounts[doc.Label]++
+		centroids.add(doc.Label, doc.Embedding)
+		imported++
+	}
+	err = writer.close()
+	if err != nil {
+		return err
+	}
+	transfer := time.Since(start)
+
+	// An -append load continues after the imported rows
+	err = rdb.Set(ctx, nextIndexKey, next, 0).Err()
+	if err != nil {
+		return err
+	}
+	err = updatePrototypes(rdb, cfg, centroids)
+	if err != nil {
+		return err
+	}
+	err = recordLabelCounts(rdb, labelCounts)
+	if err != nil {
+		return err
+	}
+	err = saveSettings(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	build, err := buildIndex(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	numDocs, err := indexNumDocs(rdb, "mnist_index")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d documents from %s in %s (%.1f docs/sec), Index Build = %s, index holds %d documents\n",
+		imported, cfg.Import, transfer.Round(time.Millisecond), float64(imported)/transfer.Seconds(), build.Round(time.Millisecond), numDocs)
+	return nil
+}
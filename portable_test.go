@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestPortableDocumentRoundTrip(t *testing.T) {
+	want := portableDocument{
+		Key:   "number:12:7",
+		Label: 7,
+		// Values without a short decimal form, the extremes and a negative zero
+		Embedding: []float32{0, 1, 255, 0.1, 1.0 / 3, float32(math.Pi), 1 / 2048.0, -0.75, math.SmallestNonzeroFloat32, math.MaxFloat32, float32(math.Copysign(0, -1))},
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	var got portableDocument
+	if err := json.NewDecoder(&buf).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != want.Key || got.Label != want.Label || len(got.Embedding) != len(want.Embedding) {
+		t.Fatalf("decoded %+v, want %+v", got, want)
+	}
+	for i := range want.Embedding {
+		if math.Float32bits(got.Embedding[i]) != math.Float32bits(want.Embedding[i]) {
+			t.Errorf("embedding[%d] = %v, want exactly %v", i, got.Embedding[i], want.Embedding[i])
+		}
+	}
+}
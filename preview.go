@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var previewIndex = modeIndex("mnist_preview_index")
+
+const (
+	previewPrefix = "preview:"
+	// previewFitRows is the number of training rows the preview PCA is fitted on
+	previewFitRows = 5000
+)
+
+// TwoStageSearch compares the single-stage KNN query on mnist_index with a two-stage
+// search: a KNN query on cfg.PreviewDim dimensional PCA previews of the training images
+// picks cfg.PreviewCandidates candidates, which are re-ranked by their exact distance
+// on the full stored embeddings. The previews are stored as preview:<i>:<label> next
+// to the number:<i>:<label> keys, the preview index is rebuilt on every run.
+func TwoStageSearch(rdb *redis.Client, cfg Config) error {
+	train, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return err
+	}
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	k := cfg.K
+	if k < 1 {
+		k = 1
+	}
+	if cfg.PreviewCandidates < k {
+		return fmt.Errorf("-preview-candidates %d is smaller than -k %d", cfg.PreviewCandidates, k)
+	}
+
+	// The projection only needs a sample, fitting it on every row is slow
+	var samples [][]float32
+	for _, record := range train[:min(previewFitRows, len(train))] {
+		embedding, err := cfg.parsePixels(record[1:])
+		if err != nil {
+			return err
+		}
+		samples = append(samples, embedding)
+	}
+	pca, err := FitPCA(samples, cfg.PreviewDim)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cfg.TrainFile, err)
+	}
+
+	// It is fine if the index does not exist yet
+	rdb.Do(ctx, "FT.DROPINDEX", previewIndex, "DD")
+	err = createVectorIndex(rdb, cfg, previewIndex, previewPrefix, len(pca.Components))
+	if err != nil {
+		return err
+	}
+	writer := newDocWriter(rdb, storage, cfg.LoadBatch, cfg.MaxInFlight)
+	for i, record := range train {
+		embedding, err := cfg.parsePixels(record[1:])
+		if err != nil {
+			return err
+		}
+		label, err := strconv.Atoi(record[0])
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s%d:%d", previewPrefix, i, label)
+		cmd, err := storage.setCommand(key, label, pca.Transform(embedding))
+		if err != nil {
+			return err
+		}
+		err = writer.write(key, cmd)
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.close()
+	if err != nil {
+		return err
+	}
+
+	var singleTime, twoStageTime time.Duration
+	var singleCorrect, twoStageCorrect, recalled, processed int
+	v := newVoter(cfg.TieBreak, cfg.Seed)
+	s := newSearcher(cfg, storage)
+	start := time.Now()
+	for _, record := range test {
+		if cfg.MaxTestDuration > 0 && time.Since(start) >= cfg.MaxTestDuration {
+			break
+		}
+		embedding, err := cfg.parsePixels(record[1:])
+		if err != nil {
+			return err
+		}
+		expected, err := strconv.Atoi(record[0])
+		if err != nil {
+			return err
+		}
+
+		queryStart := time.Now()
+		exact, _, _, err := s.searchNeighbors(rdb, embedding, k)
+		if err != nil {
+			return err
+		}
+		singleTime += time.Since(queryStart)
+
+		queryStart = time.Now()
+		reranked, err := s.twoStageNeighbors(rdb, pca, embedding, cfg.PreviewCandidates, k)
+		if err != nil {
+			return err
+		}
+		twoStageTime += time.Since(queryStart)
+
+		processed++
+		if v.vote(exact) == expected {
+			singleCorrect++
+		}
+		if v.vote(reranked) == expected {
+			twoStageCorrect++
+		}
+		recalled += overlap(exact, reranked)
+	}
+	if processed == 0 {
+		return fmt.Errorf("no test images were evaluated")
+	}
+
+	fmt.Printf("Two-stage search over %d test images, %d dimensional previews, %d candidates, k = %d\n", processed, len(pca.Components), cfg.PreviewCandidates, k)
+	fmt.Printf("Single-Stage Accuracy = %.2f%%, Average Duration = %.3fms\n", 100*float64(singleCorrect)/float64(processed), durationMs(singleTime)/float64(processed))
+	fmt.Printf("Two-Stage Accuracy = %.2f%%, Average Duration = %.3fms\n", 100*float64(twoStageCorrect)/float64(processed), durationMs(twoStageTime)/float64(processed))
+	fmt.Printf("Two-Stage Recall@%d = %.2f%%\n", k, 100*float64(recalled)/float64(processed*k))
+	return nil
+}
+
+// twoStageNeighbors finds candidates among the previews and returns the k of them
+// nearest to the full embedding
+func (s *searcher) twoStageNeighbors(rdb *redis.Client, pca *PCA, embedding []float32, candidates, k int) ([]SearchResult, error) {
+	previews, _, _, err := s.searchIndex(rdb, previewIndex, pca.Transform(embedding), candidates)
+	if err != nil {
+		return nil, err
+	}
+	// The norms are computed once per query, the stored ones are used with -store-norms
+	queryNorm := vectorNorm(embedding)
+
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.Cmd, len(previews))
+	normCmds := make([]*redis.Cmd, len(previews))
+	for i, preview := range previews {
+		// A preview document has the index of the training row it was projected from
+		idx, _, _ := strings.Cut(strings.TrimPrefix(preview.Key, previewPrefix), ":")
+		n, err := strconv.Atoi(idx)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected preview key %s", preview.Key)
+		}
+		previews[i].Key = s.storage.Keys.key(n, preview.Label)
+		cmds[i] = pipe.Do(ctx, s.storage.getEmbeddingCommand(previews[i].Key)...)
+		if s.storage.Norms {
+			normCmds[i] = pipe.Do(ctx, s.storage.getNormCommand(previews[i].Key)...)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		reply, err := cmd.Text()
+		if err != nil {
+			return nil, err
+		}
+		full, err := s.storage.decodeEmbedding(reply)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", previews[i].Key, err)
+		}
+		norm := 0.0
+		if normCmds[i] != nil {
+			reply, err := normCmds[i].Text()
+			if err == nil {
+				norm, err = s.storage.decodeNorm(reply)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("key %s has no norm: %w", previews[i].Key, err)
+			}
+		} else {
+			norm = vectorNorm(full)
+		}
+		previews[i].Norm = norm
+		previews[i].Distance = distanceWithNorms(embedding, full, queryNorm, norm, s.metric)
+	}
+
+	sort.SliceStable(previews, func(a, b int) bool { return previews[a].Distance < previews[b].Distance })
+	if len(previews) > k {
+		previews = previews[:k]
+	}
+	return s.reportedDistances(previews), nil
+}
+
+// distanceWithNorms computes the distance RediSearch reports for the metric from the
+// inner product and the known L2 norms of the two embeddings: the squared Euclidean
+// distance for L2, 1 - inner product for IP and 1 - cosine for COSINE
+func distanceWithNorms(a, b []float32, normA, normB float64, m string) float64 {
+	var dotAB float64
+	for i := range a {
+		dotAB += float64(a[i]) * float64(b[i])
+	}
+	switch m {
+	case metricIP:
+		return 1 - dotAB
+	case metricCosine:
+		if normA == 0 || normB == 0 {
+			return 1
+		}
+		return 1 - dotAB/(normA*normB)
+	}
+	// |a - b|^2 = |a|^2 + |b|^2 - 2 a.b, clamped against rounding
+	return math.Max(0, normA*normA+normB*normB-2*dotAB)
+}
+
+// overlap counts the keys of found that are also in expected
+func overlap(expected, found []SearchResult) int {
+	keys := map[string]bool{}
+	for _, neighbor := range expected {
+		keys[neighbor.Key] = true
+	}
+	n := 0
+	for _, neighbor := range found {
+		if keys[neighbor.Key] {
+			n++
+		}
+	}
+	return n
+}
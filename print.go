@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PrintCommands prints the FT.CREATE command of mnist_index with -print-create and the
+// KNN FT.SEARCH command of the first test image with -print-search, quoted for pasting
+// at the redis-cli prompt. Nothing is sent to Redis, so the commands show the options
+// as given: a -storage json run that falls back to hashes at startup prints ON JSON.
+func PrintCommands(cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.PrintCreate {
+		command, err := createIndexCommand(cfg, "mnist_index", storage.Keys.prefix, NumPixels)
+		if err != nil {
+			return err
+		}
+		fmt.Println(redisCLICommand(command))
+	}
+	if !cfg.PrintSearch {
+		return nil
+	}
+
+	records, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%s has no test images", cfg.TestFile)
+	}
+	embedding, err := cfg.parsePixels(records[0][1:])
+	if err != nil {
+		return err
+	}
+	query, err := buildKNNQuery(KNNQuery{Index: "mnist_index", K: max(cfg.K, 1), Storage: storage, Timeout: cfg.ServerTimeout, Blob: storage.vectorBlob(embedding)})
+	if err != nil {
+		return err
+	}
+	fmt.Println(redisCLICommand(query))
+	return nil
+}
+
+// DumpEmbedding prints the float32 embedding of test sample i exactly as a query would
+// send it, after the normalization, -mask, -noise and -pixel-weights, row by row with the shortest
+// text that parses back to the same float32, and with -dump-ascii its ASCII render.
+// Nothing is sent to Redis.
+func DumpEmbedding(cfg Config, i int) error {
+	records, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(records) {
+		return fmt.Errorf("-dump-embedding %d is out of range, %s has %d test images", i, cfg.TestFile, len(records))
+	}
+	embedding, err := cfg.parsePixels(records[i][1:])
+	if err != nil {
+		return err
+	}
+	mask, err := parseMask(cfg.Mask)
+	if err != nil {
+		return err
+	}
+	mask.apply(embedding)
+	newPixelNoise(cfg).apply(embedding, i)
+	// Only the variance weights need the training set
+	var train [][]string
+	if cfg.PixelWeights == pixelVariance {
+		train, err = cfg.readRecords(cfg.TrainFile)
+		if err != nil {
+			return err
+		}
+	}
+	weights, err := resolvePixelWeights(cfg, train)
+	if err != nil {
+		return err
+	}
+	weights.apply(embedding)
+
+	minimum, maximum, nonZero := embedding[0], embedding[0], 0
+	for _, v := range embedding {
+		minimum, maximum = min(minimum, v), max(maximum, v)
+		if v != 0 {
+			nonZero++
+		}
+	}
+	fmt.Printf("Test image %d: label = %s, normalize = %t, %d values, min = %g, max = %g, non-zero = %d, L2 norm = %g\n",
+		i, records[i][0], cfg.Normalize, len(embedding), minimum, maximum, nonZero, vectorNorm(embedding))
+	for row := 0; row < len(embedding); row += ImageSize {
+		values := make([]string, 0, ImageSize)
+		for _, v := range embedding[row:min(row+ImageSize, len(embedding))] {
+			values = append(values, strconv.FormatFloat(float64(v), 'g', -1, 32))
+		}
+		fmt.Println(strings.Join(values, " "))
+	}
+	if cfg.DumpASCII {
+		fmt.Print(RenderASCII(ReshapeToGrid(embedding)))
+	}
+	return nil
+}
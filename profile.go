@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// profileSampler repeats every this many KNN queries of a searcher under FT.PROFILE to
+// measure the time RediSearch spends on them, set from -profile-every. Zero disables
+// profiling.
+type profileSampler struct {
+	every int64
+	// count numbers the KNN queries considered for profiling
+	count atomic.Int64
+	// breakdown holds the profiled queries of the current evaluation
+	breakdown latencyBreakdown
+}
+
+// newProfileSampler returns a sampler profiling every this many queries
+func newProfileSampler(every int) *profileSampler {
+	return &profileSampler{every: int64(every)}
+}
+
+// sampled reports whether the next query is one to profile
+func (p *profileSampler) sampled() bool {
+	return p != nil && p.every > 0 && p.count.Add(1)%p.every == 0
+}
+
+// latencyBreakdown accumulates the client observed and the server reported time of the
+// profiled queries. The difference is spent in the network, in serialization and in
+// the client.
+type latencyBreakdown struct {
+	mu      sync.Mutex
+	samples int
+	client  time.Duration
+	server  time.Duration
+}
+
+// reset clears the samples
+func (b *latencyBreakdown) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples, b.client, b.server = 0, 0, 0
+}
+
+// add records one profiled query
+func (b *latencyBreakdown) add(client, server time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples++
+	b.client += client
+	b.server += server
+}
+
+// print writes the average client and server time of the profiled queries
+func (b *latencyBreakdown) print() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.samples == 0 {
+		return
+	}
+	client := b.client / time.Duration(b.samples)
+	server := b.server / time.Duration(b.samples)
+	fmt.Printf("Profiled Queries = %d\n", b.samples)
+	fmt.Printf("Profiled Client Duration = %.3fms\n", durationMs(client))
+	fmt.Printf("Profiled Server Duration = %.3fms\n", durationMs(server))
+	fmt.Printf("Profiled Network and Client Overhead = %.3fms\n", durationMs(client-server))
+}
+
+// durationMs converts a duration to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// profileCommand wraps an FT.SEARCH command built by buildKNNQuery into
+// FT.PROFILE <index> SEARCH QUERY <query> <arguments>
+func profileCommand(query []interface{}) []interface{} {
+	profile := []interface{}{"FT.PROFILE", query[1], "SEARCH", "QUERY"}
+	return append(profile, query[2:]...)
+}
+
+// sampleProfile runs query under FT.PROFILE when it is one of the sampled queries and
+// records its server time next to the client time the plain query took
+func (s *searcher) sampleProfile(ctx context.Context, rdb *redis.Client, query []interface{}, client time.Duration) {
+	if !s.profile.sampled() {
+		return
+	}
+	queryCtx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+	reply, err := rdb.Do(queryCtx, profileCommand(query)...).Result()
+	if err != nil {
+		return
+	}
+	server, ok := profileValue(reply, "Total profile time")
+	if !ok {
+		return
+	}
+	s.profile.breakdown.add(client, server)
+}
+
+// profileValue finds the time following the name anywhere in an FT.PROFILE reply.
+// RediSearch versions and protocols nest the profile differently, but every time is
+// reported in milliseconds right after its name.
+func profileValue(reply interface{}, name string) (time.Duration, bool) {
+	items, ok := replyList(reply).([]interface{})
+	if !ok {
+		return 0, false
+	}
+	for i, item := range items {
+		if s, _ := item.(string); s == name && i+1 < len(items) {
+			if ms, ok := profileMs(items[i+1]); ok {
+				return ms, true
+			}
+		}
+		if d, ok := profileValue(item, name); ok {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// profileMs converts a time of an FT.PROFILE reply given in milliseconds
+func profileMs(value interface{}) (time.Duration, bool) {
+	var ms float64
+	switch v := value.(type) {
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		ms = f
+	case int64:
+		ms = float64(v)
+	case float64:
+		ms = v
+	default:
+		return 0, false
+	}
+	return time.Duration(ms * float64(time.Millisecond)), true
+}
+
+// profileStage is the time one iterator or result processor of a profile took
+type profileStage struct {
+	Type string
+	Time time.Duration
+}
+
+// profileStages collects every node of an FT.PROFILE reply that has a Type and a Time,
+// in the order they appear
+func profileStages(reply interface{}) []profileStage {
+	items, ok := replyList(reply).([]interface{})
+	if !ok {
+		return nil
+	}
+	var stages []profileStage
+	var stage profileStage
+	var hasType, hasTime bool
+	for i, item := range items {
+		name, _ := item.(string)
+		if i+1 < len(items) {
+			switch name {
+			case "Type":
+				stage.Type, hasType = items[i+1].(string)
+			case "Time":
+				stage.Time, hasTime = profileMs(items[i+1])
+			}
+		}
+		stages = append(stages, profileStages(item)...)
+	}
+	if hasType && hasTime {
+		stages = append([]profileStage{stage}, stages...)
+	}
+	return stages
+}
+
+// ProfileQuery runs the KNN query of a random test image under FT.PROFILE and prints
+// the profile and the time spent in the vector reader and in the sorter
+func ProfileQuery(rdb *redis.Client, cfg Config) error {
+	records, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("%s has no test images", cfg.TestFile)
+	}
+	i := rand.New(rand.NewSource(cfg.Seed)).Intn(len(records))
+	embedding, err := cfg.parsePixels(records[i][1:])
+	if err != nil {
+		return err
+	}
+	weights, err := queryPixelWeights(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	weights.apply(embedding)
+
+	k := cfg.K
+	if k < 1 {
+		k = 1
+	}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	s := newSearcher(cfg, storage)
+	query, err := buildKNNQuery(KNNQuery{Index: "mnist_index", K: k, Storage: s.storage, Blob: s.storage.vectorBlob(embedding)})
+	if err != nil {
+		return err
+	}
+	profile := profileCommand(query)
+	queryCtx, cancel := s.withQueryTimeout(s.ctx)
+	defer cancel()
+	reply, err := rdb.Do(queryCtx, profile...).Result()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Profile of test image %d (expected = %s, k = %d):\n", i, records[i][0], k)
+	fmt.Printf("Command: %s\n", formatCommand(profile))
+	items, _ := reply.([]interface{})
+	if len(items) > 1 {
+		// The first element is the search result, the rest is the profile
+		fmt.Print(formatReply(items[1:], 1))
+	} else if m, ok := reply.(map[interface{}]interface{}); ok {
+		// RESP3 replies with the search result and the profile under their names
+		fmt.Print(formatReply(m["Profile"], 1))
+	}
+	if total, ok := profileValue(reply, "Total profile time"); ok {
+		fmt.Printf("Total Profile Time = %.3fms\n", durationMs(total))
+	}
+	var vector, sorter time.Duration
+	for _, stage := range profileStages(reply) {
+		fmt.Printf("%s Time = %.3fms\n", stage.Type, durationMs(stage.Time))
+		switch stage.Type {
+		case "VECTOR":
+			vector += stage.Time
+		case "Sorter":
+			sorter += stage.Time
+		}
+	}
+	fmt.Printf("Vector Reader Time = %.3fms\n", durationMs(vector))
+	fmt.Printf("Sorter Time = %.3fms\n", durationMs(sorter))
+	return nil
+}
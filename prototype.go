@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Classifiers selectable with -classifier
+const (
+	// classifierKNN votes among the K nearest training images.
+	classifierKNN = "knn"
+	// classifierCentroid picks the label of the nearest class mean.
+	classifierCentroid = "centroid"
+)
+
+var prototypeIndex = modeIndex("mnist_prototype_index")
+
+const prototypePrefix = "prototype:"
+
+// prototype is the stored mean embedding of one class. Count is the number of training
+// rows averaged so far, so later loads can update the mean.
+type prototype struct {
+	Result    int       `json:"result"`
+	Count     int       `json:"count"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// centroidSums accumulates the embeddings of the stored rows per label
+type centroidSums struct {
+	sums   map[int][]float64
+	counts map[int]int
+}
+
+func newCentroidSums() *centroidSums {
+	return &centroidSums{sums: map[int][]float64{}, counts: map[int]int{}}
+}
+
+// add accumulates one embedding of a label
+func (c *centroidSums) add(label int, embedding []float32) {
+	sum, ok := c.sums[label]
+	if !ok {
+		sum = make([]float64, len(embedding))
+		c.sums[label] = sum
+	}
+	for j, v := range embedding {
+		sum[j] += float64(v)
+	}
+	c.counts[label]++
+}
+
+// resetPrototypes drops the prototype index with its documents and creates it empty
+// for the storage of cfg
+func resetPrototypes(rdb *redis.Client, cfg Config) error {
+	// It is fine if the index does not exist yet
+	rdb.Do(ctx, "FT.DROPINDEX", prototypeIndex, "DD")
+	return createIndex(rdb, cfg, prototypeIndex, prototypePrefix)
+}
+
+// updatePrototypes merges the accumulated sums into the stored class means, creating the
+// prototype index for the storage of cfg when it does not exist yet
+func updatePrototypes(rdb *redis.Client, cfg Config, c *centroidSums) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	err = createIndex(rdb, cfg, prototypeIndex, prototypePrefix)
+	if err != nil && !strings.Contains(err.Error(), "Index already exists") {
+		return err
+	}
+
+	for label, sum := range c.sums {
+		key := fmt.Sprintf("%s%d", prototypePrefix, label)
+		p := prototype{Result: label}
+
+		stored, ok, err := loadPrototype(rdb, storage, key)
+		if err != nil {
+			return err
+		}
+		total := make([]float64, len(sum))
+		if ok && len(stored.Embedding) == len(sum) {
+			p.Count = stored.Count
+			for j, v := range stored.Embedding {
+				total[j] = float64(v) * float64(p.Count)
+			}
+		}
+
+		p.Count += c.counts[label]
+		p.Embedding = make([]float32, len(sum))
+		for j := range sum {
+			p.Embedding[j] = float32((total[j] + sum[j]) / float64(p.Count))
+		}
+		err = savePrototype(rdb, storage, key, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPrototype reads the class mean stored under key, ok is false when there is none
+func loadPrototype(rdb *redis.Client, storage Storage, key string) (p prototype, ok bool, err error) {
+	if storage.Mode == storageHash {
+		values, err := rdb.HMGet(ctx, key, "result", "count", "embedding").Result()
+		if err != nil || values[2] == nil {
+			return p, false, err
+		}
+		result, _ := values[0].(string)
+		count, _ := values[1].(string)
+		blob, _ := values[2].(string)
+		if p.Result, err = strconv.Atoi(result); err != nil {
+			return p, false, err
+		}
+		if p.Count, err = strconv.Atoi(count); err != nil {
+			return p, false, err
+		}
+		p.Embedding, err = storage.decodeVectorBlob([]byte(blob))
+		return p, err == nil, err
+	}
+
+	stored, err := rdb.Do(ctx, "JSON.GET", key, "$").Text()
+	if err == redis.Nil {
+		return p, false, nil
+	}
+	if err != nil {
+		return p, false, err
+	}
+	var matches []prototype
+	if err := json.Unmarshal([]byte(stored), &matches); err != nil {
+		return p, false, err
+	}
+	if len(matches) == 0 {
+		return p, false, nil
+	}
+	return matches[0], true, nil
+}
+
+// savePrototype stores a class mean under key
+func savePrototype(rdb *redis.Client, storage Storage, key string, p prototype) error {
+	if storage.Mode == storageHash {
+		return rdb.HSet(ctx, key, "result", p.Result, "count", p.Count, "embedding", storage.vectorBlob(p.Embedding)).Err()
+	}
+	doc, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return rdb.Do(ctx, "JSON.SET", key, "$", string(doc)).Err()
+}
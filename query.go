@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultDistanceAlias is the name the KNN distance is returned under
+const defaultDistanceAlias = "dist"
+
+// identifierPattern matches names that can be used as a field alias or parameter name
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// paramPattern matches the $name references of query parameters
+var paramPattern = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// defaultBlobParam is the name of the query vector parameter
+const defaultBlobParam = "blob"
+
+// KNNQuery describes a KNN FT.SEARCH command
+type KNNQuery struct {
+	// Index is the name of the index to search.
+	Index string
+	// Field is the vector field, "embedding" when empty.
+	Field string
+	// K is the number of neighbors to return.
+	K int
+	// Storage names the distance alias and the label field, "dist" and no label when empty.
+	Storage Storage
+	// Descending sorts the neighbors by decreasing distance instead of nearest first.
+	Descending bool
+	// Timeout is sent as the TIMEOUT of the query in milliseconds, the server default when zero.
+	Timeout time.Duration
+	// Return lists the returned fields, the ones of Storage when empty.
+	Return []string
+	// Filter is the query the KNN clause is applied to, "*" when empty, in parentheses
+	// when it has more than one term. It may reference the entries of Params as $name.
+	Filter string
+	// Param is the name of the parameter holding the query vector, "blob" when empty.
+	Param string
+	// Blob is the query vector, encoded with vectorBlob. It is sent as
+	// Param and can be left empty when Params holds the vector instead.
+	Blob []byte
+	// Params are the PARAMS of the query by name, for example further vectors.
+	// Every parameter must be referenced by the query and every reference must be set.
+	Params map[string]interface{}
+}
+
+// buildKNNQuery validates q and builds the FT.SEARCH command for it. The command is
+// always sorted by the distance alias, a KNN query without SORTBY returns the
+// neighbors in no particular order.
+func buildKNNQuery(q KNNQuery) ([]interface{}, error) {
+	if q.Index == "" {
+		return nil, fmt.Errorf("knn query needs an index")
+	}
+	if q.K < 1 {
+		return nil, fmt.Errorf("knn query needs k >= 1, got %d", q.K)
+	}
+	param := q.Param
+	if param == "" {
+		param = defaultBlobParam
+	}
+	if !identifierPattern.MatchString(param) {
+		return nil, fmt.Errorf("invalid parameter name %q", param)
+	}
+	params := map[string]interface{}{}
+	for name, value := range q.Params {
+		if !identifierPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid parameter name %q", name)
+		}
+		params[name] = value
+	}
+	if len(q.Blob) > 0 {
+		if _, ok := params[param]; ok {
+			return nil, fmt.Errorf("parameter %q is set both as the blob and in the params", param)
+		}
+		params[param] = q.Blob
+	}
+	if _, ok := params[param]; !ok {
+		return nil, fmt.Errorf("knn query needs a vector blob")
+	}
+	filter := q.Filter
+	if filter == "" {
+		filter = "*"
+	}
+	field := q.Field
+	if field == "" {
+		field = "embedding"
+	}
+	alias := q.Storage.DistanceAlias
+	if alias == "" {
+		alias = defaultDistanceAlias
+	}
+	if !identifierPattern.MatchString(field) {
+		return nil, fmt.Errorf("invalid vector field %q", field)
+	}
+	if !identifierPattern.MatchString(alias) {
+		return nil, fmt.Errorf("invalid distance alias %q", alias)
+	}
+	returnFields := q.Return
+	if len(returnFields) == 0 {
+		returnFields = q.Storage.returnFields()
+	}
+	direction := "ASC"
+	if q.Descending {
+		direction = "DESC"
+	}
+
+	search := fmt.Sprintf("%s=>[KNN %d @%s $%s AS %s]", filter, q.K, field, param, alias)
+	err := checkParams(search, params)
+	if err != nil {
+		return nil, err
+	}
+
+	query := []interface{}{
+		"FT.SEARCH",                // Explicitly using the FT.SEARCH command
+		q.Index,                    // Index name
+		search,                     // KNN search query
+		"SORTBY", alias, direction, // Sort by distance
+	}
+	query = append(query, "RETURN", strconv.Itoa(len(returnFields)))
+	for _, name := range returnFields {
+		query = append(query, name)
+	}
+	if q.Timeout > 0 {
+		query = append(query, "TIMEOUT", strconv.FormatInt(q.Timeout.Milliseconds(), 10))
+	}
+	query = append(query,
+		"LIMIT", "0", strconv.Itoa(q.K), // FT.SEARCH returns 10 results by default
+		// Params: search vector blob and the other parameters, as name value pairs
+		"PARAMS", strconv.Itoa(2*len(params)),
+	)
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		query = append(query, name, params[name])
+	}
+	query = append(query, "DIALECT", "2") // RedisSearch dialect 2
+	return query, nil
+}
+
+// checkParams makes sure the $name references of a query and its parameters match,
+// RediSearch rejects unknown references and a parameter that is never used is a mistake
+func checkParams(search string, params map[string]interface{}) error {
+	referenced := map[string]bool{}
+	for _, match := range paramPattern.FindAllStringSubmatch(search, -1) {
+		referenced[match[1]] = true
+		if _, ok := params[match[1]]; !ok {
+			return fmt.Errorf("query references $%s but no such parameter is set", match[1])
+		}
+	}
+	if len(referenced) != len(params) {
+		for name := range params {
+			if !referenced[name] {
+				return fmt.Errorf("parameter %q is not referenced by the query %q", name, search)
+			}
+		}
+	}
+	return nil
+}
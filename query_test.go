@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildKNNQuery(t *testing.T) {
+	blob := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name string
+		q    KNNQuery
+		want []interface{}
+	}{
+		{
+			name: "defaults",
+			q:    KNNQuery{Index: "mnist_index", K: 3, Blob: blob},
+			want: []interface{}{"FT.SEARCH", "mnist_index", "*=>[KNN 3 @embedding $blob AS dist]", "SORTBY", "dist", "ASC",
+				"RETURN", "1", "dist", "LIMIT", "0", "3", "PARAMS", "2", "blob", blob, "DIALECT", "2"},
+		},
+		{
+			name: "timeout and descending",
+			q:    KNNQuery{Index: "mnist_index", K: 1, Blob: blob, Descending: true, Timeout: 250 * time.Millisecond},
+			want: []interface{}{"FT.SEARCH", "mnist_index", "*=>[KNN 1 @embedding $blob AS dist]", "SORTBY", "dist", "DESC",
+				"RETURN", "1", "dist", "TIMEOUT", "250", "LIMIT", "0", "1", "PARAMS", "2", "blob", blob, "DIALECT", "2"},
+		},
+		{
+			name: "filter with params",
+			q: KNNQuery{Index: "idx", K: 5, Field: "preview", Param: "vec", Blob: blob, Filter: "@label:{$l}", Return: []string{"dist", "label"},
+				Storage: Storage{DistanceAlias: "score"}, Params: map[string]interface{}{"l": "7"}},
+			want: []interface{}{"FT.SEARCH", "idx", "@label:{$l}=>[KNN 5 @preview $vec AS score]", "SORTBY", "score", "ASC",
+				"RETURN", "2", "dist", "label", "LIMIT", "0", "5", "PARAMS", "4", "l", "7", "vec", blob, "DIALECT", "2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := buildKNNQuery(test.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("buildKNNQuery =\n%v\nwant\n%v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildKNNQueryErrors(t *testing.T) {
+	blob := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name string
+		q    KNNQuery
+		want string
+	}{
+		{"no index", KNNQuery{K: 1, Blob: blob}, "needs an index"},
+		{"zero k", KNNQuery{Index: "mnist_index", Blob: blob}, "k >= 1"},
+		{"negative k", KNNQuery{Index: "mnist_index", K: -2, Blob: blob}, "k >= 1"},
+		{"no blob", KNNQuery{Index: "mnist_index", K: 1}, "vector blob"},
+		{"blob twice", KNNQuery{Index: "mnist_index", K: 1, Blob: blob, Params: map[string]interface{}{"blob": blob}}, "both"},
+		{"invalid field", KNNQuery{Index: "mnist_index", K: 1, Blob: blob, Field: "embedding]"}, "invalid vector field"},
+		{"unreferenced param", KNNQuery{Index: "mnist_index", K: 1, Blob: blob, Params: map[string]interface{}{"unused": "1"}}, "unused"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := buildKNNQuery(test.q)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("buildKNNQuery error = %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
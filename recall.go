@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// exactIndex is a FLAT index over the training keys, built next to mnist_index to find
+// the exact neighbors the approximate ones are compared with
+var exactIndex = modeIndex("mnist_exact_index")
+
+// errRecallDeadline stops streaming the test images once -max-test-duration is reached
+var errRecallDeadline = errors.New("max test duration reached")
+
+// recallRun holds the state of Recall while the test images are compared
+type recallRun struct {
+	cfg      Config
+	k        int
+	weights  pixelWeights
+	searcher *searcher
+	writer   *csv.Writer
+	start    time.Time
+
+	processed, top1, recalled int
+	// exact is the time spent finding the exact neighbors, cost describes the memory
+	// they took
+	exact time.Duration
+	cost  string
+	// peakHeap is the largest client heap seen while streaming the training CSV
+	peakHeap uint64
+}
+
+// Recall compares the neighbors mnist_index returns with the exact ones of every test
+// image and writes the top-K keys of both and their overlap to cfg.RecallOut, one row
+// per image. The exact neighbors come from a FLAT index over the same documents, which
+// is built for the run and dropped afterwards, the documents themselves are kept. With
+// cfg.RecallStream they are computed here instead while the training CSV is streamed
+// once per batch of that many test images, which needs neither the copy of every
+// vector the FLAT index holds in Redis nor the whole CSV in memory. Recall@1 and
+// recall@K over all images are printed at the end, with the memory and time the exact
+// neighbors cost.
+func Recall(rdb *redis.Client, cfg Config) error {
+	weights, err := queryPixelWeights(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(cfg.RecallOut)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"index", "expected", "ann_keys", "exact_keys", "overlap", "top1_match"})
+
+	r := &recallRun{cfg: cfg, k: max(cfg.K, 1), weights: weights, searcher: newSearcher(cfg, storage), writer: writer}
+	if cfg.RecallStream > 0 {
+		err = r.stream(rdb)
+	} else {
+		err = r.index(rdb)
+	}
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if r.processed == 0 {
+		return fmt.Errorf("no test images were evaluated")
+	}
+
+	fmt.Printf("Recall of %s (%s) over %d test images, k = %d\n", "mnist_index", cfg.indexAlgorithm(), r.processed, r.k)
+	fmt.Printf("Recall@1 = %.2f%%\n", 100*float64(r.top1)/float64(r.processed))
+	fmt.Printf("Recall@%d = %.2f%%\n", r.k, 100*float64(r.recalled)/float64(r.processed*r.k))
+	fmt.Printf("Exact Neighbors: %s, %s in total, %.3fms per test image\n", r.cost, r.exact.Round(time.Millisecond), durationMs(r.exact)/float64(r.processed))
+	return file.Close()
+}
+
+// index finds the exact neighbors with a FLAT index over the stored documents
+func (r *recallRun) index(rdb *redis.Client) error {
+	test, err := r.cfg.readRecords(r.cfg.TestFile)
+	if err != nil {
+		return err
+	}
+
+	// It is fine if the index does not exist yet, the documents are shared so no DD
+	rdb.Do(ctx, "FT.DROPINDEX", exactIndex)
+	defer rdb.Do(ctx, "FT.DROPINDEX", exactIndex)
+	exactCfg := r.cfg
+	exactCfg.Algorithm = algorithmFlat
+	err = createIndex(rdb, exactCfg, exactIndex, r.searcher.storage.Keys.prefix)
+	if err != nil {
+		return err
+	}
+	build, err := waitForIndexing(rdb, exactIndex)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Built %s for the exact neighbors in %s\n", exactIndex, build.Round(time.Millisecond))
+	vectorMB, err := indexInfoValue(rdb, exactIndex, "vector_index_sz_mb")
+	if err != nil {
+		return err
+	}
+	r.cost = fmt.Sprintf("%s holds %.1fMB of vectors in Redis, built in %s", exactIndex, vectorMB, build.Round(time.Millisecond))
+
+	r.start = time.Now()
+	for i, record := range test {
+		if r.expired() {
+			break
+		}
+		embedding, err := r.embedding(record)
+		if err != nil {
+			return err
+		}
+		queryStart := time.Now()
+		exact, _, _, err := r.searcher.searchIndex(rdb, exactIndex, embedding, r.k)
+		if err != nil {
+			return err
+		}
+		r.exact += time.Since(queryStart)
+		err = r.compare(rdb, i, record, embedding, exact)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stream finds the exact neighbors of every batch of cfg.RecallStream test images in
+// one pass over the training CSV. The keys of the neighbors are derived from their row
+// like those of a plain load, so the data must be stored from the same CSV without
+// -sample-rate or -append.
+func (r *recallRun) stream(rdb *redis.Client) error {
+	passes := 0
+	r.start = time.Now()
+	err := r.cfg.streamRecords(r.cfg.TestFile, r.cfg.RecallStream, func(offset int, batch [][]string) error {
+		if r.expired() {
+			return errRecallDeadline
+		}
+		embeddings := make([][]float32, len(batch))
+		for n, record := range batch {
+			var err error
+			embeddings[n], err = r.embedding(record)
+			if err != nil {
+				return err
+			}
+		}
+		passStart := time.Now()
+		exact, err := r.streamExact(embeddings)
+		if err != nil {
+			return err
+		}
+		r.exact += time.Since(passStart)
+		passes++
+		for n, record := range batch {
+			if r.expired() {
+				return errRecallDeadline
+			}
+			err := r.compare(rdb, offset+n, record, embeddings[n], exact[n])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errRecallDeadline) {
+		return err
+	}
+	r.cost = fmt.Sprintf("streamed %s %d times, %d test images at a time, peak client heap %.1fMB", r.cfg.TrainFile, passes, r.cfg.RecallStream, float64(r.peakHeap)/(1<<20))
+	return nil
+}
+
+// streamExact reads the training CSV once and returns the k nearest training rows of
+// every embedding under the metric of this run
+func (r *recallRun) streamExact(embeddings [][]float32) ([][]SearchResult, error) {
+	norms := make([]float64, len(embeddings))
+	for q, embedding := range embeddings {
+		norms[q] = vectorNorm(embedding)
+	}
+	nearest := make([][]SearchResult, len(embeddings))
+	err := r.cfg.streamRecords(r.cfg.TrainFile, labelSample, func(offset int, batch [][]string) error {
+		for n, record := range batch {
+			label, err := strconv.Atoi(record[0])
+			if err != nil {
+				return err
+			}
+			pixels, err := r.cfg.parsePixels(record[1:])
+			if err != nil {
+				return err
+			}
+			r.weights.apply(pixels)
+			norm := vectorNorm(pixels)
+			for q, embedding := range embeddings {
+				d := distanceWithNorms(embedding, pixels, norms[q], norm, r.searcher.metric)
+				if len(nearest[q]) == r.k && d >= nearest[q][r.k-1].Distance {
+					continue
+				}
+				neighbor := SearchResult{Key: r.searcher.storage.Keys.key(offset+n, label), Label: label, Distance: d}
+				at := sort.Search(len(nearest[q]), func(i int) bool { return nearest[q][i].Distance > d })
+				if len(nearest[q]) < r.k {
+					nearest[q] = append(nearest[q], SearchResult{})
+				}
+				copy(nearest[q][at+1:], nearest[q][at:])
+				nearest[q][at] = neighbor
+			}
+		}
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		r.peakHeap = max(r.peakHeap, stats.HeapInuse)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for q := range nearest {
+		nearest[q] = r.searcher.reportedDistances(nearest[q])
+	}
+	return nearest, nil
+}
+
+// expired reports whether -max-test-duration is reached
+func (r *recallRun) expired() bool {
+	return r.cfg.MaxTestDuration > 0 && time.Since(r.start) >= r.cfg.MaxTestDuration
+}
+
+// embedding returns the query embedding of a test record
+func (r *recallRun) embedding(record []string) ([]float32, error) {
+	embedding, err := r.cfg.parsePixels(record[1:])
+	if err != nil {
+		return nil, err
+	}
+	r.weights.apply(embedding)
+	return embedding, nil
+}
+
+// compare queries mnist_index with test image i and records its neighbors against the
+// exact ones
+func (r *recallRun) compare(rdb *redis.Client, i int, record []string, embedding []float32, exact []SearchResult) error {
+	ann, _, _, err := r.searcher.searchNeighbors(rdb, embedding, r.k)
+	if err != nil {
+		return err
+	}
+
+	r.processed++
+	matched := len(ann) > 0 && len(exact) > 0 && ann[0].Key == exact[0].Key
+	if matched {
+		r.top1++
+	}
+	n := overlap(exact, ann)
+	r.recalled += n
+	return r.writer.Write([]string{
+		strconv.Itoa(i),
+		record[0],
+		neighborKeys(ann),
+		neighborKeys(exact),
+		strconv.Itoa(n),
+		strconv.FormatBool(matched),
+	})
+}
+
+// neighborKeys joins the keys of the neighbors with spaces, nearest first
+func neighborKeys(neighbors []SearchResult) string {
+	keys := make([]string, len(neighbors))
+	for i, neighbor := range neighbors {
+		keys[i] = neighbor.Key
+	}
+	return strings.Join(keys, " ")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// reconcileBatch is the number of stale keys removed per UNLINK
+const reconcileBatch = 1000
+
+// trainingKeys returns the keys StoreData writes with the layout keys for records
+// stored from offset on
+func trainingKeys(records [][]string, offset int, keys KeyTemplate) (map[string]bool, error) {
+	written := make(map[string]bool, len(records))
+	for n, record := range records {
+		label, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, err
+		}
+		written[keys.key(offset+n, label)] = true
+	}
+	return written, nil
+}
+
+// reconcileKeys removes the training keys that are not in written, left over from an
+// earlier load of a longer or reordered CSV, and returns how many were removed
+func reconcileKeys(rdb *redis.Client, written map[string]bool, keys KeyTemplate) (int, error) {
+	var stale []string
+	iter := rdb.Scan(ctx, 0, keys.scanPattern(), 1000).Iterator()
+	for iter.Next(ctx) {
+		if !written[iter.Val()] {
+			stale = append(stale, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	for start := 0; start < len(stale); start += reconcileBatch {
+		end := min(start+reconcileBatch, len(stale))
+		err := rdb.Unlink(ctx, stale[start:end]...).Err()
+		if err != nil {
+			return start, err
+		}
+	}
+	if len(stale) > 0 {
+		slog.Info("Removed stale keys.", slog.Int("keys", len(stale)))
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// checkpointRows is the number of training rows stored between two checkpoints. After
+// each chunk nextIndexKey points behind it, so a rebuilt client resumes from there.
+const checkpointRows = 5000
+
+// isConnectionError reports whether err means the connection to Redis is lost, as
+// opposed to an error reply of a command
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		// The server answered, only a restarting server is worth waiting for
+		return redisErr.Error() == "LOADING Redis is loading the dataset in memory"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, redis.ErrClosed)
+}
+
+// reconnect closes rdb and creates a new client with the same options once the server
+// answers a PING, waiting up to attempts times with a doubling delay
+func reconnect(rdb *redis.Client, attempts int) (*redis.Client, error) {
+	opt := *rdb.Options()
+	rdb.Close()
+
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		slog.Warn("Connection to Redis lost, reconnecting.", slog.Int("attempt", attempt), slog.Int("of", attempts), slog.Duration("delay", delay))
+		time.Sleep(delay)
+		client := redis.NewClient(&opt)
+		err = client.Ping(ctx).Err()
+		if err == nil {
+			slog.Info("Reconnected to Redis.", slog.String("addr", opt.Addr))
+			return client, nil
+		}
+		client.Close()
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+	return nil, err
+}
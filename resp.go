@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The replies of the module commands differ between the protocols. RESP2 sends every
+// object as a flat list of name, value pairs, while RESP3 sends maps, which go-redis
+// returns as map[interface{}]interface{}. The helpers below accept both, -protocol picks
+// the one the client speaks.
+
+// replyMap returns the name, value pairs of a RESP2 list or the entries of a RESP3 map
+func replyMap(reply interface{}) (map[string]interface{}, bool) {
+	switch v := reply.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for name, value := range v {
+			m[fmt.Sprint(name)] = value
+		}
+		return m, true
+	case []interface{}:
+		m := make(map[string]interface{}, len(v)/2)
+		for i := 0; i+1 < len(v); i += 2 {
+			name, ok := v[i].(string)
+			if !ok {
+				return nil, false
+			}
+			m[name] = v[i+1]
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+// replyList returns a RESP3 map as a RESP2 style list of name, value pairs sorted by
+// name, any other reply is returned as is
+func replyList(reply interface{}) interface{} {
+	m, ok := reply.(map[interface{}]interface{})
+	if !ok {
+		return reply
+	}
+	names := make([]string, 0, len(m))
+	values := make(map[string]interface{}, len(m))
+	for name, value := range m {
+		names = append(names, fmt.Sprint(name))
+		values[fmt.Sprint(name)] = value
+	}
+	sort.Strings(names)
+	list := make([]interface{}, 0, 2*len(m))
+	for _, name := range names {
+		list = append(list, name, values[name])
+	}
+	return list
+}
+
+// replyString returns a scalar reply element as text
+func replyString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// replyFloat returns a numeric reply element, RESP2 sends most numbers as text
+func replyFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("unexpected number %v (%T)", value, value)
+}
+
+// searchTotal returns the number of documents matching an FT.SEARCH query, the first
+// element of a RESP2 reply and the total_results of a RESP3 one
+func searchTotal(reply interface{}) (int64, error) {
+	if m, ok := reply.(map[interface{}]interface{}); ok {
+		total, err := replyFloat(m["total_results"])
+		return int64(total), err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) == 0 {
+		return 0, fmt.Errorf("unexpected result format")
+	}
+	total, err := replyFloat(items[0])
+	if err != nil {
+		return 0, fmt.Errorf("unexpected total format: %w", err)
+	}
+	return int64(total), nil
+}
+
+// searchDocument is one document of an FT.SEARCH reply
+type searchDocument struct {
+	key    string
+	fields map[string]interface{}
+}
+
+// searchDocuments returns the documents of an FT.SEARCH reply. RESP2 replies with the
+// total count followed by key, field list pairs. RESP3 replies with a map whose
+// results hold an id and the extra_attributes of every document.
+func searchDocuments(reply interface{}) ([]searchDocument, error) {
+	if m, ok := reply.(map[interface{}]interface{}); ok {
+		results, _ := m["results"].([]interface{})
+		docs := make([]searchDocument, 0, len(results))
+		for _, result := range results {
+			entry, ok := replyMap(result)
+			if !ok {
+				return nil, fmt.Errorf("unexpected result format: %v", result)
+			}
+			key, ok := entry["id"].(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected key format: %v", entry["id"])
+			}
+			fields, _ := replyMap(entry["extra_attributes"])
+			docs = append(docs, searchDocument{key: key, fields: fields})
+		}
+		return docs, nil
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("unexpected result format")
+	}
+	var docs []searchDocument
+	for i := 1; i < len(items); i += 2 {
+		key, ok := items[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected key format: %v", items[i])
+		}
+		doc := searchDocument{key: key}
+		if i+1 < len(items) {
+			doc.fields, _ = replyMap(items[i+1])
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var selfTestIndex = modeIndex("mnist_selftest_index")
+
+const selfTestPrefix = "selftest:"
+
+// selfTestVector returns a synthetic 784 dimensional vector for a label: a block of
+// ones at an offset that depends on the label, so every label is far from the others
+func selfTestVector(label int) []float32 {
+	vector := make([]float32, 784)
+	for i := label * 78; i < (label+1)*78; i++ {
+		vector[i] = 1
+	}
+	return vector
+}
+
+// selfTestDistance is the distance the metric reports between a vector and itself:
+// zero for L2 and COSINE, 1 minus the squared norm of the vector for IP
+func selfTestDistance(metric string, vector []float32) float64 {
+	if metric == metricIP {
+		norm := vectorNorm(vector)
+		return 1 - norm*norm
+	}
+	return 0
+}
+
+// SelfTest indexes one synthetic vector per label under a separate index, queries each
+// of them and a slightly perturbed copy, and checks that the expected label comes back
+// at the distance of a vector to itself under the metric, see selfTestDistance. The
+// index and its documents are dropped afterwards.
+func SelfTest(rdb *redis.Client, cfg Config) error {
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+	s := newSearcher(cfg, storage)
+	// Start from a clean index, it is fine if it does not exist yet
+	rdb.Do(ctx, "FT.DROPINDEX", selfTestIndex, "DD")
+
+	err = createIndex(rdb, cfg, selfTestIndex, selfTestPrefix)
+	if err != nil {
+		return fmt.Errorf("could not create self-test index: %w", err)
+	}
+	defer rdb.Do(ctx, "FT.DROPINDEX", selfTestIndex, "DD")
+
+	for label := 0; label < 10; label++ {
+		key := fmt.Sprintf("%s%d:%d", selfTestPrefix, label, label)
+		err := storeDocument(rdb, storage, key, label, selfTestVector(label))
+		if err != nil {
+			return fmt.Errorf("could not store %s: %w", key, err)
+		}
+	}
+
+	for label := 0; label < 10; label++ {
+		exact := selfTestVector(label)
+		neighbors, _, _, err := s.searchIndex(rdb, selfTestIndex, exact, 1)
+		if err != nil {
+			return fmt.Errorf("could not search label %d: %w", label, err)
+		}
+		want := selfTestDistance(s.metric, exact)
+		if neighbors[0].Label != label || math.Abs(neighbors[0].Distance-want) > 1e-6*math.Max(1, math.Abs(want)) {
+			return fmt.Errorf("exact query for label %d returned label %d at distance %f, want %f under %s", label, neighbors[0].Label, neighbors[0].Distance, want, s.metric)
+		}
+
+		// Dim a few pixels, the nearest neighbor must still be the same label
+		near := selfTestVector(label)
+		for i := label * 78; i < label*78+10; i++ {
+			near[i] = 0.9
+		}
+		neighbors, _, _, err = s.searchIndex(rdb, selfTestIndex, near, 1)
+		if err != nil {
+			return fmt.Errorf("could not search label %d: %w", label, err)
+		}
+		if neighbors[0].Label != label {
+			return fmt.Errorf("near query for label %d returned label %d", label, neighbors[0].Label)
+		}
+		fmt.Printf("Self-test label %d: ok\n", label)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// predictRequest is the body of a /predict call: the 784 grayscale pixels of a 28x28
+// image, row by row, in 0-255
+type predictRequest struct {
+	Pixels []int `json:"pixels"`
+}
+
+// predictBatchRequest is the body of a /predict/batch call, one image of 784 pixels in
+// 0-255 per entry
+type predictBatchRequest struct {
+	Images [][]int `json:"images"`
+}
+
+// batchPrediction is one entry of a /predict/batch reply, the prediction of the image or
+// the error of its query
+type batchPrediction struct {
+	*Prediction
+	Error string `json:"error,omitempty"`
+}
+
+// abstainResponse is the reply of a /predict call whose prediction is not trusted
+type abstainResponse struct {
+	Prediction
+	// Label is always null, it hides the voted label of the Prediction
+	Label  *int   `json:"label"`
+	Reason string `json:"reason"`
+}
+
+// errorResponse is the reply of a failed call
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Serve starts an HTTP server on cfg.Serve with a drawing page on / and the /predict
+// and /predict/batch endpoints, classifying images with the same Classifier options as SearchData. A
+// prediction whose nearest neighbor is farther than the max_distance query parameter,
+// or whose confidence is below min_confidence, is answered with 422 and a null label.
+// The parameters default to cfg.AbstainDistance and cfg.AbstainConfidence. A request
+// may send the true label with ?label=, and ?explain=1 adds the stored documents of the
+// neighbors to the reply. /stats and /metrics report the running accuracy
+// of those requests. Like SearchData it refuses to start when the stored data was
+// built with another normalization, storage, metric or vector type.
+func Serve(rdb *redis.Client, cfg Config) error {
+	static, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return err
+	}
+
+	// The queries of /predict would not compare with data stored with other settings
+	err = checkSettings(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	c, err := NewClassifier(rdb, cfg)
+	if err != nil {
+		return err
+	}
+	stats := newServingStats()
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/stats", stats.serveStats)
+	mux.HandleFunc("/metrics", stats.serveMetrics)
+	mux.HandleFunc("/predict", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "use POST"})
+			return
+		}
+		var req predictRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		embedding, err := queryEmbedding(cfg, req.Pixels)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		maxDistance, err := queryFloat(r, "max_distance", cfg.AbstainDistance)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		minConfidence, err := queryFloat(r, "min_confidence", cfg.AbstainConfidence)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		var label *int
+		if value := r.URL.Query().Get("label"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid label %q", value)})
+				return
+			}
+			label = &n
+		}
+		resp, err := c.predictEmbedding(embedding)
+		if errors.Is(err, errZeroVector) {
+			stats.record(label, rejectedLabel)
+			writeJSON(w, http.StatusUnprocessableEntity, abstainResponse{Reason: err.Error()})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, errorResponse{Error: err.Error()})
+			return
+		}
+		if r.URL.Query().Get("explain") == "1" {
+			err := c.explain(&resp)
+			if err != nil {
+				writeJSON(w, http.StatusBadGateway, errorResponse{Error: err.Error()})
+				return
+			}
+		}
+		if maxDistance > 0 && resp.Distance > maxDistance {
+			reason := fmt.Sprintf("nearest neighbor distance %.4f is above %.4f", resp.Distance, maxDistance)
+			stats.record(label, rejectedLabel)
+			writeJSON(w, http.StatusUnprocessableEntity, abstainResponse{Prediction: resp, Reason: reason})
+			return
+		}
+		if resp.Confidence < minConfidence {
+			reason := fmt.Sprintf("confidence %.2f is below %.2f", resp.Confidence, minConfidence)
+			stats.record(label, rejectedLabel)
+			writeJSON(w, http.StatusUnprocessableEntity, abstainResponse{Prediction: resp, Reason: reason})
+			return
+		}
+		stats.record(label, resp.Label)
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	mux.HandleFunc("/predict/batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "use POST"})
+			return
+		}
+		var req predictBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		if len(req.Images) == 0 {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "no images"})
+			return
+		}
+		embeddings := make([][]float32, len(req.Images))
+		for i, pixels := range req.Images {
+			embedding, err := queryEmbedding(cfg, pixels)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("image %d: %v", i, err)})
+				return
+			}
+			embeddings[i] = embedding
+		}
+		// All images are searched in one pipeline like SearchBatch, a failed query only
+		// fails its own entry
+		predictions, err := c.predictEmbeddings(embeddings)
+		var batchErr *BatchError
+		if err != nil && !errors.As(err, &batchErr) {
+			writeJSON(w, http.StatusBadGateway, errorResponse{Error: err.Error()})
+			return
+		}
+		resp := make([]batchPrediction, len(predictions))
+		for i := range predictions {
+			if batchErr != nil && batchErr.Errors[i] != nil {
+				resp[i].Error = batchErr.Errors[i].Error()
+				continue
+			}
+			resp[i].Prediction = &predictions[i]
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	slog.Info("Serving.", slog.String("addr", cfg.Serve))
+	return http.ListenAndServe(cfg.Serve, mux)
+}
+
+// queryEmbedding validates 0-255 pixels and builds their embedding like SearchData does
+func queryEmbedding(cfg Config, pixels []int) ([]float32, error) {
+	embedding, err := NormalizePixels(pixels)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Normalize {
+		for i, pixel := range pixels {
+			embedding[i] = float32(pixel)
+		}
+	}
+	return embedding, nil
+}
+
+// queryFloat reads a float query parameter, def when it is not given
+func queryFloat(r *http.Request, name string, def float64) (float64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return f, nil
+}
+
+// writeJSON writes a JSON reply with the given status
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// servingStats accumulates the /predict outcomes of a running server. Requests that
+// carry the true label with ?label= count towards the running accuracy, abstentions are
+// left out of it like rejected test images. It is safe for concurrent use.
+type servingStats struct {
+	mu    sync.Mutex
+	start time.Time
+	// predictions counts the answered and abstained requests, labeled the ones with a
+	// true label, correct and abstained split those
+	predictions int
+	labeled     int
+	correct     int
+	abstained   int
+	classes     classCounts
+}
+
+func newServingStats() *servingStats {
+	return &servingStats{start: time.Now(), classes: classCounts{}}
+}
+
+// record adds one prediction, label is nil unless the client sent the true label and
+// found is rejectedLabel for an abstention
+func (s *servingStats) record(label *int, found int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.predictions++
+	if label == nil {
+		return
+	}
+	s.labeled++
+	s.classes.add(*label, found)
+	switch found {
+	case rejectedLabel:
+		s.abstained++
+	case *label:
+		s.correct++
+	}
+}
+
+// classStats is the running accuracy of one true label in a /stats reply
+type classStats struct {
+	Labeled  int     `json:"labeled"`
+	Correct  int     `json:"correct"`
+	Accuracy float64 `json:"accuracy"`
+}
+
+// statsResponse is the reply of /stats
+type statsResponse struct {
+	Uptime      string `json:"uptime"`
+	Predictions int    `json:"predictions"`
+	Labeled     int    `json:"labeled"`
+	Correct     int    `json:"correct"`
+	Abstained   int    `json:"abstained"`
+	// Accuracy is correct over the labeled predictions that were answered, null before any
+	Accuracy *float64              `json:"accuracy"`
+	Classes  map[string]classStats `json:"classes"`
+}
+
+// snapshot returns the current totals
+func (s *servingStats) snapshot() statsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := statsResponse{
+		Uptime:      time.Since(s.start).Round(time.Second).String(),
+		Predictions: s.predictions,
+		Labeled:     s.labeled,
+		Correct:     s.correct,
+		Abstained:   s.abstained,
+		Classes:     map[string]classStats{},
+	}
+	if answered := s.labeled - s.abstained; answered > 0 {
+		accuracy := float64(s.correct) / float64(answered)
+		resp.Accuracy = &accuracy
+	}
+	for label, count := range s.classes {
+		if answered := count.total - count.rejected; answered > 0 {
+			resp.Classes[fmt.Sprint(label)] = classStats{Labeled: count.total, Correct: count.correct, Accuracy: float64(count.correct) / float64(answered)}
+		}
+	}
+	return resp
+}
+
+// serveStats answers /stats with the totals as JSON
+func (s *servingStats) serveStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.snapshot())
+}
+
+// serveMetrics answers /metrics with the totals in the Prometheus text format
+func (s *servingStats) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := s.snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP mnist_predictions_total Predictions answered or abstained by /predict.\n# TYPE mnist_predictions_total counter\nmnist_predictions_total %d\n", snap.Predictions)
+	fmt.Fprintf(w, "# HELP mnist_labeled_predictions_total Predictions whose request carried the true label.\n# TYPE mnist_labeled_predictions_total counter\nmnist_labeled_predictions_total %d\n", snap.Labeled)
+	fmt.Fprintf(w, "# HELP mnist_correct_predictions_total Labeled predictions that matched the true label.\n# TYPE mnist_correct_predictions_total counter\nmnist_correct_predictions_total %d\n", snap.Correct)
+	fmt.Fprintf(w, "# HELP mnist_abstained_predictions_total Labeled predictions answered with a null label.\n# TYPE mnist_abstained_predictions_total counter\nmnist_abstained_predictions_total %d\n", snap.Abstained)
+	if snap.Accuracy == nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP mnist_accuracy Running accuracy over the answered labeled predictions.\n# TYPE mnist_accuracy gauge\nmnist_accuracy %g\n", *snap.Accuracy)
+	labels := make([]string, 0, len(snap.Classes))
+	for label := range snap.Classes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	fmt.Fprintf(w, "# HELP mnist_class_accuracy Running accuracy per true label.\n# TYPE mnist_class_accuracy gauge\n")
+	for _, label := range labels {
+		fmt.Fprintf(w, "mnist_class_accuracy{label=%q} %g\n", label, snap.Classes[label].Accuracy)
+	}
+}
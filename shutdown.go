@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errLoadInterrupted is returned by StoreData after a SIGINT or SIGTERM stopped the load
+// and the rows stored so far were committed
+var errLoadInterrupted = errors.New("load interrupted")
+
+// shutdown stops the load early, either on SIGINT and SIGTERM, which it catches while
+// the training rows are stored, or when stop is called, so the load can flush its
+// pending batch and record the checkpoint before exiting
+type shutdown struct {
+	signals chan os.Signal
+	// reason describes why the load stops, err is what StoreData returns then
+	reason string
+	err    error
+}
+
+// newShutdown starts catching SIGINT and SIGTERM until release is called
+func newShutdown() *shutdown {
+	s := &shutdown{signals: make(chan os.Signal, 1)}
+	signal.Notify(s.signals, os.Interrupt, syscall.SIGTERM)
+	return s
+}
+
+// requested reports whether the load should stop. After a signal the signals are no
+// longer caught, so a second one terminates the process while it is flushing. A nil
+// shutdown is never requested.
+func (s *shutdown) requested() bool {
+	if s == nil {
+		return false
+	}
+	if s.reason != "" {
+		return true
+	}
+	select {
+	case sig := <-s.signals:
+		signal.Stop(s.signals)
+		s.stop(fmt.Sprintf("received %s", sig), errLoadInterrupted)
+		return true
+	default:
+		return false
+	}
+}
+
+// stop requests the load to stop for reason, StoreData returns err once the rows
+// stored so far are committed
+func (s *shutdown) stop(reason string, err error) {
+	if s.reason == "" {
+		s.reason, s.err = reason, err
+	}
+}
+
+// release restores the default handling of the signals
+func (s *shutdown) release() {
+	signal.Stop(s.signals)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// printSortedErrors lists up to n misclassified test images, all of them when n is
+// negative, by ascending distance to their nearest neighbor. The closest wrong guesses
+// are the most surprising ones and often point at a mislabeled training image, which is
+// why the nearest key is printed. With ascii the test image is rendered, and with
+// -store-pixels its neighbors too.
+func (c *Classifier) printSortedErrors(wrong []testResult, n int, ascii bool) {
+	sort.SliceStable(wrong, func(a, b int) bool { return wrong[a].distance < wrong[b].distance })
+	if n >= 0 && len(wrong) > n {
+		wrong = wrong[:n]
+	}
+	fmt.Printf("Misclassified test images by nearest neighbor distance (%s), most surprising first:\n", c.searcher.distanceName())
+	fmt.Printf("%6s %8s %8s %6s %12s  %s\n", "Rank", "Image", "Expected", "Found", "Distance", "Nearest")
+	for rank, r := range wrong {
+		fmt.Printf("%6d %8d %8d %6d %12.4f  %s\n", rank+1, r.index, r.expected, r.found, r.distance, r.nearest.Key)
+		if !ascii {
+			continue
+		}
+		fmt.Print(RenderASCII(ReshapeToGrid(r.embedding)))
+		if c.searcher.storage.Pixels {
+			c.printNeighborImages(r.neighbors)
+		}
+	}
+}
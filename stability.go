@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Stability runs the KNN query of every test image cfg.Stability times and reports how
+// often the voted label or the set of neighbors differs from the first run. An
+// approximate index such as HNSW (-algorithm HNSW) may answer differently from run to
+// run, the default FLAT index is exact and should always report zero. Every run is voted
+// with a fresh voter of the same seed, so -tiebreak random breaks the ties of identical
+// neighbors the same way.
+func Stability(rdb *redis.Client, cfg Config) error {
+	if cfg.Stability < 2 {
+		return fmt.Errorf("-stability needs at least 2 runs per query, got %d", cfg.Stability)
+	}
+	test, err := cfg.readRecords(cfg.TestFile)
+	if err != nil {
+		return err
+	}
+	c, err := NewClassifier(rdb, cfg)
+	if err != nil {
+		return err
+	}
+
+	var processed, labelChanged, neighborsChanged int
+	start := time.Now()
+	for i, record := range test {
+		if cfg.MaxTestDuration > 0 && time.Since(start) >= cfg.MaxTestDuration {
+			break
+		}
+		embedding, err := cfg.parsePixels(record[1:])
+		if err != nil {
+			return err
+		}
+		c.weights.apply(embedding)
+		first, _, err := c.search(rdb, embedding)
+		if err != nil {
+			return err
+		}
+		label := c.runVoter(i).vote(first)
+
+		var labelDiffers, neighborsDiffer bool
+		for run := 1; run < cfg.Stability; run++ {
+			neighbors, _, err := c.search(rdb, embedding)
+			if err != nil {
+				return err
+			}
+			if c.runVoter(i).vote(neighbors) != label {
+				labelDiffers = true
+			}
+			if len(neighbors) != len(first) || overlap(first, neighbors) != len(first) {
+				neighborsDiffer = true
+			}
+		}
+
+		processed++
+		if labelDiffers {
+			labelChanged++
+			fmt.Printf("Test image %d (expected %s): voted label changed between runs\n", i, record[0])
+		}
+		if neighborsDiffer {
+			neighborsChanged++
+		}
+	}
+	if processed == 0 {
+		return fmt.Errorf("no test images were evaluated")
+	}
+
+	fmt.Printf("Stability over %d test images, %d runs each, k = %d on %s\n", processed, cfg.Stability, c.k, c.Index())
+	fmt.Printf("Queries with a changed label = %d (%.2f%%)\n", labelChanged, 100*float64(labelChanged)/float64(processed))
+	fmt.Printf("Queries with a changed neighbor set = %d (%.2f%%)\n", neighborsChanged, 100*float64(neighborsChanged)/float64(processed))
+	return nil
+}
+
+// runVoter returns a voter with the priors of c whose random tie-break draws the same
+// ties for every run of test image i
+func (c *Classifier) runVoter(i int) *voter {
+	v := newVoter(c.cfg.TieBreak, c.cfg.Seed+int64(i))
+	v.priors = c.voter.priors
+	return v
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// rejectedLabel is reported instead of a label when a query is not answered
+const rejectedLabel = -1
+
+// classCount holds the results for the test images of one expected label
+type classCount struct {
+	total    int
+	correct  int
+	rejected int
+	// predicted counts the test images of any label classified as this one
+	predicted int
+}
+
+// classCounts accumulates results per expected label. It is keyed by the label
+// itself so datasets with more than ten classes or unusual label values work too.
+type classCounts map[int]*classCount
+
+// add records the outcome of one test image
+func (c classCounts) add(expected, found int) {
+	c.get(expected).total++
+	if found != rejectedLabel {
+		c.get(found).predicted++
+	}
+	count := c[expected]
+	switch found {
+	case rejectedLabel:
+		count.rejected++
+	case expected:
+		count.correct++
+	}
+}
+
+// get returns the counts of a label, adding them when the label is new
+func (c classCounts) get(label int) *classCount {
+	count, ok := c[label]
+	if !ok {
+		count = &classCount{}
+		c[label] = count
+	}
+	return count
+}
+
+// labels returns the expected and predicted labels seen so far in increasing order
+func (c classCounts) labels() []int {
+	labels := make([]int, 0, len(c))
+	for label := range c {
+		labels = append(labels, label)
+	}
+	sort.Ints(labels)
+	return labels
+}
+
+// print writes the accuracy of every class, leaving rejected images out
+func (c classCounts) print() {
+	fmt.Println("Label | Total | Correct | Rejected | Accuracy")
+	for _, label := range c.labels() {
+		count := c[label]
+		accuracy := 0.0
+		if answered := count.total - count.rejected; answered > 0 {
+			accuracy = 100 * float64(count.correct) / float64(answered)
+		}
+		fmt.Printf("%5d | %5d | %7d | %8d | %7.2f%%\n", label, count.total, count.correct, count.rejected, accuracy)
+	}
+}
+
+// printReport writes precision, recall and F1 of every class and their macro and
+// support weighted averages, laid out like the scikit-learn classification report.
+// Rejected images count against the recall of their class.
+func (c classCounts) printReport() {
+	var macro, weighted [3]float64
+	var support, correct, classes int
+	fmt.Printf("%12s %9s %9s %9s %9s\n\n", "", "precision", "recall", "f1-score", "support")
+	for _, label := range c.labels() {
+		count := c[label]
+		if count.total == 0 {
+			// Predicted but never expected, it only lowers the precision of others
+			continue
+		}
+		var precision, recall, f1 float64
+		if count.predicted > 0 {
+			precision = float64(count.correct) / float64(count.predicted)
+		}
+		recall = float64(count.correct) / float64(count.total)
+		if precision+recall > 0 {
+			f1 = 2 * precision * recall / (precision + recall)
+		}
+		fmt.Printf("%12d %9.2f %9.2f %9.2f %9d\n", label, precision, recall, f1, count.total)
+		for i, v := range []float64{precision, recall, f1} {
+			macro[i] += v
+			weighted[i] += v * float64(count.total)
+		}
+		support += count.total
+		correct += count.correct
+		classes++
+	}
+	if support == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("%12s %9s %9s %9.2f %9d\n", "accuracy", "", "", float64(correct)/float64(support), support)
+	fmt.Printf("%12s %9.2f %9.2f %9.2f %9d\n", "macro avg", macro[0]/float64(classes), macro[1]/float64(classes), macro[2]/float64(classes), support)
+	fmt.Printf("%12s %9.2f %9.2f %9.2f %9d\n", "weighted avg", weighted[0]/float64(support), weighted[1]/float64(support), weighted[2]/float64(support), support)
+}
+
+// labelPair is an expected label and the label found instead
+type labelPair struct {
+	expected int
+	found    int
+}
+
+// confusions counts the misclassified test images by expected and found label
+type confusions map[labelPair]int
+
+// printTop writes the n most frequent confusions, ties broken by the labels
+func (c confusions) printTop(n int) {
+	pairs := make([]labelPair, 0, len(c))
+	for pair := range c {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(a, b int) bool {
+		if c[pairs[a]] != c[pairs[b]] {
+			return c[pairs[a]] > c[pairs[b]]
+		}
+		if pairs[a].expected != pairs[b].expected {
+			return pairs[a].expected < pairs[b].expected
+		}
+		return pairs[a].found < pairs[b].found
+	})
+	if len(pairs) > n {
+		pairs = pairs[:n]
+	}
+	fmt.Printf("Top %d confused label pairs (expected -> found):\n", len(pairs))
+	for _, pair := range pairs {
+		fmt.Printf("%d -> %d: %d times\n", pair.expected, pair.found, c[pair])
+	}
+}
+
+// Stats collects the query durations of one evaluation in milliseconds. It is safe for
+// concurrent use, so workers may record their durations directly.
+type Stats struct {
+	mu        sync.Mutex
+	durations []int64
+	total     int64
+}
+
+// Record adds the duration of one query
+func (s *Stats) Record(ms int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.durations = append(s.durations, ms)
+	s.total += ms
+}
+
+// Count returns the number of recorded durations
+func (s *Stats) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.durations)
+}
+
+// Min returns the shortest duration, 0 when nothing was recorded
+func (s *Stats) Min() int64 {
+	return s.Percentile(0)
+}
+
+// Max returns the longest duration, 0 when nothing was recorded
+func (s *Stats) Max() int64 {
+	return s.Percentile(100)
+}
+
+// Average returns the mean duration, 0 when nothing was recorded
+func (s *Stats) Average() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.durations) == 0 {
+		return 0
+	}
+	return s.total / int64(len(s.durations))
+}
+
+// Percentile returns the duration p percent of the queries did not exceed, using the
+// nearest rank
+func (s *Stats) Percentile(p float64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.durations) == 0 {
+		return 0
+	}
+	sorted := append([]int64(nil), s.durations...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
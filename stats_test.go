@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestClassCountsBeyondTenLabels(t *testing.T) {
+	c := classCounts{}
+	c.add(35, 35)
+	c.add(35, 35)
+	c.add(35, 3)
+	c.add(3, 3)
+	c.add(3, rejectedLabel)
+
+	if got := c.labels(); len(got) != 2 || got[0] != 3 || got[1] != 35 {
+		t.Fatalf("labels = %v, want [3 35]", got)
+	}
+	want := map[int]classCount{
+		35: {total: 3, correct: 2, predicted: 2},
+		3:  {total: 2, correct: 1, rejected: 1, predicted: 2},
+	}
+	for label, count := range want {
+		if *c[label] != count {
+			t.Errorf("counts of label %d = %+v, want %+v", label, *c[label], count)
+		}
+	}
+
+	out := captureStdout(t, c.printReport)
+	for _, row := range []string{
+		"           3      0.50      0.50      0.50         2",
+		"          35      1.00      0.67      0.80         3",
+		"    accuracy                          0.60         5",
+	} {
+		if !strings.Contains(out, row+"\n") {
+			t.Errorf("report is missing the row %q:\n%s", row, out)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Storage modes selectable with -storage
+const (
+	// storageJSON stores {"result": ..., "embedding": [...]} documents with RedisJSON.
+	storageJSON = "json"
+	// storageHash stores hashes with a result field and a FLOAT32 blob embedding field.
+	storageHash = "hash"
+)
+
+// Storage describes how documents are stored and under which names a KNN query returns
+// their fields. The label field differs between the modes, a JSON document returns it
+// under its path "$.result" while a hash returns the plain field name.
+type Storage struct {
+	// Mode is storageJSON or storageHash.
+	Mode string
+	// LabelField is the returned field holding the label.
+	LabelField string
+	// DistanceAlias is the name the KNN distance is returned under.
+	DistanceAlias string
+	// Norms stores the L2 norm of every embedding in a norm field and returns it with
+	// the neighbors.
+	Norms bool
+	// Pixels stores the 0-255 pixels of every image base64 encoded in a pixels field, so
+	// a stored image can be rendered without the training CSV.
+	Pixels bool
+	// VectorType is the element type of the embedding blobs, of the hash field and of
+	// every query, vectorFloat32 when empty.
+	VectorType string
+	// Keys is the layout of the training keys, set from -key-template.
+	Keys KeyTemplate
+}
+
+// newStorage returns the Storage of a mode with the given distance alias
+func newStorage(mode, alias string) (Storage, error) {
+	if alias == "" {
+		alias = defaultDistanceAlias
+	}
+	if !identifierPattern.MatchString(alias) {
+		return Storage{}, fmt.Errorf("invalid distance alias %q", alias)
+	}
+	keys, _ := parseKeyTemplate(defaultKeyTemplate)
+	switch mode {
+	case storageJSON:
+		return Storage{Mode: mode, LabelField: "$.result", DistanceAlias: alias, Keys: keys}, nil
+	case storageHash:
+		return Storage{Mode: mode, LabelField: "result", DistanceAlias: alias, Keys: keys}, nil
+	}
+	return Storage{}, fmt.Errorf("unknown storage %q, expected json or hash", mode)
+}
+
+// storageOf returns the Storage of the -storage, -distance-alias, -store-norms,
+// -store-pixels, -vector-type and -key-template options of cfg. An empty -storage is
+// storageJSON.
+func storageOf(cfg Config) (Storage, error) {
+	mode := cfg.Storage
+	if mode == "" {
+		mode = storageJSON
+	}
+	s, err := newStorage(mode, cfg.DistanceAlias)
+	if err != nil {
+		return Storage{}, err
+	}
+	s.Norms = cfg.StoreNorms
+	s.Pixels = cfg.StorePixels
+	s.VectorType = cfg.VectorType
+	s.Keys, err = parseKeyTemplate(cfg.KeyTemplate)
+	if err != nil {
+		return Storage{}, err
+	}
+	return s, nil
+}
+
+// returnFields lists the fields a KNN query returns: the distance and the label
+func (s Storage) returnFields() []string {
+	alias := s.DistanceAlias
+	if alias == "" {
+		alias = defaultDistanceAlias
+	}
+	fields := []string{alias}
+	if s.LabelField != "" {
+		fields = append(fields, s.LabelField)
+	}
+	if s.Norms {
+		fields = append(fields, s.normField())
+	}
+	return fields
+}
+
+// label returns the label of a KNN neighbor from its returned fields, or from the
+// {label} of its key without a LabelField. RESP2 returns the label as text, a hash field
+// stored as binary or a RESP3 reply can also return it as bytes or a number, and a JSON
+// path may return it wrapped in a one element array. A missing field means the RETURN
+// clause does not match the stored documents.
+func (s Storage) label(doc searchDocument) (int, error) {
+	if s.LabelField == "" {
+		label, ok := s.Keys.parseLabel(doc.key)
+		if !ok {
+			return 0, fmt.Errorf("neighbor %s: key has no {label} of -key-template %s", doc.key, s.Keys.text)
+		}
+		return label, nil
+	}
+	value, ok := doc.fields[s.LabelField]
+	if !ok {
+		return 0, fmt.Errorf("neighbor %s has no %s field, does -storage match the stored data?", doc.key, s.LabelField)
+	}
+
+	switch v := value.(type) {
+	case int64:
+		return int(v), nil
+	case float64:
+		if v == math.Trunc(v) {
+			return int(v), nil
+		}
+	case []byte:
+		value = string(v)
+	}
+	if text, ok := value.(string); ok {
+		text = strings.TrimSpace(text)
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			text = strings.TrimSpace(text[1 : len(text)-1])
+		}
+		label, err := strconv.Atoi(text)
+		if err == nil {
+			return label, nil
+		}
+	}
+	return 0, fmt.Errorf("neighbor %s: %s = %#v is not an integer label", doc.key, s.LabelField, value)
+}
+
+// normField is the returned field holding the L2 norm of the embedding
+func (s Storage) normField() string {
+	if s.Mode == storageHash {
+		return "norm"
+	}
+	return "$.norm"
+}
+
+// indexType returns the ON argument of FT.CREATE
+func (s Storage) indexType() string {
+	if s.Mode == storageHash {
+		return "HASH"
+	}
+	return "JSON"
+}
+
+// embeddingField returns the SCHEMA argument naming the embedding field of FT.CREATE
+func (s Storage) embeddingField() []interface{} {
+	if s.Mode == storageHash {
+		return []interface{}{"embedding"}
+	}
+	return []interface{}{"$.embedding", "AS", "embedding"}
+}
+
+// setCommand builds the command storing a labeled embedding under key
+func (s Storage) setCommand(key string, result int, embedding []float32) ([]interface{}, error) {
+	if s.Mode == storageHash {
+		cmd := []interface{}{"HSET", key, "result", result, "embedding", s.vectorBlob(embedding)}
+		if s.Norms {
+			cmd = append(cmd, "norm", vectorNorm(embedding))
+		}
+		return cmd, nil
+	}
+	doc := jsonDocument{Result: result, Embedding: embedding}
+	if s.Norms {
+		norm := vectorNorm(embedding)
+		doc.Norm = &norm
+	}
+	// Marshal refuses NaN and infinite values instead of writing invalid JSON
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", key, err)
+	}
+	return []interface{}{"JSON.SET", key, "$", string(data)}, nil
+}
+
+// withPixels adds the encoded pixels built by encodePixels to a command of setCommand
+func (s Storage) withPixels(cmd []interface{}, pixels string) []interface{} {
+	if s.Mode == storageHash {
+		return append(cmd, "pixels", pixels)
+	}
+	// The base64 alphabet needs no escaping inside a JSON string
+	doc := cmd[len(cmd)-1].(string)
+	cmd[len(cmd)-1] = strings.TrimSuffix(doc, "}") + fmt.Sprintf(`,"pixels":"%s"}`, pixels)
+	return cmd
+}
+
+// decodePixels decodes the pixels encoded by encodePixels into 0-255 pixel values
+func decodePixels(encoded string) ([]float32, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	pixels := make([]float32, len(raw))
+	for i, b := range raw {
+		pixels[i] = float32(b)
+	}
+	return pixels, nil
+}
+
+// encodePixels encodes an embedding built by parsePixels as one byte per 0-255 pixel in
+// base64, 1048 characters for an MNIST image
+func encodePixels(embedding []float32, normalize bool) string {
+	raw := make([]byte, len(embedding))
+	for i, v := range embedding {
+		if normalize {
+			v *= 255
+		}
+		raw[i] = byte(math.Round(math.Max(0, math.Min(255, float64(v)))))
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// getNormCommand builds the command reading the stored L2 norm of the embedding under key
+func (s Storage) getNormCommand(key string) []interface{} {
+	if s.Mode == storageHash {
+		return []interface{}{"HGET", key, "norm"}
+	}
+	return []interface{}{"JSON.GET", key, "$.norm"}
+}
+
+// decodeNorm converts the reply of getNormCommand into the norm
+func (s Storage) decodeNorm(reply string) (float64, error) {
+	if s.Mode == storageHash {
+		return strconv.ParseFloat(reply, 64)
+	}
+	var matches []float64
+	if err := json.Unmarshal([]byte(reply), &matches); err != nil {
+		return 0, err
+	}
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("no norm")
+	}
+	return matches[0], nil
+}
+
+// getLabelCommand builds the command reading the label stored under key
+func (s Storage) getLabelCommand(key string) []interface{} {
+	if s.Mode == storageHash {
+		return []interface{}{"HGET", key, "result"}
+	}
+	return []interface{}{"JSON.GET", key, "$.result"}
+}
+
+// decodeLabel converts the reply of getLabelCommand into the label
+func (s Storage) decodeLabel(reply string) (int, error) {
+	if s.Mode == storageHash {
+		return strconv.Atoi(reply)
+	}
+	var matches []int
+	if err := json.Unmarshal([]byte(reply), &matches); err != nil {
+		return 0, err
+	}
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("no label")
+	}
+	return matches[0], nil
+}
+
+// getEmbeddingCommand builds the command reading the embedding stored under key
+func (s Storage) getEmbeddingCommand(key string) []interface{} {
+	if s.Mode == storageHash {
+		return []interface{}{"HGET", key, "embedding"}
+	}
+	return []interface{}{"JSON.GET", key, "$.embedding"}
+}
+
+// decodeEmbedding converts the reply of getEmbeddingCommand into the embedding
+func (s Storage) decodeEmbedding(reply string) ([]float32, error) {
+	if s.Mode == storageHash {
+		return s.decodeVectorBlob([]byte(reply))
+	}
+
+	// A JSONPath query returns an array of matches
+	var matches [][]float32
+	if err := json.Unmarshal([]byte(reply), &matches); err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no embedding")
+	}
+	return matches[0], nil
+}
+
+// convertBlobToFloat32Array decodes a blob written by convertFloat32ArrayToBlob
+func convertBlobToFloat32Array(blob []byte) ([]float32, error) {
+	if len(blob)%4 != 0 {
+		return nil, fmt.Errorf("blob of %d bytes is not a FLOAT32 vector", len(blob))
+	}
+	vector := make([]float32, len(blob)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:]))
+	}
+	return vector, nil
+}
+
+// checkStorage makes sure the stored data uses the same storage mode as this run
+func checkStorage(rdb *redis.Client, storage Storage) error {
+	stored, err := rdb.HGet(ctx, settingsKey, "storage").Result()
+	if err == redis.Nil {
+		// Data stored before the setting existed is always JSON
+		stored = storageJSON
+	} else if err != nil {
+		return err
+	}
+	if stored != storage.Mode {
+		return fmt.Errorf("data was stored with -storage %s but this run uses -storage %s", stored, storage.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStorageModes(t *testing.T) {
+	tests := []struct {
+		mode       string
+		schema     []interface{}
+		labelField string
+		// labels are the label values of the two neighbors as the mode returns them
+		labels [2]interface{}
+	}{
+		{storageJSON, []interface{}{"$.embedding", "AS", "embedding"}, "$.result", [2]interface{}{"7", "[3]"}},
+		{storageHash, []interface{}{"embedding"}, "result", [2]interface{}{"7", []byte("3")}},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			storage, err := storageOf(Config{Storage: test.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := storage.embeddingField(); !reflect.DeepEqual(got, test.schema) {
+				t.Errorf("embeddingField = %v, want %v", got, test.schema)
+			}
+
+			query, err := buildKNNQuery(KNNQuery{Index: "mnist_index", K: 2, Storage: storage, Blob: storage.vectorBlob([]float32{1, 0})})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query[2] != "*=>[KNN 2 @embedding $blob AS dist]" {
+				t.Errorf("query = %v, want the KNN clause on @embedding", query[2])
+			}
+			wantReturn := []interface{}{"RETURN", "2", "dist", test.labelField}
+			if got := query[6:10]; !reflect.DeepEqual(got, wantReturn) {
+				t.Errorf("query returns %v, want %v", got, wantReturn)
+			}
+
+			want := []SearchResult{{Key: "number:0:7", Label: 7, Distance: 0.5}, {Key: "number:1:3", Label: 3, Distance: 1.25}}
+			replies := map[string]interface{}{
+				"RESP2": []interface{}{int64(2),
+					"number:0:7", []interface{}{"dist", "0.5", test.labelField, test.labels[0]},
+					"number:1:3", []interface{}{"dist", "1.25", test.labelField, test.labels[1]},
+				},
+				"RESP3": map[interface{}]interface{}{
+					"total_results": int64(2),
+					"results": []interface{}{
+						map[interface{}]interface{}{"id": "number:0:7", "extra_attributes": map[interface{}]interface{}{"dist": "0.5", test.labelField: test.labels[0]}},
+						map[interface{}]interface{}{"id": "number:1:3", "extra_attributes": map[interface{}]interface{}{"dist": "1.25", test.labelField: test.labels[1]}},
+					},
+				},
+			}
+			for protocol, reply := range replies {
+				neighbors, total, err := parseSearchReply(reply, storage)
+				if err != nil {
+					t.Fatalf("%s: %v", protocol, err)
+				}
+				if total != 2 || !reflect.DeepEqual(neighbors, want) {
+					t.Errorf("%s: parseSearchReply = %v, %d, want %v, 2", protocol, neighbors, total, want)
+				}
+			}
+
+			empty := map[string]interface{}{
+				"RESP2": []interface{}{int64(0)},
+				"RESP3": map[interface{}]interface{}{"total_results": int64(0), "results": []interface{}{}},
+			}
+			for protocol, reply := range empty {
+				neighbors, total, err := parseSearchReply(reply, storage)
+				if err != nil || total != 0 || neighbors != nil {
+					t.Errorf("%s: parseSearchReply of an empty reply = %v, %d, %v, want no neighbors and a total of 0", protocol, neighbors, total, err)
+				}
+			}
+
+			// A reply of the other mode lacks the label field
+			other := []interface{}{int64(1), "number:0:7", []interface{}{"dist", "0.5", "label", "7"}}
+			if _, _, err := parseSearchReply(other, storage); err == nil {
+				t.Error("a reply without the label field parsed without an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// docWriter stores documents one by one or in batches. Batches of JSON documents are
+// written with a single JSON.MSET when the server supports it, other batches are
+// pipelined.
+// With a maxInFlight limit batches are sent in the background, and writing blocks while
+// that many documents are sent but not yet acknowledged.
+type docWriter struct {
+	rdb       *redis.Client
+	storage   Storage
+	batchSize int
+	mset      bool
+	keys      []string
+	cmds      [][]interface{}
+
+	// sem holds one token per in-flight document, nil when batches are sent synchronously
+	sem         chan struct{}
+	wg          sync.WaitGroup
+	inFlight    atomic.Int64
+	maxInFlight atomic.Int64
+	mu          sync.Mutex
+	err         error
+	// firstDone is when the first batch was acknowledged and firstRows its size, that
+	// batch pays for the connection setup and the index initialization
+	firstDone time.Time
+	firstRows int
+}
+
+// newDocWriter creates a writer of documents stored as storage flushing every batchSize
+// documents with at most maxInFlight documents pending, 0 sends every batch synchronously
+func newDocWriter(rdb *redis.Client, storage Storage, batchSize, maxInFlight int) *docWriter {
+	w := &docWriter{rdb: rdb, storage: storage, batchSize: batchSize}
+	if batchSize > 1 && storage.Mode == storageJSON {
+		w.mset = supportsCommand(rdb, "JSON.MSET")
+		if w.mset {
+			slog.Info("Writing JSON documents with JSON.MSET.", slog.Int("batch", batchSize))
+		} else {
+			slog.Info("JSON.MSET is not supported, writing JSON documents with pipelined JSON.SET.", slog.Int("batch", batchSize))
+		}
+	}
+	if maxInFlight > 0 {
+		w.sem = make(chan struct{}, maxInFlight)
+	}
+	return w
+}
+
+// supportsCommand reports whether the server knows the command, modules included
+func supportsCommand(rdb *redis.Client, name string) bool {
+	reply, err := rdb.Do(ctx, "COMMAND", "INFO", name).Slice()
+	return err == nil && len(reply) > 0 && reply[0] != nil
+}
+
+// write queues the command storing the document under key and flushes the batch once
+// it is full
+func (w *docWriter) write(key string, cmd []interface{}) error {
+	if err := w.firstError(); err != nil {
+		return err
+	}
+	w.keys = append(w.keys, key)
+	w.cmds = append(w.cmds, cmd)
+	if len(w.keys) >= w.batchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush sends the queued documents, in the background when an in-flight limit is set
+func (w *docWriter) flush() error {
+	if len(w.keys) == 0 {
+		return nil
+	}
+	keys, cmds := w.keys, w.cmds
+	w.keys, w.cmds = nil, nil
+
+	if w.sem == nil {
+		return w.send(keys, cmds)
+	}
+
+	// A batch larger than the limit only waits for the whole limit
+	tokens := len(keys)
+	if tokens > cap(w.sem) {
+		tokens = cap(w.sem)
+	}
+	for i := 0; i < tokens; i++ {
+		w.sem <- struct{}{}
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		err := w.send(keys, cmds)
+		for i := 0; i < tokens; i++ {
+			<-w.sem
+		}
+		if err != nil {
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// close flushes the remaining documents and waits for every pending batch
+func (w *docWriter) close() error {
+	err := w.flush()
+	w.wg.Wait()
+	if err != nil {
+		return err
+	}
+	return w.firstError()
+}
+
+// firstError returns the first error of a background batch
+func (w *docWriter) firstError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// send writes a batch of documents and waits for the reply
+func (w *docWriter) send(keys []string, cmds [][]interface{}) error {
+	inFlight := w.inFlight.Add(int64(len(keys)))
+	for {
+		observed := w.maxInFlight.Load()
+		if inFlight <= observed || w.maxInFlight.CompareAndSwap(observed, inFlight) {
+			break
+		}
+	}
+	defer w.inFlight.Add(-int64(len(keys)))
+
+	spanCtx, span := tracer.Start(ctx, "store batch", trace.WithAttributes(
+		attribute.Int("documents", len(keys)),
+		attribute.Bool("mset", w.mset),
+	))
+	defer span.End()
+
+	var err error
+	switch {
+	case len(keys) == 1:
+		// Execute the command directly in Redis
+		err = w.rdb.Do(spanCtx, cmds[0]...).Err()
+	case w.mset:
+		// JSON.MSET takes the key, path and value triples of the JSON.SET commands
+		args := []interface{}{"JSON.MSET"}
+		for _, cmd := range cmds {
+			args = append(args, cmd[1:]...)
+		}
+		err = w.rdb.Do(spanCtx, args...).Err()
+	default:
+		pipe := w.rdb.Pipeline()
+		for _, cmd := range cmds {
+			pipe.Do(spanCtx, cmd...)
+		}
+		_, err = pipe.Exec(spanCtx)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	w.mu.Lock()
+	if w.firstDone.IsZero() {
+		w.firstDone = time.Now()
+		w.firstRows = len(keys)
+	}
+	w.mu.Unlock()
+
+	for _, key := range keys {
+		fmt.Printf("Stored %s for %s\n", w.storage.indexType(), key)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// errServerTimeout marks a KNN query that RediSearch stopped at its TIMEOUT
+var errServerTimeout = errors.New("query timed out on the server")
+
+// errQueryTimeout marks a KNN query the client gave up on at its queryTimeout or the
+// read timeout of the connection
+var errQueryTimeout = errors.New("query timed out on the client")
+
+// isTimeout reports whether err is a KNN query stopped by either timeout, those are
+// left out of the accuracy instead of counted as wrong
+func isTimeout(err error) bool {
+	return errors.Is(err, errServerTimeout) || errors.Is(err, errQueryTimeout)
+}
+
+// timeoutError returns errServerTimeout when err means the server stopped the query at
+// its TIMEOUT, errQueryTimeout when the client stopped waiting for the reply and err
+// otherwise. reply is the FT.SEARCH reply err was derived from, nil if there is none.
+//
+// The serverTimeout of the searcher, set from -server-timeout, is sent as the TIMEOUT of
+// every KNN query. Zero leaves the server default of the search-timeout config in place.
+// What RediSearch does when the TIMEOUT expires depends on its ON_TIMEOUT config:
+//   - RETURN (the default) replies with the results found so far. A RESP3 reply lists
+//     "Timeout limit was reached" in its warning field, a reply without any neighbor is
+//     then counted as a server timeout. A RESP2 reply cannot flag it and is left alone.
+//   - FAIL replies with a "Timeout limit was reached" error.
+//
+// serverTimeout should be shorter than queryTimeout, otherwise the client gives up first.
+func (s *searcher) timeoutError(err error, reply interface{}) error {
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(err.Error(), "Timeout limit was reached") || (errors.Is(err, errNoNeighbors) && timedOutReply(reply)) {
+		return errServerTimeout
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errQueryTimeout
+	}
+	return err
+}
+
+// timedOutReply reports whether a RESP3 FT.SEARCH reply warns that the server stopped
+// the query at its TIMEOUT
+func timedOutReply(reply interface{}) bool {
+	m, ok := reply.(map[interface{}]interface{})
+	if !ok {
+		return false
+	}
+	list, _ := m["warning"].([]interface{})
+	for _, warning := range list {
+		if strings.Contains(replyString(warning), "Timeout") {
+			return true
+		}
+	}
+	return false
+}
+
+// withQueryTimeout derives the context of a KNN query from the queryTimeout of the
+// searcher, set from -query-timeout. Zero means no limit.
+//
+// Three timeouts decide how long a call can hang:
+//   - DialTimeout only covers opening a new connection.
+//   - ReadTimeout and WriteTimeout are socket deadlines for each command on an open
+//     connection, they are restarted by every command.
+//   - queryTimeout is a context deadline for the whole query, including waiting for a
+//     free pooled connection.
+//
+// go-redis sets the socket deadline to the earlier of the read/write timeout and the
+// context deadline, so the smaller of the two wins. Either one expiring during a read
+// is reported as "i/o timeout"; "context deadline exceeded" means queryTimeout expired
+// before the command was sent, typically while waiting for a pooled connection. Both
+// are counted as errQueryTimeout by timeoutError.
+func (s *searcher) withQueryTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, s.queryTimeout)
+}
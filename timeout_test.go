@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// silentServer accepts connections and never replies, like a Redis that hangs
+func silentServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestQueryTimeoutOnSilentServer(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: silentServer(t), MaxRetries: -1, ReadTimeout: -1, WriteTimeout: -1, ContextTimeoutEnabled: true})
+	defer rdb.Close()
+	storage, err := storageOf(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSearcher(Config{QueryTimeout: 50 * time.Millisecond}, storage)
+	embedding := []float32{0.5, 0.25}
+
+	start := time.Now()
+	_, _, _, err = s.knnSearch(s.ctx, rdb, "mnist_index", embedding, 1)
+	if !errors.Is(err, errQueryTimeout) {
+		t.Fatalf("knnSearch error = %v, want %v", err, errQueryTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("knnSearch returned after %s, want about the 50ms query timeout", elapsed)
+	}
+
+	_, err = s.knnSearchBatch(s.ctx, rdb, "mnist_index", [][]float32{embedding, embedding}, 1)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Errors) != 2 {
+		t.Fatalf("knnSearchBatch error = %v, want a *BatchError for both queries", err)
+	}
+	for i, err := range batchErr.Errors {
+		if !errors.Is(err, errQueryTimeout) {
+			t.Errorf("batch query %d error = %v, want %v", i, err, errQueryTimeout)
+		}
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	warned := map[interface{}]interface{}{"total_results": int64(0), "results": []interface{}{}, "warning": []interface{}{"Timeout limit was reached"}}
+	clean := map[interface{}]interface{}{"total_results": int64(0), "results": []interface{}{}, "warning": []interface{}{}}
+	tests := []struct {
+		name  string
+		err   error
+		reply interface{}
+		want  error
+	}{
+		{"nil", nil, nil, nil},
+		{"fail policy", errors.New("Timeout limit was reached"), nil, errServerTimeout},
+		{"no neighbors with warning", errNoNeighbors, warned, errServerTimeout},
+		{"no neighbors without warning", errNoNeighbors, clean, errNoNeighbors},
+		{"no neighbors RESP2", errNoNeighbors, []interface{}{int64(0)}, errNoNeighbors},
+		{"context deadline", fmt.Errorf("wait for a connection: %w", context.DeadlineExceeded), nil, errQueryTimeout},
+		{"read deadline", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, nil, errQueryTimeout},
+		{"other", errors.New("unknown index"), nil, nil},
+	}
+	s := newSearcher(Config{ServerTimeout: 100 * time.Millisecond}, Storage{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := s.timeoutError(test.err, test.reply)
+			want := test.want
+			if want == nil {
+				want = test.err
+			}
+			if !errors.Is(got, want) {
+				t.Errorf("timeoutError(%v) = %v, want %v", test.err, got, want)
+			}
+		})
+	}
+}
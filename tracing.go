@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// tracer creates the spans of the Redis calls. Until setupTracing installs a provider
+// it is a no-op.
+var tracer = otel.Tracer("github.com/mg52/redis-mnist-vector-search")
+
+// setupTracing exports spans over OTLP/HTTP to endpoint (e.g. http://localhost:4318).
+// The returned function flushes the pending spans and must be called before exiting.
+func setupTracing(endpoint string) (func(), error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("redis-mnist-vector-search"))),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		provider.Shutdown(context.Background())
+	}, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// validator evaluates a small validation set against mnist_index while StoreData is
+// still loading, which gives a learning curve of the single load
+type validator struct {
+	labels     []int
+	embeddings [][]float32
+	every      int
+	searcher   *searcher
+	// offset is the index of the first row of the load, last the number of loaded rows
+	// of the latest evaluation
+	offset int
+	last   int
+}
+
+// newValidator reads -val-file, it returns nil when no validation set is given
+func newValidator(cfg Config, offset int) (*validator, error) {
+	if cfg.ValFile == "" {
+		return nil, nil
+	}
+	records, err := cfg.readRecords(cfg.ValFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s has no validation images", cfg.ValFile)
+	}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return nil, err
+	}
+	v := &validator{every: cfg.ValEvery, searcher: newSearcher(cfg, storage), offset: offset}
+	for _, record := range records {
+		label, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, err
+		}
+		embedding, err := cfg.parsePixels(record[1:])
+		if err != nil {
+			return nil, err
+		}
+		cfg.loadWeights.apply(embedding)
+		v.labels = append(v.labels, label)
+		v.embeddings = append(v.embeddings, embedding)
+	}
+	return v, nil
+}
+
+// due reports whether the validation set is evaluated once the row at index i is
+// stored. A nil validator is never due.
+func (v *validator) due(i int) bool {
+	return v != nil && v.every > 0 && (i+1-v.offset)%v.every == 0
+}
+
+// evaluate classifies the validation images by their nearest neighbor in mnist_index
+// with searchVectorInRedis and prints the accuracy after loaded rows. An all zero image
+// the metric cannot rank is rejected and left out of the accuracy, as in Evaluate. A
+// chunk stored again after a reconnect does not repeat the evaluations it already printed.
+func (v *validator) evaluate(rdb *redis.Client, loaded int) error {
+	if v == nil || loaded <= v.last {
+		return nil
+	}
+	v.last = loaded
+	start := time.Now()
+	correct, rejected := 0, 0
+	for i, embedding := range v.embeddings {
+		neighbor, _, err := v.searcher.searchVectorInRedis(rdb, embedding)
+		if errors.Is(err, errZeroVector) {
+			rejected++
+			continue
+		}
+		if errors.Is(err, errNoNeighbors) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("validation image %d: %w", i, err)
+		}
+		if neighbor.Label == v.labels[i] {
+			correct++
+		}
+	}
+	accuracy := 0.0
+	if answered := len(v.labels) - rejected; answered > 0 {
+		accuracy = 100 * float64(correct) / float64(answered)
+	}
+	fmt.Printf("Validation after %d rows: accuracy = %.2f%% over %d images in %s", loaded, accuracy, len(v.labels)-rejected, time.Since(start).Round(time.Millisecond))
+	if rejected > 0 {
+		fmt.Printf(", %d all zero images rejected", rejected)
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Vector element types selectable with -vector-type. RediSearch has no 16 bit integer
+// type, a 16 bit embedding is stored as half precision floats.
+const (
+	vectorFloat32 = "FLOAT32"
+	// vectorFloat16 halves the vector memory. Raw 0-255 pixels are exact, scaled ones
+	// are off by at most 1/2048 of their value.
+	vectorFloat16 = "FLOAT16"
+)
+
+// validVectorType reports an error for an element type this tool does not encode
+func validVectorType(t string) error {
+	switch t {
+	case vectorFloat32, vectorFloat16:
+		return nil
+	}
+	return fmt.Errorf("unknown vector type %q, expected %s or %s", t, vectorFloat32, vectorFloat16)
+}
+
+// vectorType is the element type of the vectors of the storage, FLOAT32 unless set
+func (s Storage) vectorType() string {
+	if s.VectorType == "" {
+		return vectorFloat32
+	}
+	return s.VectorType
+}
+
+// vectorBlob encodes the vector as the little endian values of the vector type of the
+// storage, the format RediSearch expects for the query blob and the hash field of an
+// index of that type
+func (s Storage) vectorBlob(vector []float32) []byte {
+	if s.vectorType() != vectorFloat16 {
+		return convertFloat32ArrayToBlob(vector)
+	}
+	blob := make([]byte, 2*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint16(blob[2*i:], float32ToFloat16(v))
+	}
+	return blob
+}
+
+// decodeVectorBlob decodes a blob written by vectorBlob
+func (s Storage) decodeVectorBlob(blob []byte) ([]float32, error) {
+	if s.vectorType() != vectorFloat16 {
+		return convertBlobToFloat32Array(blob)
+	}
+	if len(blob)%2 != 0 {
+		return nil, fmt.Errorf("blob of %d bytes is not a FLOAT16 vector", len(blob))
+	}
+	vector := make([]float32, len(blob)/2)
+	for i := range vector {
+		vector[i] = float16ToFloat32(binary.LittleEndian.Uint16(blob[2*i:]))
+	}
+	return vector, nil
+}
+
+// roundToVectorType rounds every value to the nearest one the vector type of the
+// storage can hold, which is what a hash field of that type stores
+func (s Storage) roundToVectorType(vector []float32) {
+	if s.vectorType() != vectorFloat16 {
+		return
+	}
+	for i, v := range vector {
+		vector[i] = float16ToFloat32(float32ToFloat16(v))
+	}
+}
+
+// float32ToFloat16 converts f to the nearest IEEE 754 half precision value, ties to
+// even. Values beyond the half range become infinite, tiny ones subnormal or zero.
+func float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	biased := bits >> 23 & 0xff
+	mantissa := bits & 0x7fffff
+	exp := int32(biased) - 127 + 15
+	switch {
+	case bits&0x7fffffff == 0:
+		return sign
+	case biased == 0xff:
+		if mantissa != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		// The implicit leading bit becomes part of the subnormal significand
+		mantissa |= 0x800000
+		shift := uint32(14 - exp)
+		half := mantissa >> shift
+		rest, halfway := mantissa&(1<<shift-1), uint32(1)<<(shift-1)
+		if rest > halfway || (rest == halfway && half&1 == 1) {
+			half++
+		}
+		return sign | uint16(half)
+	}
+	half := uint32(exp)<<10 | mantissa>>13
+	// A carry out of the significand correctly rounds up into the exponent
+	rest := mantissa & 0x1fff
+	if rest > 0x1000 || (rest == 0x1000 && half&1 == 1) {
+		half++
+	}
+	return sign | uint16(half)
+}
+
+// float16ToFloat32 converts an IEEE 754 half precision value exactly to float32
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mantissa := uint32(h & 0x3ff)
+	switch exp {
+	case 0:
+		if mantissa == 0 {
+			return math.Float32frombits(sign)
+		}
+		// Normalize the subnormal value
+		biased := uint32(127 - 14)
+		for mantissa&0x400 == 0 {
+			mantissa <<= 1
+			biased--
+		}
+		return math.Float32frombits(sign | biased<<23 | (mantissa&0x3ff)<<13)
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mantissa<<13)
+}
+
+// checkVectorType makes sure the index was created with the vector type of this run,
+// queries encoded for another type would not match the stored vectors
+func checkVectorType(rdb *redis.Client, storage Storage) error {
+	stored, err := rdb.HGet(ctx, settingsKey, "vector_type").Result()
+	if err == redis.Nil {
+		// Data stored before the setting existed is always FLOAT32
+		stored = vectorFloat32
+	} else if err != nil {
+		return err
+	}
+	if stored != storage.vectorType() {
+		return fmt.Errorf("index was created with -vector-type %s but this run uses -vector-type %s", stored, storage.vectorType())
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultVerifyDecimals is the number of decimal places -verify compares. New documents
+// hold the exact float32 values, older ones were rounded to 6 decimals.
+const defaultVerifyDecimals = 6
+
+// verifyTolerance is the largest accepted difference between a stored and a freshly
+// computed value, abs plus rel times the expected value
+type verifyTolerance struct {
+	abs float64
+	rel float64
+}
+
+// newVerifyTolerance returns the tolerance of -verify. Without -verify-abs-tol the
+// absolute tolerance is one unit in the last compared decimal place, so fewer decimals
+// widen it.
+func newVerifyTolerance(cfg Config) verifyTolerance {
+	t := verifyTolerance{abs: cfg.VerifyAbsTol, rel: cfg.VerifyRelTol}
+	if t.abs == 0 {
+		t.abs = math.Pow(10, -float64(cfg.VerifyDecimals))
+	}
+	return t
+}
+
+// accepts reports whether stored matches expected within the tolerance
+func (t verifyTolerance) accepts(expected, stored float64) bool {
+	return math.Abs(expected-stored) <= t.abs+t.rel*math.Abs(expected)
+}
+
+// VerifyData compares the stored embeddings with the ones computed from the training
+// CSV and reports missing keys and values that differ by more than the tolerance of
+// -verify-decimals, -verify-abs-tol and -verify-rel-tol, with the largest deviation of
+// the mismatched rows. A random sample of cfg.VerifySample rows is checked unless
+// cfg.VerifyAll is set.
+func VerifyData(rdb *redis.Client, cfg Config) error {
+	tolerance := newVerifyTolerance(cfg)
+	weights, err := storedPixelWeights(rdb)
+	if err != nil {
+		return err
+	}
+	records, err := cfg.readRecords(cfg.TrainFile)
+	if err != nil {
+		return err
+	}
+	storage, err := storageOf(cfg)
+	if err != nil {
+		return err
+	}
+
+	rows := make([]int, len(records))
+	for i := range rows {
+		rows[i] = i
+	}
+	if !cfg.VerifyAll && cfg.VerifySample < len(rows) {
+		rng := rand.New(rand.NewSource(cfg.Seed))
+		rng.Shuffle(len(rows), func(a, b int) { rows[a], rows[b] = rows[b], rows[a] })
+		rows = rows[:cfg.VerifySample]
+		sort.Ints(rows)
+	}
+
+	var missing, mismatched int
+	// maxDeviation is the largest difference of any verified value, maxMismatch the
+	// largest one of a mismatched row
+	var maxDeviation, maxMismatch float64
+	const batchSize = 500
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		keys := make([]string, 0, end-start)
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.Cmd, 0, end-start)
+		for _, i := range rows[start:end] {
+			label, err := strconv.Atoi(records[i][0])
+			if err != nil {
+				return err
+			}
+			key := storage.Keys.key(i, label)
+			keys = append(keys, key)
+			cmds = append(cmds, pipe.Do(ctx, storage.getEmbeddingCommand(key)...))
+		}
+		// Missing keys show up as redis.Nil on their command
+		pipe.Exec(ctx)
+
+		for n, i := range rows[start:end] {
+			reply, err := cmds[n].Text()
+			if err == redis.Nil {
+				missing++
+				fmt.Printf("Missing %s\n", keys[n])
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			stored, err := storage.decodeEmbedding(reply)
+			if err != nil {
+				mismatched++
+				fmt.Printf("Mismatch %s: stored embedding cannot be decoded\n", keys[n])
+				continue
+			}
+			expected, err := cfg.parsePixels(records[i][1:])
+			if err != nil {
+				return err
+			}
+			weights.apply(expected)
+			// A hash holds the blob of the vector type, JSON the numbers as given
+			if storage.Mode == storageHash {
+				storage.roundToVectorType(expected)
+			}
+			msg, deviation := compareEmbeddings(expected, stored, tolerance)
+			maxDeviation = max(maxDeviation, deviation)
+			if msg != "" {
+				mismatched++
+				maxMismatch = max(maxMismatch, deviation)
+				fmt.Printf("Mismatch %s: %s\n", keys[n], msg)
+			}
+		}
+	}
+
+	fmt.Printf("Verified %d of %d rows: %d missing, %d mismatched\n", len(rows), len(records), missing, mismatched)
+	fmt.Printf("Tolerance = %g absolute + %g relative, max deviation = %g\n", tolerance.abs, tolerance.rel, maxDeviation)
+	if mismatched > 0 {
+		fmt.Printf("Max deviation of the mismatched rows = %g\n", maxMismatch)
+	}
+	if missing > 0 || mismatched > 0 {
+		return fmt.Errorf("%d of %d verified rows do not match the CSV", missing+mismatched, len(rows))
+	}
+	return nil
+}
+
+// compareEmbeddings describes the first difference between two embeddings outside the
+// tolerance, or returns an empty string when they match. It also returns the largest
+// deviation of any value, infinite when the lengths differ.
+func compareEmbeddings(expected, stored []float32, tolerance verifyTolerance) (string, float64) {
+	if len(expected) != len(stored) {
+		return fmt.Sprintf("expected %d values, stored %d", len(expected), len(stored)), math.Inf(1)
+	}
+	msg := ""
+	var deviation float64
+	for j := range expected {
+		deviation = max(deviation, math.Abs(float64(expected[j])-float64(stored[j])))
+		if msg == "" && !tolerance.accepts(float64(expected[j]), float64(stored[j])) {
+			msg = fmt.Sprintf("value %d is %g, expected %g", j, stored[j], expected[j])
+		}
+	}
+	if msg != "" {
+		msg += fmt.Sprintf(", max deviation %g", deviation)
+	}
+	return msg, deviation
+}
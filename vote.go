@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// priorsKey counts the stored training rows per label. Like settingsKey it is outside
+// of the number: prefix.
+const priorsKey = "mnist_index:priors"
+
+// Tie-break strategies for the KNN majority vote
+const (
+	// tieBreakNearest picks the label of the closest neighbor among the tied labels.
+	tieBreakNearest = "nearest"
+	// tieBreakLowestLabel picks the numerically smallest tied label.
+	tieBreakLowestLabel = "lowest-label"
+	// tieBreakRandom picks one of the tied labels with the seeded random generator.
+	tieBreakRandom = "random"
+)
+
+// validTieBreak reports an error for an unknown tie-break strategy
+func validTieBreak(tieBreak string) error {
+	switch tieBreak {
+	case tieBreakNearest, tieBreakLowestLabel, tieBreakRandom:
+		return nil
+	}
+	return fmt.Errorf("unknown tie-break %q, expected %s, %s or %s", tieBreak, tieBreakNearest, tieBreakLowestLabel, tieBreakRandom)
+}
+
+// voter turns the neighbors of a query into a predicted label by majority vote. It is
+// safe for concurrent use by the search workers.
+type voter struct {
+	tieBreak string
+	// priors holds the frequency of every label in the training set. When set, the vote
+	// of a neighbor is divided by the frequency of its label.
+	priors map[int]float64
+	mu     sync.Mutex
+	rng    *rand.Rand
+}
+
+// newVoter creates a voter resolving ties with tieBreak, seeded with seed for the random strategy
+func newVoter(tieBreak string, seed int64) *voter {
+	return &voter{tieBreak: tieBreak, rng: rand.New(rand.NewSource(seed))}
+}
+
+// vote returns the label with the most votes among the neighbors, which are sorted
+// nearest first. Votes are weighted by the inverse label priors when they are set.
+func (v *voter) vote(neighbors []SearchResult) int {
+	return v.voteWeighted(neighbors, v.priors)
+}
+
+// unweightedVote returns the most common label among the neighbors, ignoring the priors
+func (v *voter) unweightedVote(neighbors []SearchResult) int {
+	return v.voteWeighted(neighbors, nil)
+}
+
+func (v *voter) voteWeighted(neighbors []SearchResult, priors map[int]float64) int {
+	scores := map[int]float64{}
+	best := 0.0
+	for _, neighbor := range neighbors {
+		weight := 1.0
+		if prior := priors[neighbor.Label]; prior > 0 {
+			weight = 1 / prior
+		}
+		scores[neighbor.Label] += weight
+		if scores[neighbor.Label] > best {
+			best = scores[neighbor.Label]
+		}
+	}
+
+	// Tied labels in order of their closest neighbor
+	var tied []int
+	seen := map[int]bool{}
+	for _, neighbor := range neighbors {
+		if math.Abs(scores[neighbor.Label]-best) < 1e-9*best && !seen[neighbor.Label] {
+			seen[neighbor.Label] = true
+			tied = append(tied, neighbor.Label)
+		}
+	}
+	if len(tied) == 1 {
+		return tied[0]
+	}
+
+	switch v.tieBreak {
+	case tieBreakLowestLabel:
+		lowest := tied[0]
+		for _, label := range tied[1:] {
+			if label < lowest {
+				lowest = label
+			}
+		}
+		return lowest
+	case tieBreakRandom:
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return tied[v.rng.Intn(len(tied))]
+	default:
+		return tied[0]
+	}
+}
+
+// loadPriors reads the label counts recorded while storing and turns them into frequencies
+func loadPriors(rdb *redis.Client) (map[int]float64, error) {
+	counts, err := rdb.HGetAll(ctx, priorsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(counts) == 0 {
+		return nil, fmt.Errorf("no label counts found in %s, store the training data first", priorsKey)
+	}
+
+	var total float64
+	priors := map[int]float64{}
+	for labelString, countString := range counts {
+		label, err := strconv.Atoi(labelString)
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.ParseFloat(countString, 64)
+		if err != nil {
+			return nil, err
+		}
+		priors[label] = count
+		total += count
+	}
+	for label := range priors {
+		priors[label] /= total
+	}
+	return priors, nil
+}
+
+// recordLabelCounts adds the number of stored rows per label to the priors hash
+func recordLabelCounts(rdb *redis.Client, counts map[int]int) error {
+	pipe := rdb.Pipeline()
+	for label, count := range counts {
+		pipe.HIncrBy(ctx, priorsKey, strconv.Itoa(label), int64(count))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// countLabel returns the number of neighbors with the given label
+func countLabel(neighbors []SearchResult, label int) int {
+	count := 0
+	for _, neighbor := range neighbors {
+		if neighbor.Label == label {
+			count++
+		}
+	}
+	return count
+}
+
+// printAgreement writes how many queries had each number of neighbors agreeing with
+// the voted label, from unanimous down to the weakest plurality
+func printAgreement(agreement map[int]int, k int) {
+	total := 0
+	for _, count := range agreement {
+		total += count
+	}
+	if total == 0 {
+		return
+	}
+	fmt.Println("Agreeing Neighbors | Queries | Share")
+	for agreeing := k; agreeing >= 1; agreeing-- {
+		count := agreement[agreeing]
+		if count == 0 {
+			continue
+		}
+		fmt.Printf("%12d of %d | %7d | %5.1f%%\n", agreeing, k, count, 100*float64(count)/float64(total))
+	}
+	fmt.Printf("Unanimous votes = %.1f%%\n", 100*float64(agreement[k])/float64(total))
+}
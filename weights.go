@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pixelVariance computes the weights of -pixel-weights from the training set
+const pixelVariance = "variance"
+
+// pixelWeights scales every pixel of the stored and the query embeddings, so the L2
+// distance counts informative pixels more. A nil pixelWeights leaves them as they are.
+type pixelWeights []float32
+
+// apply multiplies the embedding in place with the weights, nil weights do nothing
+func (w pixelWeights) apply(embedding []float32) {
+	if w == nil {
+		return
+	}
+	for i := range embedding {
+		if i < len(w) {
+			embedding[i] *= w[i]
+		}
+	}
+}
+
+// encode returns the weights as the comma separated text kept in the settings
+func (w pixelWeights) encode() string {
+	values := make([]string, len(w))
+	for i, v := range w {
+		values[i] = strconv.FormatFloat(float64(v), 'g', -1, 32)
+	}
+	return strings.Join(values, ",")
+}
+
+// parsePixelWeights reads NumPixels finite, non-negative weights separated by commas,
+// spaces or newlines
+func parsePixelWeights(text string) (pixelWeights, error) {
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(fields) != NumPixels {
+		return nil, fmt.Errorf("expected %d pixel weights, got %d", NumPixels, len(fields))
+	}
+	w := make(pixelWeights, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(field, 32)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, fmt.Errorf("invalid pixel weight %d: %q, expected a non-negative number", i, field)
+		}
+		w[i] = float32(v)
+	}
+	return w, nil
+}
+
+// varianceWeights weighs every pixel by its variance over the training rows, scaled so
+// the most varying pixel gets 1. The borders, which are almost always 0, get close to
+// no weight. The records are parsed with the pixel type of cfg.
+func varianceWeights(cfg Config, records [][]string) (pixelWeights, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no training rows to compute the pixel variance from")
+	}
+	sum := make([]float64, NumPixels)
+	squares := make([]float64, NumPixels)
+	for _, record := range records {
+		pixels, err := cfg.parseRawPixels(record[1:])
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range pixels {
+			sum[i] += float64(v)
+			squares[i] += float64(v) * float64(v)
+		}
+	}
+	n := float64(len(records))
+	variance := make([]float64, NumPixels)
+	var largest float64
+	for i := range variance {
+		mean := sum[i] / n
+		variance[i] = math.Max(0, squares[i]/n-mean*mean)
+		largest = math.Max(largest, variance[i])
+	}
+	if largest == 0 {
+		return nil, fmt.Errorf("every pixel is constant over the training rows")
+	}
+	w := make(pixelWeights, NumPixels)
+	for i, v := range variance {
+		w[i] = float32(v / largest)
+	}
+	return w, nil
+}
+
+// resolvePixelWeights returns the weights of -pixel-weights: nil when it is empty, the
+// variance of the training records or the weights read from a file
+func resolvePixelWeights(cfg Config, records [][]string) (pixelWeights, error) {
+	switch cfg.PixelWeights {
+	case "":
+		return nil, nil
+	case pixelVariance:
+		return varianceWeights(cfg, records)
+	}
+	data, err := os.ReadFile(cfg.PixelWeights)
+	if err != nil {
+		return nil, err
+	}
+	w, err := parsePixelWeights(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.PixelWeights, err)
+	}
+	return w, nil
+}
+
+// storedPixelWeights returns the weights the stored embeddings were built with, nil
+// when they were stored without
+func storedPixelWeights(rdb *redis.Client) (pixelWeights, error) {
+	stored, err := rdb.HGet(ctx, settingsKey, "pixel_weights").Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsePixelWeights(stored)
+}
+
+// queryPixelWeights returns the weights queries against the stored data must apply.
+// They are always the stored ones, so the query and the stored embeddings are weighted
+// identically. The run must ask for weights exactly when the data has them, and a
+// weights file must hold the stored weights.
+func queryPixelWeights(rdb *redis.Client, cfg Config) (pixelWeights, error) {
+	stored, err := storedPixelWeights(rdb)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case stored == nil && cfg.PixelWeights != "":
+		return nil, fmt.Errorf("data was stored without pixel weights but this run uses -pixel-weights %s", cfg.PixelWeights)
+	case stored != nil && cfg.PixelWeights == "":
+		return nil, fmt.Errorf("data was stored with pixel weights, pass -pixel-weights to weigh the queries the same way")
+	case stored != nil && cfg.PixelWeights != pixelVariance:
+		w, err := resolvePixelWeights(cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		if w.encode() != stored.encode() {
+			return nil, fmt.Errorf("the weights of -pixel-weights %s differ from the ones the data was stored with", cfg.PixelWeights)
+		}
+	}
+	if stored != nil {
+		cfg.logger().Info("Weighing the query pixels like the stored data.", slog.String("pixel weights", cfg.PixelWeights))
+	}
+	return stored, nil
+}